@@ -1,35 +1,68 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/downloader"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/seeder"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
 )
 
-func runCommand(command string, args []string) error {
+// dhtLookupTimeout bounds the DHT search when trackers have no peers
+const dhtLookupTimeout = 30 * time.Second
+
+// peerHandshakeTimeout bounds each peer's handshake when trying peers in turn
+const peerHandshakeTimeout = 10 * time.Second
+
+// seedStatsInterval is how often the seed command reports what it uploaded
+const seedStatsInterval = 30 * time.Second
+
+func runCommand(ctx context.Context, command string, args []string) error {
 	switch command {
 	case "decode":
-		return handleDecode(args[2])
+		return handleDecode(args)
 	case "info":
 		return handleInfo(args[2])
+	case "files":
+		return handleFiles(args)
+	case "lint":
+		return handleLint(args[2])
+	case "create":
+		return handleCreate(args)
+	case "verify":
+		return handleVerify(args)
 	case "peers":
-		return handlePeers(args[2])
+		return handlePeers(args)
+	case "plan":
+		return handlePlan(args)
+	case "scrape":
+		return handleScrape(args[2])
 	case "handshake":
 		return handleHandshake(args)
 	case "download_piece":
 		return handleDownloadPiece(args)
 	case "download":
-		return handleDownload(args)
+		return handleDownload(ctx, args)
+	case "seed":
+		return handleSeed(ctx, args)
+	case "magnet_create":
+		return handleMagnetCreate(args[2])
 	case "magnet_parse":
 		return handleMagnetParse(args[2])
 	case "magnet_handshake":
@@ -39,7 +72,7 @@ func runCommand(command string, args []string) error {
 	case "magnet_download_piece":
 		return handleMagnetDownloadPiece(args)
 	case "magnet_download":
-		return handleMagnetDownload(args)
+		return handleMagnetDownload(ctx, args)
 	default:
 
 	}
@@ -47,12 +80,31 @@ func runCommand(command string, args []string) error {
 
 }
 
-func handleDecode(bencodedValue string) error {
+// handleDecode prints a bencoded value as JSON, or with --pretty in a format
+// that shows binary strings as hex instead of mangling them
+func handleDecode(args []string) error {
+	pretty := args[2] == "--pretty"
+	bencodedValue := args[2]
+	if pretty {
+		if len(args) < 4 {
+			return fmt.Errorf("usage: decode [--pretty] <bencoded value>")
+		}
+		bencodedValue = args[3]
+	}
+
 	decoded, err := bencode.Decode([]byte(bencodedValue))
 	if err != nil {
 		return err
 	}
+	if pretty {
+		fmt.Println(bencode.Format(decoded))
+		return nil
+	}
+
 	jsonOutput, err := json.Marshal(decoded)
+	if err != nil {
+		return fmt.Errorf("error encoding decoded value as JSON: %w", err)
+	}
 	fmt.Println(string(jsonOutput))
 	return nil
 }
@@ -66,8 +118,111 @@ func handleInfo(filePath string) error {
 	return nil
 }
 
-func handlePeers(filePath string) error {
-	t, err := metainfo.DeserializeTorrent(filePath)
+// handleFiles lists a torrent's files, one per line as tab-separated index,
+// length, first piece, last piece and path. An optional second argument keeps
+// only the files whose path contains it.
+func handleFiles(args []string) error {
+	t, err := metainfo.DeserializeTorrent(args[2])
+	if err != nil {
+		return err
+	}
+
+	filter := ""
+	if len(args) > 3 {
+		filter = args[3]
+	}
+	for _, f := range t.Info.FileEntries() {
+		if !strings.Contains(f.Path, filter) {
+			continue
+		}
+		fmt.Printf("%d\t%d\t%d\t%d\t%s\n", f.Index, f.Length, f.FirstPiece, f.LastPiece, f.Path)
+	}
+	return nil
+}
+
+func handleLint(filePath string) error {
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	problems := metainfo.Lint(contents)
+	if len(problems) == 0 {
+		fmt.Println("OK")
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	return fmt.Errorf("%s: %d problem(s) found", filePath, len(problems))
+}
+
+func handleCreate(args []string) error {
+	torrentFilePath := args[3]
+	sourcePath := args[4]
+	trackerURL := args[5]
+
+	pieceLength := 0
+	if len(args) > 6 {
+		var err error
+		if pieceLength, err = strconv.Atoi(args[6]); err != nil {
+			return err
+		}
+	}
+
+	t, err := metainfo.CreateTorrent(sourcePath, trackerURL, pieceLength)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(torrentFilePath, t.Serialize(), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s (info hash %s)\n", torrentFilePath, t.Info.GetHexInfoHash())
+	return nil
+}
+
+func handleVerify(args []string) error {
+	torrentFilePath := args[2]
+	dataPath := args[3]
+
+	t, err := metainfo.DeserializeTorrent(torrentFilePath)
+	if err != nil {
+		return err
+	}
+
+	valid, err := t.Info.VerifyFile(dataPath)
+	if err != nil {
+		return err
+	}
+
+	good := 0
+	for index, ok := range valid {
+		if ok {
+			good++
+		} else {
+			fmt.Printf("Piece %d: bad\n", index)
+		}
+	}
+	fmt.Printf("%d/%d pieces valid\n", good, len(valid))
+	return nil
+}
+
+// handlePeers lists the peers the torrent's tracker hands out, one address
+// per line or, with -json, as a JSON array, after the swarm's size if the
+// tracker reported it
+func handlePeers(args []string) error {
+	fs := flag.NewFlagSet("peers", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the peers as JSON, with their source and any peer ID")
+	compact := fs.Bool("compact", true, "ask the tracker for a compact peer list")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: peers [-json] [-compact=false] <torrent file>")
+	}
+
+	t, err := metainfo.DeserializeTorrent(fs.Arg(0))
 	if err != nil {
 		return err
 	}
@@ -79,20 +234,53 @@ func handlePeers(filePath string) error {
 	)
 
 	r := tracker.NewTrackerRequest(trackerURL, infoHash, left)
+	tracker.WithCompact(*compact)(r)
 	tres, err := r.SendRequest()
 	if err != nil {
 		return err
 	}
+	// On stderr, so the peer list stays one address per line or plain JSON
+	if tres.Seeders > 0 || tres.Leechers > 0 {
+		fmt.Fprintf(os.Stderr, "Seeders: %d, leechers: %d\n", tres.Seeders, tres.Leechers)
+	}
 
+	if *asJSON {
+		jsonOutput, err := json.Marshal(tres.Peers)
+		if err != nil {
+			return fmt.Errorf("error encoding peers as JSON: %w", err)
+		}
+		fmt.Println(string(jsonOutput))
+		return nil
+	}
 	fmt.Println(tres.PeersString())
 	return nil
 }
 
+func handleScrape(filePath string) error {
+	t, err := metainfo.DeserializeTorrent(filePath)
+	if err != nil {
+		return err
+	}
+
+	sres, err := tracker.Scrape(t.Announce, t.Info.InfoHash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Seeders:", sres.Complete)
+	fmt.Println("Leechers:", sres.Incomplete)
+	fmt.Println("Downloaded:", sres.Downloaded)
+	return nil
+}
+
 func handleHandshake(args []string) error {
 	filePath := args[2]
 	peerAddress := args[3]
 
 	addrPort, err := netip.ParseAddrPort(peerAddress)
+	if err != nil {
+		return fmt.Errorf("invalid peer address %q, want <ip>:<port>: %w", peerAddress, err)
+	}
 
 	p := peer.Peer{
 		AddrPort: &addrPort,
@@ -121,7 +309,7 @@ func handleHandshake(args []string) error {
 func handleDownloadPiece(args []string) error {
 	downloadFilePath := args[3]
 	torrentFilePath := args[4]
-	pieceIndex, err := strconv.Atoi(os.Args[5])
+	pieceIndex, err := strconv.Atoi(args[5])
 	if err != nil {
 		return err
 	}
@@ -136,60 +324,196 @@ func handleDownloadPiece(args []string) error {
 		return err
 	}
 
-	p := peer.Peer{
-		AddrPort: &peers[0],
+	p, err := connectToAny(peers.Addrs(), func(p *peer.Peer) error {
+		if _, err := p.Handshake(t.Info.InfoHash, false); err != nil {
+			return err
+		}
+		p.NumPieces = t.Info.NumPieces()
+		_, err := p.ReadBitfield()
+		return err
+	})
+	if err != nil {
+		return err
 	}
+	defer p.Conn.Close()
 
-	if err = p.Connect(); err != nil {
+	if err = awaitUnchoke(p); err != nil {
 		return err
 	}
-	defer p.Conn.Close()
 
-	_, err = p.Handshake(t.Info.InfoHash, false)
+	pieceLength, err := t.Info.PieceLengthAt(pieceIndex)
+	if err != nil {
+		return err
+	}
+	pieceHash, err := t.Info.PieceHash(pieceIndex)
 	if err != nil {
 		return err
 	}
 
-	// bitfield
-	msg, err := p.ReadBitfield()
+	piece, err := p.GetPiece(context.Background(), pieceHash, pieceLength, uint32(pieceIndex))
+	if err != nil {
+		return err
+	}
 
-	// interested msg
-	msg, err = p.SendInterested()
+	f, err := os.Create(downloadFilePath)
 	if err != nil {
 		return err
 	}
-	// unchoke
-	if msg.ID != internal.MessageUnchoke {
-		return fmt.Errorf("incorrect message id: expected 1 got %d", msg.ID)
+
+	defer f.Close()
+	if _, err = f.Write(piece); err != nil {
+		return err
+	}
+	return nil
+}
+
+// awaitUnchoke declares interest to a peer whose bitfield has been read and
+// waits for it to unchoke us, taking in any have messages it sends meanwhile
+func awaitUnchoke(p *peer.Peer) error {
+	if err := p.WriteMessage(internal.MessageInterested, nil); err != nil {
+		return fmt.Errorf("error sending interested: %w", err)
 	}
+	return p.AwaitUnchoke()
+}
 
-	pieceLength := uint32(t.Info.PieceLength)
-	pieceHash := t.Info.PieceHashes()[pieceIndex]
+// downloadFlags are the options download and magnet_download share
+type downloadFlags struct {
+	output  string
+	workers int
+	retries int
+	verbose bool
+	compact bool
+	listen  int
+	dht     bool
+	pex     bool
+	all     bool
+	webSeed bool
+	mmap    bool
+	timeout time.Duration
+}
 
-	if pieceIndex == len(t.Info.Pieces)/20-1 {
-		pieceLength = uint32(t.Info.Length) - pieceLength*uint32(len(t.Info.Pieces)/20-1)
+// parseDownloadFlags parses "-o <destination> [options] <source>" for the
+// named command, returning the flags and the torrent file or magnet link
+func parseDownloadFlags(command string, args []string) (*downloadFlags, string, error) {
+	defaults := downloader.DefaultConfig()
+	f := &downloadFlags{}
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.StringVar(&f.output, "o", "", "destination file, or parent directory for multi-file torrents")
+	fs.IntVar(&f.workers, "workers", defaults.MaxWorkers, "peers to download from at once; 0 suits the swarm's seeders")
+	fs.IntVar(&f.retries, "retries", defaults.MaxRetries, "attempts at each piece per peer")
+	fs.BoolVar(&f.verbose, "v", false, "report tracker, peer and retry errors")
+	fs.BoolVar(&f.compact, "compact", true, "ask trackers for compact peer lists")
+	fs.IntVar(&f.listen, "listen", 0, "upload verified pieces to peers connecting on this port; 0 doesn't listen")
+	fs.BoolVar(&f.dht, "dht", false, "also look for peers in the DHT, and fall back to it when trackers have none")
+	fs.BoolVar(&f.pex, "pex", false, "exchange peers with connected peers over ut_pex")
+	fs.BoolVar(&f.all, "announce-all", false, "announce to every tracker at once instead of failing over tier by tier")
+	fs.BoolVar(&f.webSeed, "webseeds", false, "also download from the torrent's url-list web seeds")
+	fs.BoolVar(&f.mmap, "mmap", false, "write the output through a memory mapping where supported")
+	fs.DurationVar(&f.timeout, "timeout", defaults.Timeout, "give up after this long, e.g. 30m")
+	if err := fs.Parse(args[2:]); err != nil {
+		return nil, "", err
+	}
+	if f.output == "" || fs.NArg() != 1 {
+		return nil, "", fmt.Errorf("usage: %s -o <destination> [options] <source>", command)
+	}
+	return f, fs.Arg(0), nil
+}
+
+// apply bounds ctx by the -timeout flag and returns the downloader options
+// the other flags select
+func (f *downloadFlags) apply(ctx context.Context) (context.Context, context.CancelFunc, []downloader.Option) {
+	cancel := context.CancelFunc(func() {})
+	if f.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+	}
+	return ctx, cancel, []downloader.Option{
+		downloader.WithTimeout(f.timeout),
+		downloader.WithMaxRetries(f.retries),
+		downloader.WithVerbose(f.verbose),
+		downloader.WithCompact(f.compact),
+		downloader.WithListen(f.listen),
+		downloader.WithDHT(f.dht),
+		downloader.WithPEX(f.pex),
+		downloader.WithAnnounceAll(f.all),
+		downloader.WithWebSeeds(f.webSeed),
+		downloader.WithMmap(f.mmap),
 	}
+}
 
-	piece, err := p.GetPiece(pieceHash, pieceLength, uint32(pieceIndex))
+// askTrackers announces the start of a download to find peers, failing over
+// through the torrent's trackers or, with -announce-all, asking all at once
+func (f *downloadFlags) askTrackers(t *metainfo.TorrentFile) (metainfo.Swarm, error) {
+	opts := []tracker.RequestOption{tracker.WithCompact(f.compact)}
+	if f.all {
+		return t.GetSwarm(opts...)
+	}
+	return t.GetTierSwarm(opts...)
+}
+
+// handlePlan prints what "download" would do with the same arguments: the
+// torrent's pieces and blocks, the files it would write, and how many peers
+// the trackers offer, without downloading anything
+func handlePlan(args []string) error {
+	flags, torrentFilePath, err := parseDownloadFlags("plan", args)
 	if err != nil {
 		return err
 	}
-
-	f, err := os.Create(downloadFilePath)
+	t, err := metainfo.DeserializeTorrent(torrentFilePath)
 	if err != nil {
 		return err
 	}
-
-	defer f.Close()
-	if _, err = f.Write(piece); err != nil {
+	files, err := downloader.New(t, nil).OutputFiles(flags.output)
+	if err != nil {
 		return err
 	}
+
+	numPieces := t.Info.NumPieces()
+	lastLength, err := t.Info.PieceLengthAt(numPieces - 1)
+	if err != nil {
+		return fmt.Errorf("invalid torrent: %w", err)
+	}
+	blocks := 0
+	for i := range numPieces {
+		length, _ := t.Info.PieceLengthAt(i)
+		blocks += int((length + internal.BlockSize - 1) / internal.BlockSize)
+	}
+
+	fmt.Printf("Name: %s\n", t.Info.Name)
+	fmt.Printf("Info Hash: %s\n", t.Info.GetHexInfoHash())
+	fmt.Printf("Total Size: %d bytes\n", t.Info.Length)
+	fmt.Printf("Pieces: %d of %d bytes (last %d bytes)\n", numPieces, t.Info.PieceLength, lastLength)
+	fmt.Printf("Blocks: %d of up to %d bytes\n", blocks, internal.BlockSize)
+	fmt.Printf("Files:\n")
+	for _, f := range files {
+		fmt.Printf("  %s (%d bytes)\n", f.Path, f.Length)
+	}
+
+	trackers := t.TrackerURLs()
+	swarm, err := flags.askTrackers(t)
+	if err != nil {
+		fmt.Printf("Trackers: %d, no peers: %v\n", len(trackers), err)
+		return nil
+	}
+	fmt.Printf("Trackers: %d, peers: %d\n", len(trackers), len(swarm.Peers))
+	if swarm.Seeders > 0 || swarm.Leechers > 0 {
+		fmt.Printf("Seeders: %d, leechers: %d\n", swarm.Seeders, swarm.Leechers)
+	}
+	workers := flags.workers
+	if workers <= 0 {
+		workers = downloader.SwarmWorkers(swarm.Seeders)
+	}
+	fmt.Printf("Workers: %d\n", min(workers, len(swarm.Peers)))
 	return nil
 }
 
-func handleDownload(args []string) error {
-	downloadFilePath := args[3]
-	torrentFilePath := args[4]
+func handleDownload(ctx context.Context, args []string) error {
+	flags, torrentFilePath, err := parseDownloadFlags("download", args)
+	if err != nil {
+		return err
+	}
+	downloadFilePath := flags.output
+	ctx, cancel, opts := flags.apply(ctx)
+	defer cancel()
 
 	t, err := metainfo.DeserializeTorrent(torrentFilePath)
 	if err != nil {
@@ -198,20 +522,25 @@ func handleDownload(args []string) error {
 
 	fmt.Println("\nStarting download...")
 
-	peers, err := t.GetPeers()
+	swarm, err := findPeers(ctx, t, flags)
 	if err != nil {
-		return err
+		if !flags.webSeed || len(t.URLList) == 0 {
+			return err
+		}
+		// Web seeds can carry the whole download on their own
+		fmt.Printf("No peers (%v), downloading from %d web seeds\n", err, len(t.URLList))
+	} else {
+		fmt.Printf("Found %d peers\n", len(swarm.Peers))
 	}
-	fmt.Printf("Found %d peers\n", len(peers))
+	opts = append(opts, downloader.WithSeeders(swarm.Seeders))
 
-	// Create Peer objects from addresses
-	peerList := make([]peer.Peer, len(peers))
-	for i, addr := range peers {
-		addrCopy := addr
-		peerList[i] = peer.Peer{AddrPort: &addrCopy}
+	// Create Peer objects from the descriptors
+	peerList := make([]peer.Peer, len(swarm.Peers))
+	for i, info := range swarm.Peers {
+		peerList[i] = *peer.FromInfo(info)
 	}
 
-	if err = downloader.DownloadFile(t, peerList, 50, downloadFilePath); err != nil {
+	if err = downloader.DownloadFileCtx(ctx, t, peerList, flags.workers, downloadFilePath, opts...); err != nil {
 		return err
 	}
 
@@ -224,39 +553,127 @@ func handleDownload(args []string) error {
 	return nil
 }
 
-func handleMagnetParse(magnetLink string) error {
-	magnet, err := metainfo.DeserializeMagnet(magnetLink)
+// handleSeed uploads a torrent's data from disk until interrupted. The data
+// is verified first; we then announce to the tracker and accept peers on the
+// -port given (internal.DefaultPort by default), re-announcing on the
+// tracker's interval.
+func handleSeed(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	port := fs.Int("port", internal.DefaultPort, "accept peers on this port, and announce it to the tracker")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: seed [-port n] <torrent file> <downloaded file or directory>")
+	}
+	if *port <= 0 || *port > 65535 {
+		return fmt.Errorf("invalid port %d", *port)
+	}
+	torrentFilePath := fs.Arg(0)
+	dataPath := fs.Arg(1)
+
+	t, err := metainfo.DeserializeTorrent(torrentFilePath)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Tracker URL:", magnet.TrackerURL)
-	fmt.Println("Info Hash:", magnet.HexInfoHash)
-	return nil
+	src, err := seeder.OpenFileSource(t.Info, dataPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	have := src.Bitfield()
+	good := 0
+	for index := range t.Info.NumPieces() {
+		if have.HasPiece(index) {
+			good++
+		}
+	}
+	fmt.Printf("%d/%d pieces verified\n", good, t.Info.NumPieces())
+	if good == 0 {
+		return fmt.Errorf("nothing to seed: no piece of %s verified", dataPath)
+	}
+
+	s := seeder.New(t.Info, src)
+	listenErr := make(chan error, 1)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		listenErr <- s.Listen(ctx, *port)
+	}()
+	fmt.Printf("Seeding on port %d\n", *port)
+
+	event := tracker.EventStarted
+	if src.Left() == 0 {
+		event = tracker.EventCompleted
+	}
+	announce := time.NewTimer(announceSeed(t, event, *port, s, src))
+	defer announce.Stop()
+	stats := time.NewTicker(seedStatsInterval)
+	defer stats.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// The seeder reads from src until its connections are closed
+			<-served
+			announceSeed(t, tracker.EventStopped, *port, s, src)
+			fmt.Printf("Uploaded %d bytes\n", s.Uploaded())
+			return nil
+		case err := <-listenErr:
+			if err != nil {
+				return err
+			}
+		case <-stats.C:
+			fmt.Printf("Uploaded %d bytes\n", s.Uploaded())
+		case <-announce.C:
+			announce.Reset(announceSeed(t, tracker.EventNone, *port, s, src))
+		}
+	}
 }
 
-func handleMagnetHandshake(magnetURL string) error {
-	magnet, err := metainfo.DeserializeMagnet(magnetURL)
-	treq := tracker.NewTrackerRequest(magnet.TrackerURL, metainfo.URLEncodeInfoHash(magnet.HexInfoHash), 999)
-	tres, err := treq.SendRequest()
+// announceSeed reports a seeding event on port to the tracker and returns how
+// long to wait before announcing again
+func announceSeed(t *metainfo.TorrentFile, event string, port int, s *seeder.Seeder, src *seeder.FileSource) time.Duration {
+	interval := internal.DefaultAnnounceInterval * time.Second
+	tres, err := t.AnnounceEvent(event, int(s.Uploaded()), 0, int(src.Left()), tracker.WithPort(port))
 	if err != nil {
-		return err
+		fmt.Printf("Tracker error: %v\n", err)
+		return interval
+	}
+	if next := tres.NextAnnounce(); next > 0 {
+		interval = time.Duration(next) * time.Second
 	}
+	return interval
+}
 
-	p := peer.Peer{AddrPort: &tres.Peers[0]}
-	err = p.Connect()
+func handleMagnetCreate(filePath string) error {
+	t, err := metainfo.DeserializeTorrent(filePath)
 	if err != nil {
 		return err
 	}
-	defer p.Conn.Close()
-	_, err = p.MagnetHandshake(magnet.InfoHash)
+	fmt.Println(metainfo.ToMagnet(t))
+	return nil
+}
+
+func handleMagnetParse(magnetLink string) error {
+	magnet, err := metainfo.DeserializeMagnet(magnetLink)
 	if err != nil {
 		return err
 	}
-	_, err = p.ReadBitfield()
+
+	fmt.Println("Tracker URL:", magnet.TrackerURL)
+	fmt.Println("Info Hash:", magnet.HexInfoHash)
+	return nil
+}
+
+func handleMagnetHandshake(magnetURL string) error {
+	p, _, err := ConnectToMagnetPeer(magnetURL)
 	if err != nil {
 		return err
 	}
+	defer p.Conn.Close()
 
 	eh, err := p.ExtensionHandshake()
 	if err != nil {
@@ -269,13 +686,11 @@ func handleMagnetHandshake(magnetURL string) error {
 }
 
 func handleMagnetInfo(magnetURL string) error {
-	p, magnet, err := ConnectToMagnetPeer(magnetURL)
-	defer p.Conn.Close()
-
-	info, err := p.DownloadMetadata(magnet)
+	p, magnet, info, err := fetchMagnetMetadata(magnetURL)
 	if err != nil {
 		return err
 	}
+	defer p.Conn.Close()
 
 	t := metainfo.TorrentFile{
 		Announce: magnet.TrackerURL,
@@ -294,43 +709,39 @@ func handleMagnetDownloadPiece(args []string) error {
 		return err
 	}
 
-	p, magnet, err := ConnectToMagnetPeer(magnetURL)
-	defer p.Conn.Close()
-
-	metadata, err := p.DownloadMetadata(magnet)
+	p, magnet, metadata, err := fetchMagnetMetadata(magnetURL)
 	if err != nil {
 		return err
 	}
+	defer p.Conn.Close()
 
 	t := metainfo.TorrentFile{
 		Announce: magnet.TrackerURL,
 		Info:     metadata,
 	}
 	t.Info.InfoHash = magnet.InfoHash
+	p.NumPieces = t.Info.NumPieces()
 
 	left := t.Info.Length
 	treq := tracker.NewTrackerRequest(magnet.TrackerURL, metainfo.URLEncodeInfoHash(magnet.HexInfoHash), left)
 	_, err = treq.SendRequest()
-	if err != nil {
+	if err != nil && !errors.Is(err, tracker.ErrNoPeers) {
 		return err
 	}
 
-	pieceLength := uint32(t.Info.PieceLength)
-	pieceHash := t.Info.PieceHashes()[pieceIndex]
-	if pieceIndex == len(t.Info.Pieces)/20-1 {
-		pieceLength = uint32(t.Info.Length) - pieceLength*uint32(len(t.Info.Pieces)/20-1)
+	pieceLength, err := t.Info.PieceLengthAt(pieceIndex)
+	if err != nil {
+		return err
 	}
-	// interested msg
-	msg, err := p.SendInterested()
+	pieceHash, err := t.Info.PieceHash(pieceIndex)
 	if err != nil {
 		return err
 	}
-	// unchoke
-	if msg.ID != internal.MessageUnchoke {
-		return fmt.Errorf("incorrect message id: expected 1 got %d", msg.ID)
+	if err = awaitUnchoke(p); err != nil {
+		return err
 	}
 
-	piece, err := p.GetPiece(pieceHash, pieceLength, uint32(pieceIndex))
+	piece, err := p.GetPiece(context.Background(), pieceHash, pieceLength, uint32(pieceIndex))
 	if err != nil {
 		return err
 	}
@@ -346,34 +757,31 @@ func handleMagnetDownloadPiece(args []string) error {
 	return nil
 }
 
-func handleMagnetDownload(args []string) error {
-	downloadFilePath := args[3]
-	magnetURl := args[4]
-
-	p, magnet, err := ConnectToMagnetPeer(magnetURl)
-	defer p.Conn.Close()
-
-	metadata, err := p.DownloadMetadata(magnet)
+func handleMagnetDownload(ctx context.Context, args []string) error {
+	flags, magnetURl, err := parseDownloadFlags("magnet_download", args)
 	if err != nil {
 		return err
 	}
+	downloadFilePath := flags.output
+	ctx, cancel, opts := flags.apply(ctx)
+	defer cancel()
 
-	t := metainfo.TorrentFile{
-		Announce: magnet.TrackerURL,
-		Info:     metadata,
+	t, err := magnetTorrent(magnetURl, downloadFilePath+".torrent")
+	if err != nil {
+		return err
 	}
-	t.Info.InfoHash = magnet.InfoHash
-	peers, err := t.GetPeers()
+	swarm, err := findPeers(ctx, t, flags)
 	if err != nil {
 		return err
 	}
+	opts = append(opts, downloader.WithSeeders(swarm.Seeders))
 
-	peerList := make([]peer.Peer, len(peers))
-	for i, addr := range peers {
-		peerList[i] = peer.Peer{AddrPort: &addr}
+	peerList := make([]peer.Peer, len(swarm.Peers))
+	for i, info := range swarm.Peers {
+		peerList[i] = *peer.FromInfo(info)
 	}
 
-	if err = downloader.DownloadFile(&t, peerList, 50, downloadFilePath); err != nil {
+	if err = downloader.DownloadFileCtx(ctx, t, peerList, flags.workers, downloadFilePath, opts...); err != nil {
 		return err
 	}
 
@@ -386,34 +794,157 @@ func handleMagnetDownload(args []string) error {
 	return nil
 }
 
-func ConnectToMagnetPeer(magnetURL string) (*peer.Peer, *metainfo.MagnetLink, error) {
+// magnetTorrent returns the torrent a magnet link refers to. Metadata fetched
+// from peers is cached as a .torrent at cachePath, and later runs load it from
+// there instead, as long as its info hash still matches the magnet's.
+func magnetTorrent(magnetURL, cachePath string) (*metainfo.TorrentFile, error) {
 	magnet, err := metainfo.DeserializeMagnet(magnetURL)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if t, err := metainfo.DeserializeTorrent(cachePath); err == nil {
+		if t.Info.InfoHash == magnet.InfoHash {
+			fmt.Printf("Using metadata cached in %s\n", cachePath)
+			return t, nil
+		}
+		fmt.Printf("Ignoring %s: its info hash doesn't match the magnet link\n", cachePath)
 	}
 
-	treq := tracker.NewTrackerRequest(magnet.TrackerURL,
-		metainfo.URLEncodeInfoHash(magnet.HexInfoHash), 999)
+	p, magnet, metadata, err := fetchMagnetMetadata(magnetURL)
+	if err != nil {
+		return nil, err
+	}
+	p.Conn.Close()
 
-	tres, err := treq.SendRequest()
+	t := &metainfo.TorrentFile{
+		Announce: magnet.TrackerURL,
+		Info:     metadata,
+	}
+	t.Info.InfoHash = magnet.InfoHash
+	if err = os.WriteFile(cachePath, t.Serialize(), 0644); err != nil {
+		fmt.Printf("Could not cache metadata: %v\n", err)
+	}
+	return t, nil
+}
+
+// findPeers asks the torrent's trackers for peers, falling back to the DHT
+// with -dht when none of them has any and the torrent isn't private. The DHT
+// says nothing of the swarm's size.
+func findPeers(ctx context.Context, t *metainfo.TorrentFile, flags *downloadFlags) (metainfo.Swarm, error) {
+	swarm, err := flags.askTrackers(t)
+	if err == nil || !flags.dht || t.Info.Private {
+		return swarm, err
+	}
+
+	fmt.Println("No peers from tracker, searching the DHT...")
+	dhtCtx, cancel := context.WithTimeout(ctx, dhtLookupTimeout)
+	defer cancel()
+	dhtPeers, dhtErr := dht.Lookup(dhtCtx, t.Info.InfoHash)
+	if dhtErr != nil {
+		return metainfo.Swarm{}, errors.Join(err, dhtErr)
+	}
+	return metainfo.Swarm{Peers: tracker.NewPeers(dhtPeers, tracker.SourceDHT)}, nil
+}
+
+func ConnectToMagnetPeer(magnetURL string) (*peer.Peer, *metainfo.MagnetLink, error) {
+	magnet, addrs, err := magnetPeers(magnetURL)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	p := &peer.Peer{AddrPort: &tres.Peers[0]}
-	if err = p.Connect(); err != nil {
+	p, err := connectToAny(addrs, magnetHandshake(magnet))
+	if err != nil {
 		return nil, nil, err
 	}
 
-	if _, err = p.MagnetHandshake(magnet.InfoHash); err != nil {
-		p.Conn.Close()
+	return p, magnet, nil
+}
+
+// magnetPeers parses a magnet link and asks its tracker for peers
+func magnetPeers(magnetURL string) (*metainfo.MagnetLink, []netip.AddrPort, error) {
+	magnet, err := metainfo.DeserializeMagnet(magnetURL)
+	if err != nil {
 		return nil, nil, err
 	}
+	if magnet.TrackerURL == "" {
+		return nil, nil, fmt.Errorf("magnet link has no tracker")
+	}
+
+	treq := tracker.NewTrackerRequest(magnet.TrackerURL,
+		metainfo.URLEncodeInfoHash(magnet.HexInfoHash), 999)
 
-	if _, err = p.ReadBitfield(); err != nil {
-		p.Conn.Close()
+	tres, err := treq.SendRequest()
+	if err != nil {
 		return nil, nil, err
 	}
+	return magnet, tres.Peers.Addrs(), nil
+}
+
+// magnetHandshake returns the handshake connectToAny uses for magnet peers
+func magnetHandshake(magnet *metainfo.MagnetLink) func(p *peer.Peer) error {
+	return func(p *peer.Peer) error {
+		if _, err := p.MagnetHandshake(magnet.InfoHash); err != nil {
+			return err
+		}
+		_, err := p.ReadBitfield()
+		return err
+	}
+}
 
-	return p, magnet, nil
+// fetchMagnetMetadata downloads a magnet's info dict, moving on to the next
+// peer whenever one rejects a metadata piece or drops out, and keeping the
+// pieces already received. It returns the peer that supplied the last piece,
+// still connected.
+func fetchMagnetMetadata(magnetURL string) (*peer.Peer, *metainfo.MagnetLink, *metainfo.Info, error) {
+	magnet, addrs, err := magnetPeers(magnetURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	md := peer.NewMetadataDownload(magnet.InfoHash)
+	var errs []error
+	for len(addrs) > 0 {
+		p, err := connectToAny(addrs, magnetHandshake(magnet))
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		addrs = addrs[slices.Index(addrs, *p.AddrPort)+1:]
+
+		if err = p.FetchMetadata(md); err != nil {
+			p.Conn.Close()
+			errs = append(errs, fmt.Errorf("%s: %w", p.AddrPort, err))
+			continue
+		}
+		info, err := md.Info()
+		if err != nil {
+			p.Conn.Close()
+			return nil, nil, nil, err
+		}
+		return p, magnet, info, nil
+	}
+	return nil, nil, nil, fmt.Errorf("no peer supplied the metadata: %w", errors.Join(errs...))
+}
+
+// connectToAny tries each peer in turn until one connects and completes
+// handshake within peerHandshakeTimeout, and returns that peer still
+// connected. If none does, the error lists what went wrong with each.
+func connectToAny(addrs []netip.AddrPort, handshake func(p *peer.Peer) error) (*peer.Peer, error) {
+	var errs []error
+	for _, addr := range addrs {
+		p := &peer.Peer{AddrPort: &addr, ReadTimeout: peerHandshakeTimeout}
+		if err := p.Connect(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+		if err := handshake(p); err != nil {
+			p.Conn.Close()
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+		p.ReadTimeout = 0
+		p.Conn.SetReadDeadline(time.Time{})
+		return p, nil
+	}
+	return nil, fmt.Errorf("no peer completed the handshake: %w", errors.Join(errs...))
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+)
+
+func TestHandleHandshakeInvalidAddress(t *testing.T) {
+	err := handleHandshake([]string{"bittorrent", "handshake", "sample.torrent", "not an address"})
+	if err == nil {
+		t.Fatal("handleHandshake succeeded with an invalid address")
+	}
+	if !strings.Contains(err.Error(), `invalid peer address "not an address"`) {
+		t.Errorf("got %q, want it to name the invalid address", err)
+	}
+}
+
+// writeMessage writes one peer wire message to conn
+func writeMessage(conn net.Conn, id byte, payload []byte) error {
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	msg = append(msg, id)
+	_, err := conn.Write(append(msg, payload...))
+	return err
+}
+
+// readMessage reads one peer wire message from conn
+func readMessage(conn net.Conn) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 {
+		return internal.MessageKeepAlive, nil, nil
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// servePieces plays a seeder holding data on one connection: it answers the
+// handshake, announces its pieces with a bitfield and a later have, and only
+// unchokes once we're interested, then serves every block requested
+func servePieces(t *testing.T, ln net.Listener, tf *metainfo.TorrentFile, data []byte) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Errorf("accept: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	handshake := make([]byte, internal.HandshakeLength)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		t.Errorf("reading handshake: %v", err)
+		return
+	}
+	reply := append([]byte{internal.ProtocolStringLength}, internal.ProtocolString...)
+	reply = append(reply, make([]byte, 8)...)
+	reply = append(reply, tf.Info.InfoHash[:]...)
+	reply = append(reply, "-TS0001-scriptedpeer"...)
+	if _, err := conn.Write(reply); err != nil {
+		t.Errorf("writing handshake: %v", err)
+		return
+	}
+
+	// Piece 1 in the bitfield, piece 0 announced with a have before unchoking
+	if err := writeMessage(conn, internal.MessageBitfield, []byte{0x40}); err != nil {
+		t.Errorf("writing bitfield: %v", err)
+		return
+	}
+	if err := writeMessage(conn, internal.MessageHave, []byte{0, 0, 0, 0}); err != nil {
+		t.Errorf("writing have: %v", err)
+		return
+	}
+
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		switch id {
+		case internal.MessageInterested:
+			if err := writeMessage(conn, internal.MessageUnchoke, nil); err != nil {
+				return
+			}
+		case internal.MessageRequest:
+			index := binary.BigEndian.Uint32(payload[0:4])
+			begin := binary.BigEndian.Uint32(payload[4:8])
+			length := binary.BigEndian.Uint32(payload[8:12])
+			offset := int(index)*tf.Info.PieceLength + int(begin)
+			block := append(payload[:8:8], data[offset:offset+int(length)]...)
+			if err := writeMessage(conn, internal.MessagePiece, block); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestHandleDownloadPiece(t *testing.T) {
+	dir := t.TempDir()
+	const pieceLength = 2 * int(internal.BlockSize)
+	data := make([]byte, pieceLength+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peerAddr := netip.MustParseAddrPort(ln.Addr().String())
+
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers := peerAddr.Addr().AsSlice()
+		peers = binary.BigEndian.AppendUint16(peers, peerAddr.Port())
+		w.Write([]byte("d8:intervali900e5:peers6:" + string(peers) + "e"))
+	}))
+	defer tracker.Close()
+
+	tf, err := metainfo.CreateTorrent(source, tracker.URL, pieceLength)
+	if err != nil {
+		t.Fatalf("CreateTorrent: %v", err)
+	}
+	torrentPath := filepath.Join(dir, "test.torrent")
+	if err := os.WriteFile(torrentPath, tf.Serialize(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		servePieces(t, ln, tf, data)
+	}()
+
+	output := filepath.Join(dir, "piece-0")
+	err = handleDownloadPiece([]string{"bittorrent", "download_piece", "-o", output, torrentPath, "0"})
+	if err != nil {
+		t.Fatalf("handleDownloadPiece: %v", err)
+	}
+	<-done
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[:pieceLength]) {
+		t.Errorf("downloaded piece of %d bytes does not match the source", len(got))
+	}
+}
+
+func TestHandleSeedPort(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("seed data "), 100)
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A port nothing listens on, for the seeder to take
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	announced := make(chan url.Values, 2)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced <- r.URL.Query()
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	tf, err := metainfo.CreateTorrent(source, tracker.URL, 256)
+	if err != nil {
+		t.Fatalf("CreateTorrent: %v", err)
+	}
+	torrentPath := filepath.Join(dir, "test.torrent")
+	if err := os.WriteFile(torrentPath, tf.Serialize(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- handleSeed(ctx, []string{"bittorrent", "seed", "-port", strconv.Itoa(port), torrentPath, source})
+	}()
+
+	for _, event := range []string{"completed", "stopped"} {
+		query := <-announced
+		if query.Get("event") != event || query.Get("port") != strconv.Itoa(port) {
+			t.Errorf("announced event %q on port %q, want %q on %d", query.Get("event"), query.Get("port"), event, port)
+		}
+		if event == "completed" {
+			// The seeder listens on the port it announced, though perhaps not
+			// yet by the time it announces
+			addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+			conn, err := net.Dial("tcp", addr)
+			for i := 0; err != nil && i < 50; i++ {
+				time.Sleep(10 * time.Millisecond)
+				conn, err = net.Dial("tcp", addr)
+			}
+			if err != nil {
+				t.Errorf("connecting to the seeder: %v", err)
+			} else {
+				conn.Close()
+			}
+			cancel()
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("handleSeed: %v", err)
+	}
+}
+
+func TestHandleSeedUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"bittorrent", "seed", "test.torrent"},
+		{"bittorrent", "seed", "-port", "0", "test.torrent", "data"},
+		{"bittorrent", "seed", "-port", "65536", "test.torrent", "data"},
+	} {
+		if err := handleSeed(context.Background(), args); err == nil {
+			t.Errorf("handleSeed(%q) succeeded", args)
+		}
+	}
+}
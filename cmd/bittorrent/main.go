@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	if len(os.Args) < 2 {
 		log.Fatal(fmt.Errorf("not enough arguments"))
 	}
-	if err := runCommand(os.Args[1], os.Args); err != nil {
+
+	// Ctrl-C stops a download cleanly instead of killing it mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := runCommand(ctx, os.Args[1], os.Args)
+	stop()
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,21 +1,56 @@
 package bencode
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-// Decode decodes bencoded data into Go types
+// decoder carries the decoding mode through nested values
+type decoder struct {
+	strict       bool // refuse dictionaries with a duplicate key
+	nonCanonical bool // set on meeting a duplicate or out-of-order key
+}
+
+// Decode decodes bencoded data into Go types. A dictionary with a duplicate
+// key keeps the last value.
 func Decode(bencoded []byte) (interface{}, error) {
 	result, _, err := DecodeAt(bencoded, 0)
 	return result, err
 }
 
+// DecodeStrict is Decode, but refuses a dictionary with a duplicate key with
+// a DecodeError instead of keeping its last value
+func DecodeStrict(bencoded []byte) (interface{}, error) {
+	d := decoder{strict: true}
+	result, _, err := d.decodeAt(bencoded, 0)
+	return result, err
+}
+
+// DecodeCanonical is Decode, also reporting whether the input is canonical:
+// every dictionary's keys unique and in sorted order. Re-encoding a decoded
+// non-canonical input doesn't reproduce it, so hashes of it must be taken
+// over the original bytes.
+func DecodeCanonical(bencoded []byte) (interface{}, bool, error) {
+	var d decoder
+	result, _, err := d.decodeAt(bencoded, 0)
+	return result, !d.nonCanonical, err
+}
+
 // DecodeAt is the internal recursive decoder that processes bencoded data
 // Returns string, int, []interace{}, map[string]interface{}, or []byte depending on input
 func DecodeAt(bencoded []byte, index int) (interface{}, int, error) {
+	var d decoder
+	return d.decodeAt(bencoded, index)
+}
+
+func (d *decoder) decodeAt(bencoded []byte, index int) (interface{}, int, error) {
+	if index < 0 || index >= len(bencoded) {
+		return "", index, newDecodeError(bencoded, index, "unexpected end of input")
+	}
 	identifier := rune(bencoded[index])
 	if unicode.IsDigit(identifier) {
 		decodedString, i, err := decodeString(bencoded, index)
@@ -29,24 +64,21 @@ func DecodeAt(bencoded []byte, index int) (interface{}, int, error) {
 		return decodeInt(bencoded, index)
 
 	} else if identifier == 'l' {
-		return decodeList(bencoded, index)
+		return d.decodeList(bencoded, index)
 
 	} else if identifier == 'd' {
-		return decodeDict(bencoded, index)
+		return d.decodeDict(bencoded, index, nil)
 
 	} else {
-		return "", -1, &DecodeError{
-			Position: index,
-			Reason:   fmt.Sprintf("invalid identifier: %s", string(identifier)),
-			Context:  string(bencoded[index:min(index+20, len(bencoded))]),
-		}
+		return "", index, newDecodeError(bencoded, index,
+			fmt.Sprintf("invalid identifier: %s", string(identifier)))
 	}
 }
 
 // decodeString decodes a bencoded string of format: <length>:<contents>
 // Returns the decoded bytes (not converted to string), next index, and any error.
 func decodeString(bencoded []byte, index int) ([]byte, int, error) {
-	var firstColonIndex int
+	firstColonIndex := -1
 
 	for i := index; i < len(bencoded); i++ {
 		if bencoded[i] == ':' {
@@ -54,15 +86,23 @@ func decodeString(bencoded []byte, index int) ([]byte, int, error) {
 			break
 		}
 	}
+	if firstColonIndex < 0 {
+		return nil, index, newDecodeError(bencoded, index, "unterminated string length")
+	}
 	lengthStr := bencoded[index:firstColonIndex]
 
 	length, err := strconv.Atoi(string(lengthStr))
 	if err != nil {
-		return nil, index, &DecodeError{
-			Position: index,
-			Reason:   err.Error(),
-			Context:  string(bencoded[index:min(index+20, len(bencoded))]),
-		}
+		return nil, index, newDecodeError(bencoded, index, err.Error())
+	}
+	if length < 0 {
+		return nil, index, newDecodeError(bencoded, index,
+			fmt.Sprintf("negative string length: %d", length))
+	}
+	if length > len(bencoded)-firstColonIndex-1 {
+		return nil, index, newDecodeError(bencoded, index,
+			fmt.Sprintf("string length %d exceeds remaining input (%d bytes)",
+				length, len(bencoded)-firstColonIndex-1))
 	}
 	endIndex := firstColonIndex + 1 + length
 
@@ -75,13 +115,18 @@ func decodeString(bencoded []byte, index int) ([]byte, int, error) {
 // Example: "i42e" returns 42
 func decodeInt(bencoded []byte, index int) (int, int, error) {
 	i := index
-	for ; bencoded[i] != 'e'; i++ {
+	for ; i < len(bencoded) && bencoded[i] != 'e'; i++ {
+	}
+	if i == len(bencoded) {
+		return 0, index, newDecodeError(bencoded, index, "unterminated integer")
 	}
 
 	numStr := string(bencoded[index+1 : i])
 
-	// Check for invalid formats
-	if len(numStr) > 1 && numStr[0] == '0' {
+	// Check for invalid formats. "-0" is caught below; "-01" and the like
+	// have a leading zero after the sign.
+	digits := strings.TrimPrefix(numStr, "-")
+	if len(digits) > 1 && digits[0] == '0' {
 		return 0, index, &DecodeError{
 			Position: index,
 			Reason:   fmt.Sprintf("integer has leading zero: %s", numStr),
@@ -112,25 +157,24 @@ func decodeInt(bencoded []byte, index int) (int, int, error) {
 
 // decodeList decodes a bencoded list of format: l<item1><item2>...e
 // Returns a slice of decoded items (mixed types possible)
-func decodeList(bencoded []byte, index int) ([]interface{}, int, error) {
+func (d *decoder) decodeList(bencoded []byte, index int) ([]interface{}, int, error) {
 	decodedList := make([]interface{}, 0)
 	i := index + 1
 	for {
 		var val interface{}
 		var err error
 
+		if i >= len(bencoded) {
+			return nil, index, newDecodeError(bencoded, index, "unterminated list")
+		}
 		if bencoded[i] == 'e' {
 			i++
 			break
 		}
 
-		val, i, err = DecodeAt(bencoded, i)
+		val, i, err = d.decodeAt(bencoded, i)
 		if err != nil {
-			return nil, index, &DecodeError{
-				Position: index,
-				Reason:   err.Error(),
-				Context:  string(bencoded[index:min(20+index, len(bencoded))]),
-			}
+			return nil, index, newDecodeError(bencoded, index, err.Error())
 		}
 		decodedList = append(decodedList, val)
 
@@ -140,11 +184,41 @@ func decodeList(bencoded []byte, index int) ([]interface{}, int, error) {
 
 }
 
+// Span is the half-open byte range [Start, End) a value occupies in its input.
+type Span struct {
+	Start int
+	End   int
+}
+
+// DecodeDictSpans decodes a top-level bencoded dictionary and also returns the
+// byte span of each of its values, so callers can recover a value's exact
+// original encoding (e.g. the info dictionary, whose bytes define the info hash).
+// A duplicate key in the top-level dictionary would make its span ambiguous,
+// so it is refused with a DecodeError.
+func DecodeDictSpans(bencoded []byte) (map[string]interface{}, map[string]Span, error) {
+	if len(bencoded) == 0 || bencoded[0] != 'd' {
+		return nil, nil, &DecodeError{
+			Position: 0,
+			Reason:   "input is not a dictionary",
+			Context:  string(bencoded[:min(20, len(bencoded))]),
+		}
+	}
+	spans := make(map[string]Span)
+	var d decoder
+	dict, _, err := d.decodeDict(bencoded, 0, spans)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dict, spans, nil
+}
+
 // decodeDict decodes a bencoded dictionary of format: d<key1><val1><key2><val2>...e
 // Keys must be strings and are sorted in lexicographical order.
-// Returns a map with string keys and mixed-type values.
-func decodeDict(bencoded []byte, index int) (map[string]interface{}, int, error) {
+// Returns a map with string keys and mixed-type values, recording the span of
+// each value in spans when it is non-nil.
+func (d *decoder) decodeDict(bencoded []byte, index int, spans map[string]Span) (map[string]interface{}, int, error) {
 	decodedDict := make(map[string]interface{})
+	var prevKey []byte
 	i := index + 1
 	for {
 		var (
@@ -152,6 +226,9 @@ func decodeDict(bencoded []byte, index int) (map[string]interface{}, int, error)
 			val interface{}
 			err error
 		)
+		if i >= len(bencoded) {
+			return nil, index, newDecodeError(bencoded, index, "unterminated dictionary")
+		}
 		identifier := bencoded[i]
 
 		if identifier == 'e' {
@@ -159,25 +236,32 @@ func decodeDict(bencoded []byte, index int) (map[string]interface{}, int, error)
 			break
 		}
 
+		keyStart := i
 		key, i, err = decodeString(bencoded, i)
 		if err != nil {
-			return nil, i, &DecodeError{
-				Position: i,
-				Reason:   err.Error(),
-				Context:  string(bencoded[i:min(20+i, len(bencoded))]),
+			return nil, i, newDecodeError(bencoded, i, err.Error())
+		}
+		if _, dup := decodedDict[string(key)]; dup {
+			if d.strict || spans != nil {
+				return nil, keyStart, newDecodeError(bencoded, keyStart,
+					fmt.Sprintf("duplicate dictionary key %q", key))
 			}
+			d.nonCanonical = true
+		} else if len(decodedDict) > 0 && bytes.Compare(key, prevKey) < 0 {
+			d.nonCanonical = true
 		}
+		prevKey = key
 
-		val, i, err = DecodeAt(bencoded, i)
+		start := i
+		val, i, err = d.decodeAt(bencoded, i)
 		if err != nil {
-			return nil, i, &DecodeError{
-				Position: i,
-				Reason:   err.Error(),
-				Context:  string(bencoded[i:min(20+i, len(bencoded))]),
-			}
+			return nil, i, newDecodeError(bencoded, i, err.Error())
 		}
 
 		decodedDict[string(key)] = val
+		if spans != nil {
+			spans[string(key)] = Span{Start: start, End: i}
+		}
 
 	}
 	return decodedDict, i, nil
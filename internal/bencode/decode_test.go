@@ -0,0 +1,89 @@
+package bencode
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"truncated string", "5:abc"},
+		{"oversized string length", "99999999999999999999:abc"},
+		{"negative string length", "-1:a"},
+		{"string without colon", "3abc"},
+		{"unterminated integer", "i42"},
+		{"empty integer", "ie"},
+		{"leading zero", "i03e"},
+		{"negative leading zero", "i-01e"},
+		{"negative zero", "i-0e"},
+		{"integer overflow", "i99999999999999999999e"},
+		{"unterminated list", "li1ei2e"},
+		{"truncated list element", "l5:ab"},
+		{"unterminated dictionary", "d3:key5:value"},
+		{"dictionary without value", "d3:keye"},
+		{"non-string key", "di1e3:abce"},
+		{"unknown type", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode([]byte(tt.input))
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Errorf("Decode(%q) = %v, want a DecodeError", tt.input, err)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncatedPrefixes(t *testing.T) {
+	input := "d4:listli1ei-2e3:abce3:numi42e3:str5:helloe"
+	if _, err := Decode([]byte(input)); err != nil {
+		t.Fatalf("Decode(%q): %v", input, err)
+	}
+	for i := range len(input) {
+		if _, err := Decode([]byte(input[:i])); err == nil {
+			t.Errorf("Decode(%q) succeeded on truncated input", input[:i])
+		}
+	}
+}
+
+func TestDecodeIntegers(t *testing.T) {
+	tests := map[string]int{"i0e": 0, "i-1e": -1, "i10e": 10, "i-105e": -105}
+	for input, want := range tests {
+		got, err := Decode([]byte(input))
+		if err != nil || got != want {
+			t.Errorf("Decode(%q) = %v, %v, want %d", input, got, err, want)
+		}
+	}
+}
+
+func TestDecodeDuplicateKeys(t *testing.T) {
+	input := []byte("d3:keyi1e3:keyi2ee")
+
+	got, err := Decode(input)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if v := got.(map[string]interface{})["key"]; v != 2 {
+		t.Errorf("Decode kept %v, want the last value 2", v)
+	}
+
+	var decodeErr *DecodeError
+	if _, err := DecodeStrict(input); !errors.As(err, &decodeErr) {
+		t.Errorf("DecodeStrict = %v, want a DecodeError", err)
+	}
+
+	if _, canonical, err := DecodeCanonical(input); err != nil || canonical {
+		t.Errorf("DecodeCanonical = %v, %v, want non-canonical", canonical, err)
+	}
+	if _, canonical, err := DecodeCanonical([]byte("d1:ai1e1:bi2ee")); err != nil || !canonical {
+		t.Errorf("DecodeCanonical of sorted unique keys = %v, %v, want canonical", canonical, err)
+	}
+	if _, canonical, _ := DecodeCanonical([]byte("d1:bi1e1:ai2ee")); canonical {
+		t.Error("DecodeCanonical reported out-of-order keys as canonical")
+	}
+}
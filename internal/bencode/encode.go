@@ -0,0 +1,66 @@
+package bencode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Encode bencodes a value built from the same types Decode produces: string,
+// []byte, int, []interface{} and map[string]interface{}. Dictionary keys are
+// written in sorted order, as the spec requires.
+func Encode(v interface{}) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+func appendValue(out []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return appendString(out, v), nil
+	case []byte:
+		return appendString(out, string(v)), nil
+	case int:
+		return appendInt(out, int64(v)), nil
+	case int64:
+		return appendInt(out, v), nil
+	case []interface{}:
+		out = append(out, 'l')
+		for _, item := range v {
+			var err error
+			if out, err = appendValue(out, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(out, 'e'), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		out = append(out, 'd')
+		for _, key := range keys {
+			out = appendString(out, key)
+			var err error
+			if out, err = appendValue(out, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return append(out, 'e'), nil
+	default:
+		return nil, fmt.Errorf("bencode: cannot encode value of type %T", v)
+	}
+}
+
+func appendString(out []byte, s string) []byte {
+	out = strconv.AppendInt(out, int64(len(s)), 10)
+	out = append(out, ':')
+	return append(out, s...)
+}
+
+func appendInt(out []byte, n int64) []byte {
+	out = append(out, 'i')
+	out = strconv.AppendInt(out, n, 10)
+	return append(out, 'e')
+}
@@ -12,3 +12,14 @@ func (e *DecodeError) Error() string {
 	return fmt.Sprintf("bencode decode error at position %d: %s (context %s)",
 		e.Position, e.Reason, e.Context)
 }
+
+// newDecodeError builds a DecodeError, clamping the context window to the input
+// so positions at or past the end (truncated input) are safe to report.
+func newDecodeError(bencoded []byte, position int, reason string) *DecodeError {
+	start := min(max(position, 0), len(bencoded))
+	return &DecodeError{
+		Position: position,
+		Reason:   reason,
+		Context:  string(bencoded[start:min(start+20, len(bencoded))]),
+	}
+}
@@ -0,0 +1,68 @@
+package bencode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format renders a decoded value as indented text without losing anything to
+// JSON: text strings are quoted, binary strings (which Decode returns as
+// []byte) are shown in hex as <hex:...>, and dictionary keys are sorted.
+func Format(v interface{}) string {
+	var b strings.Builder
+	formatValue(&b, v, 0)
+	return b.String()
+}
+
+func formatValue(b *strings.Builder, v interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch v := v.(type) {
+	case string:
+		b.WriteString(strconv.Quote(v))
+	case []byte:
+		fmt.Fprintf(b, "<hex:%s>", hex.EncodeToString(v))
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[\n")
+		for i, item := range v {
+			b.WriteString(indent + "  ")
+			formatValue(b, item, depth+1)
+			if i < len(v)-1 {
+				b.WriteByte(',')
+			}
+			b.WriteByte('\n')
+		}
+		b.WriteString(indent + "]")
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("{\n")
+		for i, key := range keys {
+			b.WriteString(indent + "  " + strconv.Quote(key) + ": ")
+			formatValue(b, v[key], depth+1)
+			if i < len(keys)-1 {
+				b.WriteByte(',')
+			}
+			b.WriteByte('\n')
+		}
+		b.WriteString(indent + "}")
+	default:
+		fmt.Fprintf(b, "%v", v)
+	}
+}
@@ -0,0 +1,121 @@
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrKeyNotFound is returned, wrapped, when a lookup path names a key that
+// isn't there, so callers can tell optional keys apart from malformed ones.
+var ErrKeyNotFound = errors.New("key not found")
+
+// Lookup walks a decoded value through nested dictionaries, one key per path
+// element, and returns the value at the end. With no path it returns v.
+func Lookup(v interface{}, path ...string) (interface{}, error) {
+	for i, key := range path {
+		dict, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is %s, not a dictionary", pathString(path[:i]), typeName(v))
+		}
+		v, ok = dict[key]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", pathString(path[:i+1]), ErrKeyNotFound)
+		}
+	}
+	return v, nil
+}
+
+// GetDict looks up a dictionary
+func GetDict(v interface{}, path ...string) (map[string]interface{}, error) {
+	v, err := Lookup(v, path...)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is %s, not a dictionary", pathString(path), typeName(v))
+	}
+	return dict, nil
+}
+
+// GetList looks up a list
+func GetList(v interface{}, path ...string) ([]interface{}, error) {
+	v, err := Lookup(v, path...)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is %s, not a list", pathString(path), typeName(v))
+	}
+	return list, nil
+}
+
+// GetInt looks up an integer
+func GetInt(v interface{}, path ...string) (int, error) {
+	v, err := Lookup(v, path...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("%s is %s, not an integer", pathString(path), typeName(v))
+	}
+	return n, nil
+}
+
+// GetString looks up a string. Binary strings, which Decode returns as
+// []byte, are converted.
+func GetString(v interface{}, path ...string) (string, error) {
+	v, err := Lookup(v, path...)
+	if err != nil {
+		return "", err
+	}
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case []byte:
+		return string(s), nil
+	}
+	return "", fmt.Errorf("%s is %s, not a string", pathString(path), typeName(v))
+}
+
+// GetBytes looks up a string as raw bytes, whether or not Decode found it to
+// be valid UTF-8
+func GetBytes(v interface{}, path ...string) ([]byte, error) {
+	v, err := Lookup(v, path...)
+	if err != nil {
+		return nil, err
+	}
+	switch s := v.(type) {
+	case []byte:
+		return s, nil
+	case string:
+		return []byte(s), nil
+	}
+	return nil, fmt.Errorf("%s is %s, not a string", pathString(path), typeName(v))
+}
+
+// pathString renders a lookup path for error messages
+func pathString(path []string) string {
+	if len(path) == 0 {
+		return "value"
+	}
+	return fmt.Sprintf("%q", strings.Join(path, "."))
+}
+
+// typeName names the bencode type of a decoded value
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case string, []byte:
+		return "a string"
+	case int:
+		return "an integer"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a dictionary"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,212 @@
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Unmarshal decodes bencoded data into the value v points to, much like
+// encoding/json. Integers fill int and uint fields, strings fill string,
+// []byte and byte array fields, lists fill slices and arrays, and
+// dictionaries fill structs and maps with string keys. Struct fields take the
+// dictionary key named by their `bencode:"key"` tag, or their field name when
+// untagged; a tag of "-" skips the field. Keys with no field are ignored and
+// fields with no key are left alone, so optional keys are best held in
+// pointer fields, which stay nil when the key is missing.
+func Unmarshal(data []byte, v interface{}) error {
+	decoded, err := Decode(data)
+	if err != nil {
+		return err
+	}
+	return UnmarshalDecoded(decoded, v)
+}
+
+// UnmarshalDecoded is Unmarshal for a value Decode has already returned,
+// e.g. one dictionary out of a larger document
+func UnmarshalDecoded(decoded interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: cannot unmarshal into non-pointer %T", v)
+	}
+	return assign(rv.Elem(), decoded, "")
+}
+
+// assign stores the decoded value src in dst. path locates src in the
+// document for error messages.
+func assign(dst reflect.Value, src interface{}, path string) error {
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src, path)
+
+	case reflect.Interface:
+		if dst.NumMethod() == 0 {
+			dst.Set(reflect.ValueOf(src))
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := src.(int)
+		if !ok {
+			return mismatch(src, path, "an integer")
+		}
+		if dst.OverflowInt(int64(n)) {
+			return fmt.Errorf("%s: %d overflows %s", where(path), n, dst.Type())
+		}
+		dst.SetInt(int64(n))
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := src.(int)
+		if !ok {
+			return mismatch(src, path, "an integer")
+		}
+		if n < 0 || dst.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%s: %d overflows %s", where(path), n, dst.Type())
+		}
+		dst.SetUint(uint64(n))
+		return nil
+
+	case reflect.String:
+		s, err := GetString(src)
+		if err != nil {
+			return mismatch(src, path, "a string")
+		}
+		dst.SetString(s)
+		return nil
+
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := GetBytes(src)
+			if err != nil {
+				return mismatch(src, path, "a string")
+			}
+			dst.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		list, ok := src.([]interface{})
+		if !ok {
+			return mismatch(src, path, "a list")
+		}
+		s := reflect.MakeSlice(dst.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := assign(s.Index(i), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+		return nil
+
+	case reflect.Array:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := GetBytes(src)
+			if err != nil {
+				return mismatch(src, path, "a string")
+			}
+			if len(b) != dst.Len() {
+				return fmt.Errorf("%s has %d bytes, want %d", where(path), len(b), dst.Len())
+			}
+			reflect.Copy(dst, reflect.ValueOf(b))
+			return nil
+		}
+		list, ok := src.([]interface{})
+		if !ok {
+			return mismatch(src, path, "a list")
+		}
+		if len(list) != dst.Len() {
+			return fmt.Errorf("%s has %d items, want %d", where(path), len(list), dst.Len())
+		}
+		for i, item := range list {
+			if err := assign(dst.Index(i), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			break
+		}
+		dict, ok := src.(map[string]interface{})
+		if !ok {
+			return mismatch(src, path, "a dictionary")
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), len(dict))
+		for key, item := range dict {
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := assign(elem, item, join(path, key)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(dst.Type().Key()), elem)
+		}
+		dst.Set(m)
+		return nil
+
+	case reflect.Struct:
+		dict, ok := src.(map[string]interface{})
+		if !ok {
+			return mismatch(src, path, "a dictionary")
+		}
+		t := dst.Type()
+		for i := range t.NumField() {
+			field := t.Field(i)
+			key := fieldKey(field)
+			if key == "" {
+				continue
+			}
+			item, ok := dict[key]
+			if !ok {
+				continue
+			}
+			if err := assign(dst.Field(i), item, join(path, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("bencode: cannot unmarshal into %s", dst.Type())
+}
+
+// fieldKey returns the dictionary key a struct field is filled from, or ""
+// if the field is skipped
+func fieldKey(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	tag, ok := field.Tag.Lookup("bencode")
+	if !ok {
+		return field.Name
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+	return name
+}
+
+// mismatch reports a decoded value of the wrong type for its destination
+func mismatch(src interface{}, path, want string) error {
+	return fmt.Errorf("%s is %s, not %s", where(path), typeName(src), want)
+}
+
+// join appends a dictionary key to a path
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// where renders a path for error messages, in the style of Lookup's
+func where(path string) string {
+	if path == "" {
+		return "value"
+	}
+	return fmt.Sprintf("%q", path)
+}
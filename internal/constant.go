@@ -1,8 +1,5 @@
 package internal
 
-// Peer ID used for all BitTorrent communications
-const PeerID = "leofeopeoluvsanayeli"
-
 // BitTorrent Protocol
 const (
 	ProtocolString       = "BitTorrent protocol"
@@ -21,14 +18,38 @@ const (
 	MessageRequest       byte = 6
 	MessagePiece         byte = 7
 	MessageCancel        byte = 8
+	MessageSuggest       byte = 13 // BEP 6 Fast Extension
+	MessageHaveAll       byte = 14 // BEP 6 Fast Extension
+	MessageHaveNone      byte = 15 // BEP 6 Fast Extension
+	MessageRejectRequest byte = 16 // BEP 6 Fast Extension
+	MessageAllowedFast   byte = 17 // BEP 6 Fast Extension
 	MessageExtension     byte = 20 // BEP 10 Extension Protocol
+
+	// MessageKeepAlive is a pseudo-ID reported for zero-length keep-alive frames,
+	// which carry no ID on the wire
+	MessageKeepAlive byte = 0xFF
 )
 
 // Download config
 const (
 	MaxPipelineRequests int    = 5       // Maximum concurrent block requests per peer
 	BlockSize           uint32 = 1 << 14 // 16KB - standard block size
+	MaxBlockSize        uint32 = 1 << 17 // 128KB - largest block request peers accept
 	MetadataPieceSize          = 1 << 14 // 16KB - metadata piece size for magnet links
+	MaxMetadataSize            = 1 << 23 // 8MB - largest info dict we fetch from magnet peers
+	MaxPieceLength             = 1 << 28 // 256MB - largest piece length we accept; pieces are held in memory
+	MaxMessageLength    uint32 = 1 << 21 // 2MB - largest peer message we accept
+	DefaultMaxWorkers          = 50      // workers when the swarm's size is unknown, and the most it picks
+	MinSwarmWorkers            = 10      // fewest workers a small swarm picks, leaving room for leechers
+	MaxPieceChokes             = 5       // chokes one piece attempt survives before the piece counts as failed
+
+	// MaxPieces is the most pieces an info dict of MaxMetadataSize can list,
+	// bounding the have messages we accept before a magnet's metadata arrives
+	MaxPieces = MaxMetadataSize / 20
+
+	// FailedPieceRetryDelay is how long, in milliseconds, a peer left with only
+	// pieces it failed gives other peers to take them before retrying them
+	FailedPieceRetryDelay = 500
 )
 
 // Network config
@@ -37,11 +58,32 @@ const (
 	DefaultUploaded   = 0
 	DefaultDownloaded = 0
 	DefaultCompact    = 1
-	ConnectionTimeout = 3 // seconds
+	ConnectionTimeout = 3  // seconds
+	KeepAliveInterval = 90 // seconds of idleness before sending a keep-alive
+	MaxHalfOpen       = 8  // peer connections being dialed at once
+
+	DefaultTrackerRetries   = 2    // extra attempts after a transient tracker failure
+	TrackerRetryDelay       = 500  // milliseconds, multiplied by the attempt number
+	DefaultAnnounceInterval = 1800 // seconds between announces until the tracker tells us otherwise
+	MinAnnounceInterval     = 60   // seconds between announces made early because we ran out of peers
+	TrackerTimeout          = 15   // seconds allowed for a whole HTTP tracker request
+	TrackerAnnounceTimeout  = 30   // seconds each tracker gets, retries included, when announcing to all at once
+	MaxTrackerRedirects     = 5
+	MaxTrackerResponse      = 1 << 20 // 1MB - largest tracker response body we accept
+	UserAgent               = "LR/0.0.1"
+	TorrentFetchTimeout     = 30       // seconds allowed to download a .torrent over HTTP
+	MaxTorrentFileSize      = 10 << 20 // 10MB - largest .torrent we fetch over HTTP
+
+	InboundHandshakeTimeout = 10  // seconds an inbound peer has to complete its handshake
+	InboundReadTimeout      = 180 // seconds an inbound peer may stay silent; keep-alives come every 120
+	MaxInboundConns         = 50  // inbound peer connections served at once when seeding
 )
 
 // Magnet Link Extension
 const (
 	ExtensionBitPosition = 5 // Reserved byte index for extension bit
 	ExtensionID          = 0x10
+	FastBitPosition      = 7    // Reserved byte index for the Fast Extension bit
+	FastID               = 0x04 // BEP 6
+	MetadataRetries      = 3    // attempts at each metadata piece before giving up
 )
@@ -0,0 +1,235 @@
+// Package dht finds peers through the mainline DHT (BEP 5). It is a read-only
+// client: it looks up peers for an info hash but doesn't keep a routing table
+// or answer queries from other nodes.
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BootstrapNodes are well-known routers used to enter the DHT
+var BootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// Lookup tuning
+const (
+	alpha        = 8               // queries in flight per round
+	maxQueries   = 200             // give up after asking this many nodes
+	wantPeers    = 50              // stop once we've found this many peers
+	roundTimeout = 2 * time.Second // how long to wait for a round's replies
+	maxPacket    = 1500            // largest UDP datagram we expect
+)
+
+// ErrNoPeers is returned when a lookup finishes without finding any peers
+var ErrNoPeers = errors.New("dht: no peers found")
+
+// Client performs DHT lookups over a single UDP socket
+type Client struct {
+	conn net.PacketConn
+	id   [20]byte
+	txn  uint16
+}
+
+// New opens a UDP socket on an ephemeral port with a random node ID.
+func New() (*Client, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("error opening DHT socket: %w", err)
+	}
+	c := &Client{conn: conn}
+	if _, err = rand.Read(c.id[:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error generating DHT node id: %w", err)
+	}
+	return c, nil
+}
+
+// Close closes the client's socket
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Lookup finds peers for infoHash with a short-lived client
+func Lookup(ctx context.Context, infoHash [20]byte) ([]netip.AddrPort, error) {
+	c, err := New()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.GetPeers(ctx, infoHash)
+}
+
+// GetPeers iteratively queries the nodes closest to infoHash until it has
+// found enough peers, runs out of closer nodes, or ctx is done.
+func (c *Client) GetPeers(ctx context.Context, infoHash [20]byte) ([]netip.AddrPort, error) {
+	candidates, err := resolveBootstrap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		queried = make(map[netip.AddrPort]bool)
+		known   = make(map[netip.AddrPort]bool)
+		seen    = make(map[netip.AddrPort]bool)
+		peers   []netip.AddrPort
+	)
+	for _, n := range candidates {
+		known[n.addr] = true
+	}
+
+	for len(queried) < maxQueries && len(peers) < wantPeers && ctx.Err() == nil {
+		// Ask the closest nodes we haven't asked yet
+		sortByDistance(candidates, infoHash)
+		var batch []node
+		for _, n := range candidates {
+			if len(batch) == alpha {
+				break
+			}
+			if !queried[n.addr] {
+				batch = append(batch, n)
+				queried[n.addr] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, resp := range c.queryRound(ctx, batch, infoHash) {
+			for _, p := range resp.peers {
+				if !seen[p] {
+					seen[p] = true
+					peers = append(peers, p)
+				}
+			}
+			for _, n := range resp.nodes {
+				if !known[n.addr] && reachable(n.addr) {
+					known[n.addr] = true
+					candidates = append(candidates, n)
+				}
+			}
+		}
+	}
+
+	if len(peers) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrNoPeers
+	}
+	return peers, nil
+}
+
+// queryRound sends get_peers to every node in batch and collects the replies
+// that arrive before roundTimeout
+func (c *Client) queryRound(ctx context.Context, batch []node, infoHash [20]byte) []*response {
+	pending := make(map[string]netip.AddrPort)
+	for _, n := range batch {
+		txn := c.nextTxn()
+		query, err := encodeGetPeers(txn, c.id, infoHash)
+		if err != nil {
+			continue
+		}
+		if _, err = c.conn.WriteTo(query, net.UDPAddrFromAddrPort(n.addr)); err != nil {
+			continue
+		}
+		pending[txn] = n.addr
+	}
+
+	deadline := time.Now().Add(roundTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { c.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var responses []*response
+	buf := make([]byte, maxPacket)
+	for len(pending) > 0 {
+		n, from, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		resp, err := decodeResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Only accept a reply from the node we sent that transaction to
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		fromAddr := udpAddr.AddrPort()
+		if pending[resp.txn] != netip.AddrPortFrom(fromAddr.Addr().Unmap(), fromAddr.Port()) {
+			continue
+		}
+		delete(pending, resp.txn)
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+// nextTxn returns a fresh 2-byte transaction id
+func (c *Client) nextTxn() string {
+	c.txn++
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, c.txn)
+	return string(b)
+}
+
+// resolveBootstrap looks up the bootstrap routers. Their node IDs are unknown,
+// but they are the only candidates in the first round anyway.
+func resolveBootstrap(ctx context.Context) ([]node, error) {
+	var (
+		nodes []node
+		errs  []error
+	)
+	for _, hostPort := range BootstrapNodes {
+		host, portStr, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid port: %w", hostPort, err))
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hostPort, err))
+			continue
+		}
+		nodes = append(nodes, node{addr: netip.AddrPortFrom(addrs[0].Unmap(), uint16(port))})
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("error resolving DHT bootstrap nodes: %w", errors.Join(errs...))
+	}
+	return nodes, nil
+}
+
+// sortByDistance orders nodes by XOR distance from target, closest first
+func sortByDistance(nodes []node, target [20]byte) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		for k := range target {
+			di := nodes[i].id[k] ^ target[k]
+			dj := nodes[j].id[k] ^ target[k]
+			if di != dj {
+				return di < dj
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+func TestSortByDistance(t *testing.T) {
+	target := [20]byte{0x0F}
+	nodes := []node{
+		{id: [20]byte{0xF0}},
+		{id: [20]byte{0x0F, 1}},
+		{id: [20]byte{0x00}},
+		{id: [20]byte{0x0F}},
+		{id: [20]byte{0x0E}},
+	}
+	sortByDistance(nodes, target)
+
+	var got [][20]byte
+	for _, n := range nodes {
+		got = append(got, n.id)
+	}
+	want := [][20]byte{{0x0F}, {0x0F, 1}, {0x0E}, {0x00}, {0xF0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %x, want %x", got, want)
+	}
+}
+
+// reply bencodes a get_peers response for txn carrying peers
+func reply(t *testing.T, txn string, peers ...string) []byte {
+	t.Helper()
+	var values []interface{}
+	for _, p := range peers {
+		values = append(values, compactPeer(p))
+	}
+	return encode(t, map[string]interface{}{
+		"t": txn,
+		"y": "r",
+		"r": map[string]interface{}{"id": string(make([]byte, 20)), "values": values},
+	})
+}
+
+func TestGetPeers(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	router, impostor := listen(), listen()
+
+	saved := BootstrapNodes
+	BootstrapNodes = []string{router.LocalAddr().String()}
+	defer func() { BootstrapNodes = saved }()
+
+	infoHash := [20]byte{0xAB}
+	queried := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxPacket)
+		n, from, err := router.ReadFrom(buf)
+		if err != nil {
+			queried <- err
+			return
+		}
+		decoded, err := bencode.Decode(buf[:n])
+		if err != nil {
+			queried <- err
+			return
+		}
+		query := decoded.(map[string]interface{})
+		txn, _ := bencode.GetString(query, "t")
+		args := query["a"].(map[string]interface{})
+		if got, _ := bencode.GetString(args, "info_hash"); got != string(infoHash[:]) {
+			t.Errorf("queried for info hash %x, want %x", got, infoHash)
+		}
+
+		// Replies from another address or for another transaction are ignored
+		impostor.WriteTo(reply(t, txn, "192.0.2.66:6881"), from)
+		router.WriteTo(reply(t, txn+"x", "192.0.2.67:6881"), from)
+		_, err = router.WriteTo(reply(t, txn, "192.0.2.1:6881", "192.0.2.2:0", "192.0.2.1:6881"), from)
+		queried <- err
+	}()
+
+	c, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peers, err := c.GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("GetPeers: %v", err)
+	}
+	if err := <-queried; err != nil {
+		t.Fatalf("router: %v", err)
+	}
+	if want := []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:6881")}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got peers %v, want %v", peers, want)
+	}
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+)
+
+// Compact encodings used in KRPC responses
+const (
+	compactPeerLength = 6  // 4-byte IPv4 address + 2-byte port
+	compactNodeLength = 26 // 20-byte node ID + compact peer
+)
+
+// node is a DHT node we know the address (and maybe the ID) of
+type node struct {
+	id   [20]byte
+	addr netip.AddrPort
+}
+
+// response is the part of a get_peers reply we care about
+type response struct {
+	txn   string
+	peers []netip.AddrPort
+	nodes []node
+}
+
+// reachable reports whether addr could be connected to. Nodes sometimes
+// report a zero port or address, which would only waste a query or dial.
+func reachable(addr netip.AddrPort) bool {
+	return addr.Port() != 0 && !addr.Addr().IsUnspecified()
+}
+
+// encodeGetPeers builds a KRPC get_peers query
+func encodeGetPeers(txn string, id, infoHash [20]byte) ([]byte, error) {
+	return bencode.Encode(map[string]interface{}{
+		"t": txn,
+		"y": "q",
+		"q": "get_peers",
+		"a": map[string]interface{}{
+			"id":        id[:],
+			"info_hash": infoHash[:],
+		},
+	})
+}
+
+// decodeResponse parses a KRPC reply. Errors ("y" = "e") and queries from
+// other nodes are reported as errors so the caller can skip them.
+func decodeResponse(packet []byte) (*response, error) {
+	decoded, err := bencode.Decode(packet)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding KRPC message: %w", err)
+	}
+	msg, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("KRPC message is not a dictionary")
+	}
+
+	txn, _ := bencode.GetString(msg, "t")
+	if y, _ := bencode.GetString(msg, "y"); y != "r" {
+		return nil, fmt.Errorf("KRPC message is not a response (y=%q)", y)
+	}
+	r, ok := msg["r"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("KRPC response has no body")
+	}
+
+	resp := &response{txn: txn}
+
+	// "values" is a list of compact peers for the info hash
+	if values, ok := r["values"].([]interface{}); ok {
+		for _, v := range values {
+			b, err := bencode.GetBytes(v)
+			if err != nil || len(b) != compactPeerLength {
+				continue
+			}
+			peers, _ := tracker.ParseCompactPeers(b, net.IPv4len)
+			if reachable(peers[0]) {
+				resp.peers = append(resp.peers, peers[0])
+			}
+		}
+	}
+
+	// "nodes" holds closer nodes to ask next
+	if nodes, err := bencode.GetBytes(r, "nodes"); err == nil {
+		for i := 0; i+compactNodeLength <= len(nodes); i += compactNodeLength {
+			var n node
+			copy(n.id[:], nodes[i:i+20])
+			addrs, _ := tracker.ParseCompactPeers(nodes[i+20:i+compactNodeLength], net.IPv4len)
+			n.addr = addrs[0]
+			resp.nodes = append(resp.nodes, n)
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// compactNode encodes a node as it appears in a "nodes" string
+func compactNode(id byte, addr string) string {
+	ap := netip.MustParseAddrPort(addr)
+	b := append(bytes.Repeat([]byte{id}, 20), ap.Addr().AsSlice()...)
+	return string(append(b, byte(ap.Port()>>8), byte(ap.Port())))
+}
+
+// compactPeer encodes a peer as it appears in "values"
+func compactPeer(addr string) string {
+	return compactNode(0, addr)[20:]
+}
+
+// encode bencodes a KRPC message for decodeResponse
+func encode(t *testing.T, msg map[string]interface{}) []byte {
+	t.Helper()
+	b, err := bencode.Encode(msg)
+	if err != nil {
+		t.Fatalf("encoding %v: %v", msg, err)
+	}
+	return b
+}
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   map[string]interface{}
+		peers []string
+		nodes []node
+	}{
+		{
+			name: "peers",
+			msg: map[string]interface{}{"t": "aa", "y": "r", "r": map[string]interface{}{
+				"values": []interface{}{compactPeer("192.0.2.1:6881"), compactPeer("192.0.2.2:51413")},
+			}},
+			peers: []string{"192.0.2.1:6881", "192.0.2.2:51413"},
+		},
+		{
+			name: "bad values entries",
+			msg: map[string]interface{}{"t": "aa", "y": "r", "r": map[string]interface{}{
+				"values": []interface{}{
+					compactPeer("192.0.2.1:6881")[:5],
+					compactPeer("192.0.2.1:6881") + "x",
+					42,
+					compactPeer("192.0.2.2:0"),
+					compactPeer("0.0.0.0:6881"),
+					compactPeer("192.0.2.3:6881"),
+				},
+			}},
+			peers: []string{"192.0.2.3:6881"},
+		},
+		{
+			name: "truncated nodes",
+			msg: map[string]interface{}{"t": "aa", "y": "r", "r": map[string]interface{}{
+				"nodes": compactNode(1, "192.0.2.1:6881") + compactNode(2, "192.0.2.2:6881")[:10],
+			}},
+			nodes: []node{{id: [20]byte(bytes.Repeat([]byte{1}, 20)), addr: netip.MustParseAddrPort("192.0.2.1:6881")}},
+		},
+	}
+	for _, tt := range tests {
+		resp, err := decodeResponse(encode(t, tt.msg))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if resp.txn != "aa" {
+			t.Errorf("%s: txn = %q, want %q", tt.name, resp.txn, "aa")
+		}
+		var peers []string
+		for _, p := range resp.peers {
+			peers = append(peers, p.String())
+		}
+		if !reflect.DeepEqual(peers, tt.peers) {
+			t.Errorf("%s: peers = %v, want %v", tt.name, peers, tt.peers)
+		}
+		if !reflect.DeepEqual(resp.nodes, tt.nodes) {
+			t.Errorf("%s: nodes = %v, want %v", tt.name, resp.nodes, tt.nodes)
+		}
+	}
+}
+
+func TestDecodeResponseRejects(t *testing.T) {
+	tests := map[string][]byte{
+		"error reply": encode(t, map[string]interface{}{
+			"t": "aa", "y": "e", "e": []interface{}{201, "Generic Error"},
+		}),
+		"query": encode(t, map[string]interface{}{
+			"t": "aa", "y": "q", "q": "ping", "a": map[string]interface{}{"id": string(make([]byte, 20))},
+		}),
+		"no body":         encode(t, map[string]interface{}{"t": "aa", "y": "r"}),
+		"not a dict":      []byte("li1ee"),
+		"invalid bencode": []byte("d1:t2:aa"),
+	}
+	for name, packet := range tests {
+		if resp, err := decodeResponse(packet); err == nil {
+			t.Errorf("%s: decoded as %+v", name, resp)
+		}
+	}
+}
+
+func TestEncodeGetPeers(t *testing.T) {
+	id := [20]byte{1}
+	infoHash := [20]byte{2}
+	query, err := encodeGetPeers("ab", id, infoHash)
+	if err != nil {
+		t.Fatalf("encodeGetPeers: %v", err)
+	}
+
+	// Keys are sorted as bencode requires
+	want := "d1:ad2:id20:" + string(id[:]) + "9:info_hash20:" + string(infoHash[:]) +
+		"e1:q9:get_peers1:t2:ab1:y1:qe"
+	if string(query) != want {
+		t.Errorf("got %q, want %q", query, want)
+	}
+}
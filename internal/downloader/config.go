@@ -1,26 +1,104 @@
 package downloader
 
-import "time"
+import (
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
 
 type Config struct {
-	MaxWorkers    int
-	MaxRetries    int
-	PipelineDepth int
-	Timeout       time.Duration
-	Verbose       bool
+	MaxWorkers      int // 0 picks a count to suit the swarm's seeders, see SwarmWorkers
+	MaxConnections  int // live peer connections kept at once; 0 uses MaxWorkers
+	MaxRetries      int
+	MaxPeerFailures int    // drop a peer after this many pieces fail in a row; 0 never does
+	PipelineDepth   int    // block requests kept in flight per peer
+	BlockSize       uint32 // bytes requested per block
+	Timeout         time.Duration
+	ConnectTimeout  time.Duration // how long to wait for a peer's TCP connection
+	PeerReadTimeout time.Duration // drop a peer that stays silent this long
+	PieceTimeout    time.Duration // drop a peer that takes longer than this over one piece attempt; 0 never does
+	TrackerRetries  int           // retries of an announce after a transient failure
+	TrackerBackoff  time.Duration // wait before the first announce retry, growing linearly
+	Verbose         bool
+	UseMmap         bool        // write output through a memory mapping where supported
+	ResumePath      string      // where to persist progress; empty disables resuming
+	StreamPath      string      // write pieces straight to this output path instead of buffering
+	OutputDir       string      // directory relative output paths are resolved against; empty is the working directory
+	FilePerm        fs.FileMode // permissions of created output files; 0 is 0644
+	DirPerm         fs.FileMode // permissions of created output directories; 0 is 0755
+	NoOverwrite     bool        // make SaveFile fail rather than replace existing files
+	Strategy        Strategy
+	RateLimit       int   // cap on total download throughput in bytes per second; 0 is unlimited
+	UseDHT          bool  // also look for peers in the DHT while downloading (never for private torrents)
+	UsePEX          bool  // exchange peers with connected peers over ut_pex (never for private torrents)
+	UseWebSeeds     bool  // also fetch pieces over HTTP from the torrent's url-list web seeds
+	ListenPort      int   // accept inbound peers and upload to them on this port; 0 disables
+	AnnouncePort    int   // port announced to the tracker; 0 announces ListenPort, or the default port
+	AnnounceAll     bool  // announce to every tracker at once, each on its own interval, instead of failing over
+	NoCompact       bool  // ask trackers for the dictionary peer list instead of the compact one
+	SharePieces     bool  // let idle workers fetch blocks of pieces other workers are downloading
+	Files           []int // indices of the files to download; nil downloads every file
+
+	// Seeders is how many seeders the trackers reported when the peers were
+	// found, for sizing the worker pool when MaxWorkers is 0
+	Seeders int
+
+	// TrackerClient, if set, sends tracker announces, e.g. through a proxy
+	TrackerClient *http.Client
+
+	// Storage, if set, receives each verified piece instead of memory or the
+	// StreamPath files
+	Storage storage.Storage
+
+	// Progress is called after each verified piece with the number of pieces
+	// completed, the total, and the bytes completed so far
+	Progress ProgressFunc
 }
 
+// ProgressFunc receives download progress. It is always called from the same
+// goroutine, so implementations need no synchronization of their own.
+type ProgressFunc func(completed, total int, bytes int64)
+
 func DefaultConfig() Config {
 	return Config{
-		MaxWorkers: 50,
-		MaxRetries: 3,
-		Timeout:    5 * time.Minute,
-		Verbose:    false,
+		MaxRetries:      3,
+		MaxPeerFailures: 3,
+		Timeout:         5 * time.Minute,
+		ConnectTimeout:  internal.ConnectionTimeout * time.Second,
+		PeerReadTimeout: 2 * time.Minute, // peers send keep-alives at least this often
+		PieceTimeout:    2 * time.Minute,
+		Verbose:         false,
+		Strategy:        Rarest,
+		TrackerRetries:  internal.DefaultTrackerRetries,
+		TrackerBackoff:  internal.TrackerRetryDelay * time.Millisecond,
 	}
 }
 
 type Option func(*Config)
 
+// newConfig returns the default config with opts applied in order
+func newConfig(opts []Option) Config {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithSeeders tells the downloader how many seeders the trackers reported,
+// e.g. in metainfo.Swarm, so that without WithMaxWorkers the worker pool
+// starts at a size to suit the swarm. Re-announces update the count.
+func WithSeeders(n int) Option {
+	return func(c *Config) {
+		if n > 0 {
+			c.Seeders = n
+		}
+	}
+}
+
 func WithMaxWorkers(n int) Option {
 	return func(c *Config) {
 		if n > 0 {
@@ -37,8 +115,308 @@ func WithMaxRetries(n int) Option {
 	}
 }
 
+// WithMaxConnections sets how many peers we stay connected to at once,
+// however many are known: as connections drop, queued peers are dialed to
+// take their place, no more than MaxHalfOpen from the internal package at a
+// time
+func WithMaxConnections(n int) Option {
+	return func(c *Config) {
+		if n > 0 {
+			c.MaxConnections = n
+		}
+	}
+}
+
+// connections returns the number of live peer connections to keep
+func (c Config) connections() int {
+	if c.MaxConnections > 0 {
+		return c.MaxConnections
+	}
+	return c.workers(c.Seeders)
+}
+
+// workers returns the number of workers to run in a swarm with the given
+// number of seeders
+func (c Config) workers(seeders int) int {
+	if c.MaxWorkers > 0 {
+		return c.MaxWorkers
+	}
+	return SwarmWorkers(seeders)
+}
+
+// SwarmWorkers picks a worker count for a swarm with the given number of
+// seeders: two per seeder, so leechers get as many slots again, but no fewer
+// than MinSwarmWorkers and no more than DefaultMaxWorkers from the internal
+// package. With no seeders reported there is nothing to go on, and it picks
+// the most.
+func SwarmWorkers(seeders int) int {
+	if seeders <= 0 {
+		return internal.DefaultMaxWorkers
+	}
+	return min(max(2*seeders, internal.MinSwarmWorkers), internal.DefaultMaxWorkers)
+}
+
+// WithMaxPeerFailures drops a peer once n pieces in a row have failed from
+// it, freeing its worker slot for another peer. Dropped peers aren't retried.
+func WithMaxPeerFailures(n int) Option {
+	return func(c *Config) {
+		if n > 0 {
+			c.MaxPeerFailures = n
+		}
+	}
+}
+
+// WithPipelineDepth sets how many block requests are kept in flight per
+// peer. High-latency links benefit from deeper pipelines.
+func WithPipelineDepth(n int) Option {
+	return func(c *Config) {
+		if n >= 1 {
+			c.PipelineDepth = n
+		}
+	}
+}
+
+// WithBlockSize sets the size of each block request. Most peers refuse
+// blocks over 16KB, so larger sizes only suit known peers.
+func WithBlockSize(n uint32) Option {
+	return func(c *Config) {
+		if n >= 1 && n <= internal.MaxBlockSize {
+			c.BlockSize = n
+		}
+	}
+}
+
+// WithRateLimit caps total download throughput across all peers at
+// bytesPerSec.
+func WithRateLimit(bytesPerSec int) Option {
+	return func(c *Config) {
+		if bytesPerSec > 0 {
+			c.RateLimit = bytesPerSec
+		}
+	}
+}
+
+// WithDHT looks up peers in the DHT alongside the tracker, adding any it finds
+// to the worker pool mid-download.
+func WithDHT(useDHT bool) Option {
+	return func(c *Config) {
+		c.UseDHT = useDHT
+	}
+}
+
+// WithPEX exchanges peer lists with connected peers (BEP 11), adding the
+// peers they share to the worker pool mid-download.
+func WithPEX(usePEX bool) Option {
+	return func(c *Config) {
+		c.UsePEX = usePEX
+	}
+}
+
+// WithWebSeeds also downloads from the torrent's BEP 19 web seeds, if it
+// lists any, fetching whole pieces over HTTP alongside the peers. They keep a
+// download going when the swarm has no peers left.
+func WithWebSeeds(useWebSeeds bool) Option {
+	return func(c *Config) {
+		c.UseWebSeeds = useWebSeeds
+	}
+}
+
+// WithFileSelection downloads only the files at the given indices (in
+// Info.GetFiles order), plus whatever pieces they share with other files.
+// Unselected files aren't written.
+func WithFileSelection(indices []int) Option {
+	return func(c *Config) {
+		c.Files = append([]int{}, indices...)
+	}
+}
+
+// WithConnectTimeout sets how long workers wait to connect to a peer, for
+// swarms with distant peers
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.ConnectTimeout = d
+		}
+	}
+}
+
+// WithPeerReadTimeout drops peers that send nothing for d
+func WithPeerReadTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.PeerReadTimeout = d
+		}
+	}
+}
+
+// WithPieceTimeout gives up on a piece attempt that takes longer than d, so a
+// peer trickling blocks can't hold a piece for the whole download; the piece
+// goes back to the queue for another peer. 0 disables the limit.
+func WithPieceTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		if d >= 0 {
+			c.PieceTimeout = d
+		}
+	}
+}
+
+// WithTimeout bounds a download made with New or DownloadFileCtx. Downloads
+// made with NewContext take their deadline from the context instead.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		if d > 0 {
+			c.Timeout = d
+		}
+	}
+}
+
 func WithVerbose(verbose bool) Option {
 	return func(c *Config) {
 		c.Verbose = verbose
 	}
 }
+
+// WithMmap writes the output file(s) through a memory mapping instead of
+// WriteAt calls. Platforms without mmap support fall back to WriteAt.
+func WithMmap(useMmap bool) Option {
+	return func(c *Config) {
+		c.UseMmap = useMmap
+	}
+}
+
+// WithResume persists each verified piece to the file at path, and skips pieces
+// already saved there when the download is restarted.
+func WithResume(path string) Option {
+	return func(c *Config) {
+		c.ResumePath = path
+	}
+}
+
+// WithPermissions sets the permissions output files and directories are
+// created with; zero values keep the defaults of 0644 and 0755
+func WithPermissions(file, dir fs.FileMode) Option {
+	return func(c *Config) {
+		c.FilePerm = file
+		c.DirPerm = dir
+	}
+}
+
+// WithNoOverwrite makes SaveFile refuse to write over files that already
+// exist, e.g. a partial download, leaving them untouched
+func WithNoOverwrite(noOverwrite bool) Option {
+	return func(c *Config) {
+		c.NoOverwrite = noOverwrite
+	}
+}
+
+// WithStreamToDisk writes each verified piece to its offset in the output file(s)
+// at path as soon as it arrives, instead of buffering the whole torrent in memory.
+// Download then returns no data; the files are complete when it returns.
+func WithStreamToDisk(path string) Option {
+	return func(c *Config) {
+		c.StreamPath = path
+	}
+}
+
+// WithStorage writes each verified piece to its offset in s as soon as it
+// arrives, like WithStreamToDisk but with any backend, e.g.
+// storage.NewMemory. Download syncs s but leaves closing it to the caller.
+func WithStorage(s storage.Storage) Option {
+	return func(c *Config) {
+		c.Storage = s
+	}
+}
+
+// WithOutputDir resolves relative output paths against dir, so the output
+// file name and the directory it lands in can be chosen separately.
+// Multi-file torrents get their own directory inside it.
+func WithOutputDir(dir string) Option {
+	return func(c *Config) {
+		c.OutputDir = dir
+	}
+}
+
+// WithProgress registers a callback invoked after every verified piece.
+func WithProgress(fn ProgressFunc) Option {
+	return func(c *Config) {
+		c.Progress = fn
+	}
+}
+
+// WithStrategy sets the order in which pieces are downloaded. Rarest is the
+// default; Sequential is useful when the output is consumed while downloading.
+func WithStrategy(strategy Strategy) Option {
+	return func(c *Config) {
+		c.Strategy = strategy
+	}
+}
+
+// WithAnnouncePort announces port to the tracker instead of the listen port,
+// e.g. when a router forwards a different external port to us.
+func WithAnnouncePort(port int) Option {
+	return func(c *Config) {
+		if port > 0 && port <= 65535 {
+			c.AnnouncePort = port
+		}
+	}
+}
+
+// WithAnnounceAll announces to every tracker in the announce-list instead of
+// just the first that answers, pooling the peers they return. Each tracker is
+// re-announced to on the interval it asks for.
+func WithAnnounceAll(announceAll bool) Option {
+	return func(c *Config) {
+		c.AnnounceAll = announceAll
+	}
+}
+
+// WithSharedPieces lets a worker with nothing pending help download a piece
+// another worker is on, splitting its blocks between their peers. It speeds
+// up the tail of a download, when few pieces are left for many peers.
+func WithSharedPieces(share bool) Option {
+	return func(c *Config) {
+		c.SharePieces = share
+	}
+}
+
+// WithTrackerRetries retries announces that fail with a network error or a
+// 5xx status up to n times, waiting backoff times the retry number before
+// each one: backoff, then 2*backoff, then 3*backoff. Failures the tracker
+// explains are never retried.
+func WithTrackerRetries(n int, backoff time.Duration) Option {
+	return func(c *Config) {
+		if n >= 0 {
+			c.TrackerRetries = n
+		}
+		if backoff > 0 {
+			c.TrackerBackoff = backoff
+		}
+	}
+}
+
+// WithCompact asks trackers for compact peer lists, as they are by
+// default, or for the dictionary form when compact is false, for trackers
+// that mishandle compact=1
+func WithCompact(compact bool) Option {
+	return func(c *Config) {
+		c.NoCompact = !compact
+	}
+}
+
+// WithTrackerClient sends tracker announces through client. Build it with
+// tracker.NewHTTPClient to keep the usual timeout and redirect handling.
+func WithTrackerClient(client *http.Client) Option {
+	return func(c *Config) {
+		c.TrackerClient = client
+	}
+}
+
+// WithListen accepts inbound peer connections on port while downloading and
+// uploads the pieces verified so far.
+func WithListen(port int) Option {
+	return func(c *Config) {
+		if port > 0 && port <= 65535 {
+			c.ListenPort = port
+		}
+	}
+}
@@ -2,14 +2,21 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"net/netip"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/seeder"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
 )
 
 type Downloader struct {
@@ -17,30 +24,67 @@ type Downloader struct {
 	peers   []peer.Peer
 	config  Config
 
-	workQueue chan *PieceWork
-	results   chan *PieceResult
-	errors    chan *WorkerError
-
+	picker  *piecePicker
+	pool    *workerPool
+	limiter *rateLimiter  // shared by all workers when RateLimit is set
+	dialing chan struct{} // one slot per dial in progress, up to MaxHalfOpen
+	swarm   *swarm        // connected peers shared over PEX when UsePEX is set
+	results chan *PieceResult
+	errors  chan *WorkerError
+	stats   chan PeerStats
+
+	mu             sync.Mutex // guards done and pieces, which the seeder reads
+	numPieces      int
+	pieces         [][]byte      // verified piece data when not streaming
+	done           peer.BitField // pieces verified so far
+	wanted         peer.BitField // pieces overlapping a selected file
+	partial        peer.BitField // wanted pieces that also overlap an unselected file
+	selected       map[int]bool  // selected file indices; nil selects every file
+	numWanted      int
+	remaining      int // wanted pieces not yet verified
+	completedBytes int64
+	resumedBytes   int64                // bytes already verified when the download started
+	workerErrors   map[string]error     // last error reported by each peer
+	peerStats      map[string]PeerStats // per-peer totals, guarded by mu
+	store          storage.Storage      // output storage when streaming to disk
+	resume         *resumeFile
+	seeder         *seeder.Seeder
+	pieceReady     *sync.Cond // broadcast on each verified piece and when Download ends
+	finished       bool
+	finishErr      error
+	pieceSubs      map[chan int]struct{} // seeder connections told of newly verified pieces
+
+	started    time.Time
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 }
 
+// New creates a Downloader whose download is bounded by Config.Timeout.
 func New(t *metainfo.TorrentFile, peers []peer.Peer, opts ...Option) *Downloader {
-	cfg := DefaultConfig()
-	for _, opt := range opts {
-		opt(&cfg)
-	}
-
+	cfg := newConfig(opts)
 	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	return newDownloader(ctx, cancel, t, peers, cfg)
+}
 
-	return &Downloader{
+// NewContext creates a Downloader whose download runs until ctx is done,
+// e.g. on Ctrl-C. Config.Timeout is not applied; ctx carries any deadline.
+func NewContext(ctx context.Context, t *metainfo.TorrentFile, peers []peer.Peer, opts ...Option) *Downloader {
+	cfg := newConfig(opts)
+	ctx, cancel := context.WithCancel(ctx)
+	return newDownloader(ctx, cancel, t, peers, cfg)
+}
+
+func newDownloader(ctx context.Context, cancel context.CancelFunc,
+	t *metainfo.TorrentFile, peers []peer.Peer, cfg Config) *Downloader {
+	d := &Downloader{
 		torrent:    t,
 		peers:      peers,
 		config:     cfg,
 		ctx:        ctx,
 		cancelFunc: cancel,
 	}
-
+	d.pieceReady = sync.NewCond(&d.mu)
+	return d
 }
 
 type PieceWork struct {
@@ -54,121 +98,638 @@ type PieceResult struct {
 	Payload []byte
 }
 
-// Download orchestrates concurrent download from multiple peers using a worker pool
+// Download orchestrates concurrent download from multiple peers using a worker pool.
+// If the download times out or is cancelled, the error is a *TimeoutError and,
+// unless streaming to disk, the data downloaded so far is returned with it,
+// missing pieces zero-filled, so it can be kept for later.
 func (d *Downloader) Download() ([]byte, error) {
+	data, err := d.download()
+	d.finish(err)
+	return data, err
+}
+
+func (d *Downloader) download() ([]byte, error) {
 	defer d.cancelFunc()
+	d.started = time.Now()
 
-	var (
-		pieceHashes = d.torrent.Info.PieceHashes()
-		numPieces   = len(pieceHashes)
-	)
+	numPieces := d.torrent.Info.NumPieces()
+	if _, err := d.torrent.Info.PieceLengthAt(numPieces - 1); err != nil {
+		return nil, fmt.Errorf("invalid torrent: %w", err)
+	}
 
-	d.workQueue = make(chan *PieceWork, numPieces)
 	d.results = make(chan *PieceResult, numPieces)
-	d.errors = make(chan *WorkerError, len(d.peers))
-
-	if err := d.fillWorkQueue(); err != nil {
+	d.errors = make(chan *WorkerError, d.config.connections())
+	d.stats = make(chan PeerStats)
+
+	d.numPieces = numPieces
+	d.mu.Lock() // a Reader may already be waiting on done
+	d.done = peer.NewBitField(numPieces)
+	d.pieces = make([][]byte, numPieces)
+	d.mu.Unlock()
+	d.workerErrors = make(map[string]error)
+	d.peerStats = make(map[string]PeerStats)
+	if err := d.selectPieces(); err != nil {
 		return nil, err
 	}
 
-	var wg sync.WaitGroup
-	numWorkers := min(d.config.MaxWorkers, len(d.peers))
+	if d.config.Storage != nil {
+		d.store = d.config.Storage
+	} else if d.config.StreamPath != "" {
+		files, err := d.storageFiles(d.config.StreamPath)
+		if err != nil {
+			return nil, err
+		}
+		s, err := storage.Open(files, d.config.UseMmap)
+		if err != nil {
+			return nil, fmt.Errorf("error opening output storage: %w", err)
+		}
+		d.store = s
+		defer d.store.Close()
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(p peer.Peer) {
-			defer wg.Done()
-			worker := NewWorker(&p, d.torrent, d.config)
-			if err := worker.Run(d.ctx, d.workQueue, d.results, d.errors); err != nil {
-				d.errors <- &WorkerError{
-					PeerAddr: p.AddrPort.String(),
-					Phase:    "worker",
-					Err:      err,
-				}
-			}
-		}(d.peers[i])
+	if d.config.ResumePath != "" {
+		if err := d.loadResume(); err != nil {
+			return nil, err
+		}
+		defer d.resume.close()
+	}
+
+	d.picker = newPiecePicker(d.pieceWork(), d.skipped(), d.config.Strategy)
+	if d.config.SharePieces {
+		d.picker.enableSharing(d.config.BlockSize)
+	}
+	if d.config.RateLimit > 0 {
+		d.limiter = newRateLimiter(d.config.RateLimit)
+	}
+	d.dialing = make(chan struct{}, internal.MaxHalfOpen)
+	if d.config.UsePEX && !d.torrent.Info.Private {
+		d.swarm = newSwarm()
+	}
+	d.resumedBytes = d.completedBytes
+	// Set up before the re-announces start, as they report its upload total
+	if d.config.ListenPort > 0 {
+		d.seeder = seeder.New(d.torrent.Info, d)
+		d.seeder.Verbose = d.config.Verbose
 	}
 
-	// Close results when workers are done
-	go func() {
-		wg.Wait()
+	// Workers stop as soon as every piece is in, even if some are still waiting
+	workCtx, stopWorkers := context.WithCancel(d.ctx)
+	defer stopWorkers()
+
+	// Results, errors and stats close once the last worker exits
+	statsDone := make(chan struct{})
+	go d.collectStats(statsDone)
+	d.pool = newWorkerPool(d.config.connections(), func(p *peer.Peer) {
+		d.runWorker(workCtx, p)
+	}, func() {
 		close(d.results)
 		close(d.errors)
-	}()
+		close(d.stats)
+	})
+	if !d.complete() {
+		peers := make([]*peer.Peer, len(d.peers))
+		for i := range d.peers {
+			peers[i] = &d.peers[i]
+		}
+		d.pool.add(peers...)
+		if d.config.AnnounceAll {
+			for _, trackerURL := range d.torrent.TrackerURLs() {
+				go d.reannounce(workCtx, trackerURL)
+			}
+		} else {
+			go d.reannounce(workCtx, "")
+		}
+		if d.config.UseDHT && !d.torrent.Info.Private {
+			go d.discoverDHT(workCtx)
+		}
+		if d.config.UseWebSeeds {
+			for _, seedURL := range d.torrent.URLList {
+				d.pool.spawn(func() { d.runWebSeed(workCtx, seedURL) })
+			}
+		}
+	}
+	d.pool.start()
+
+	// The seeder reads from the output storage, so it must be done with its
+	// connections before the storage is closed
+	seedDone := make(chan struct{})
+	if d.seeder != nil {
+		go func() {
+			defer close(seedDone)
+			d.seed(workCtx)
+		}()
+	} else {
+		close(seedDone)
+	}
+
+	wasComplete := d.complete()
+	err := d.collectResults()
+	d.pool.stop()
+	stopWorkers()
+
+	// Wait for the workers to wind down so Stats covers all of them
+	<-statsDone
+	<-seedDone
+
+	if d.complete() && !wasComplete {
+		d.announce(tracker.EventCompleted)
+	}
+	d.announce(tracker.EventStopped)
 
-	pieces, err := d.collectResults()
 	if err != nil {
+		// Keep what we have so an interrupted download can resume
+		if d.store != nil {
+			d.store.Sync()
+			return nil, err
+		}
+		var timeoutErr *TimeoutError
+		if errors.As(err, &timeoutErr) {
+			return d.assemble(), err
+		}
 		return nil, err
 	}
 
-	// Assemble file byte slice
+	// Streamed pieces are already on disk
+	if d.store != nil {
+		if err := d.finishStream(); err != nil {
+			return nil, err
+		}
+		return nil, d.validatePieces()
+	}
+
+	// Every worker gave up before the download finished
+	if err := d.validatePieces(); err != nil {
+		return nil, err
+	}
+
+	return d.assemble(), nil
+}
+
+// assemble joins the downloaded pieces into the torrent's data, zero-filling
+// pieces no selected file needed or that never arrived
+func (d *Downloader) assemble() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	fileBytes := make([]byte, 0, d.torrent.Info.Length)
-	for _, piece := range pieces {
+	for i, piece := range d.pieces {
+		if piece == nil {
+			piece = make([]byte, d.pieceLength(i))
+		}
 		fileBytes = append(fileBytes, piece...)
 	}
+	return fileBytes
+}
+
+// pieceWork describes every piece of the torrent, indexed by piece
+func (d *Downloader) pieceWork() []*PieceWork {
+	work := make([]*PieceWork, d.numPieces)
+
+	for i := range work {
+		hash, _ := d.torrent.Info.PieceHash(i)
+		work[i] = &PieceWork{
+			Index:  i,
+			Hash:   hash,
+			Length: d.pieceLength(i),
+		}
+	}
+	return work
+}
 
-	return fileBytes, nil
+// pieceLength returns the length of the piece at index; the last piece may be
+// short. Download checks the piece hashes up front, so index is always valid.
+func (d *Downloader) pieceLength(index int) uint32 {
+	length, _ := d.torrent.Info.PieceLengthAt(index)
+	return length
 }
 
-func (d *Downloader) fillWorkQueue() error {
-	pieceHashes := d.torrent.Info.PieceHashes()
-	numPieces := len(pieceHashes)
-	pieceLength := uint32(d.torrent.Info.PieceLength)
+// loadResume opens the resume file and marks any verified pieces saved by a
+// previous run as done. When streaming, piece data is checked in the output
+// storage; otherwise it is read back from the resume file into memory.
+func (d *Downloader) loadResume() error {
+	r, err := openResume(d.config.ResumePath, d.torrent.Info, d.store)
+	if err != nil {
+		return err
+	}
+	loaded := 0
+	err = r.load(d.pieceLength, func(index int, data []byte) {
+		d.markDone(index, data)
+		loaded++
+	})
+	if err != nil {
+		r.close()
+		return err
+	}
+	if d.config.Verbose && loaded > 0 {
+		fmt.Printf("Resuming: %d/%d pieces (%.1f%%) already downloaded\n",
+			d.numWanted-d.remaining, d.numWanted, d.torrent.Info.PercentComplete(d.done))
+	}
+	d.resume = r
+	return nil
+}
 
-	for i := 0; i < numPieces; i++ {
-		length := pieceLength
+// storePiece puts a verified piece in the output storage when streaming, or
+// keeps it in memory otherwise, and records its progress
+func (d *Downloader) storePiece(index int, data []byte) error {
+	if d.store != nil {
+		offset := int64(index) * int64(d.torrent.Info.PieceLength)
+		if _, err := d.store.WriteAt(data, offset); err != nil {
+			return fmt.Errorf("error writing piece %d: %w", index, err)
+		}
+	}
+	d.markDone(index, data)
 
-		if i == numPieces-1 {
-			length = uint32(d.torrent.Info.Length) - pieceLength*uint32(numPieces-1)
+	if d.resume != nil {
+		if err := d.resume.save(index, data); err != nil {
+			return err
 		}
+	}
 
-		d.workQueue <- &PieceWork{
-			Index:  i,
-			Hash:   pieceHashes[i],
-			Length: length,
+	if d.config.Progress != nil {
+		d.config.Progress(d.numWanted-d.remaining, d.numWanted, d.completedBytes)
+	}
+	return nil
+}
+
+// markDone records a verified piece, keeping its data in memory unless it
+// lives in the output storage
+func (d *Downloader) markDone(index int, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.store == nil {
+		d.pieces[index] = data
+	}
+	isNew := !d.done.HasPiece(index)
+	if d.wanted.HasPiece(index) && isNew {
+		d.remaining--
+	}
+	d.done.SetPiece(index)
+	d.completedBytes += int64(len(data))
+	d.pieceReady.Broadcast()
+
+	// Like Bitfield, leave out pieces that can't be read back
+	if isNew && !(d.store != nil && d.config.Storage == nil && d.partial.HasPiece(index)) {
+		for ch := range d.pieceSubs {
+			ch <- index
+		}
+	}
+}
+
+// SubscribePieces returns a channel receiving the index of each piece
+// verified from now on that Bitfield would include, and a func ending the
+// subscription. The seeder uses it to send Have messages while downloading.
+func (d *Downloader) SubscribePieces() (<-chan int, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Each piece is sent at most once, so room for all of them means markDone
+	// never blocks on a slow connection
+	ch := make(chan int, d.torrent.Info.NumPieces())
+	if d.pieceSubs == nil {
+		d.pieceSubs = make(map[chan int]struct{})
+	}
+	d.pieceSubs[ch] = struct{}{}
+	return ch, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.pieceSubs, ch)
+	}
+}
+
+// Bitfield returns a snapshot of the pieces verified so far. When streaming
+// to disk, pieces only partly stored because they overlap an unselected file
+// are left out, as they can't be read back.
+func (d *Downloader) Bitfield() peer.BitField {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bf := append(peer.BitField(nil), d.done...)
+	if d.store != nil && d.config.Storage == nil {
+		for j := range bf {
+			bf[j] &^= d.partial[j]
+		}
+	}
+	return bf
+}
+
+// ReadAt reads verified torrent data at a global byte offset, from the output
+// storage when streaming or from memory otherwise. It lets the seeder upload
+// pieces while the download is still running.
+func (d *Downloader) ReadAt(p []byte, off int64) (int, error) {
+	if d.store != nil {
+		return d.store.ReadAt(p, off)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pieceLength := int64(d.torrent.Info.PieceLength)
+	n := 0
+	for n < len(p) {
+		index := int((off + int64(n)) / pieceLength)
+		if index >= len(d.pieces) || d.pieces[index] == nil {
+			return n, fmt.Errorf("piece %d not available", index)
+		}
+		begin := (off + int64(n)) % pieceLength
+		if begin >= int64(len(d.pieces[index])) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], d.pieces[index][begin:])
+	}
+	return n, nil
+}
+
+// seed uploads verified pieces to inbound peers until ctx is done
+func (d *Downloader) seed(ctx context.Context) {
+	if err := d.seeder.Listen(ctx, d.config.ListenPort); err != nil && d.config.Verbose {
+		fmt.Printf("Seeder error: %v\n", err)
+	}
+}
+
+// runWorker downloads from p until it fails or ctx is done
+func (d *Downloader) runWorker(ctx context.Context, p *peer.Peer) {
+	d.configurePeer(p)
+	worker := NewWorker(p, d.torrent, d.config)
+	worker.swarm = d.swarm
+	worker.dialing = d.dialing
+	err := worker.Run(ctx, d.picker, d.results, d.errors)
+	d.stats <- worker.Stats()
+	if err == nil {
+		return
+	}
+	workerErr, ok := err.(*WorkerError)
+	if !ok {
+		workerErr = &WorkerError{
+			PeerAddr: p.AddrPort.String(),
+			Phase:    "worker",
+			Err:      err,
+		}
+	}
+	worker.report(ctx, d.errors, workerErr)
+}
+
+// reannounce periodically announces to trackerURL on the interval it asks
+// for, handing any new peers it returns to the worker pool. Once the pool
+// runs out of spare peers it announces early, as soon as the tracker allows;
+// while announces keep coming back without peers, the wait before an early
+// one doubles each time, up to the regular interval. Queued peers older than
+// the interval are dropped as stale, since the tracker has had time to hand
+// out fresher ones, and a growing seeder count makes room for more workers
+// when their number is left to the swarm. An empty trackerURL fails over through the announce-list
+// instead.
+func (d *Downloader) reannounce(ctx context.Context, trackerURL string) {
+	interval := internal.DefaultAnnounceInterval * time.Second
+	minInterval := internal.MinAnnounceInterval * time.Second
+	empty := 0 // announces in a row that returned no peers
+	last := time.Now()
+	next := last.Add(interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		case <-d.pool.starved:
+			if early := last.Add(announceBackoff(minInterval, interval, empty)); early.Before(next) {
+				next = early
+			}
+			continue
+		}
+
+		last = time.Now()
+		next = last.Add(interval)
+		tres, err := d.announceTo(trackerURL, tracker.EventNone)
+		if err != nil {
+			continue
 		}
+		if len(tres.Peers) == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+		if n := tres.NextAnnounce(); n > 0 {
+			interval = time.Duration(n) * time.Second
+			next = last.Add(interval)
+			d.pool.setMaxAge(interval)
+		}
+		if tres.MinInterval > 0 {
+			minInterval = max(time.Duration(tres.MinInterval)*time.Second, minInterval)
+		}
+		if tres.Seeders > 0 && d.config.MaxConnections == 0 {
+			d.pool.raiseMaxWorkers(d.config.workers(tres.Seeders))
+		}
+		if added := d.pool.addInfos(tres.Peers); added > 0 && d.config.Verbose {
+			fmt.Printf("Tracker returned %d new peers\n", added)
+		}
+	}
+}
+
+// announceBackoff returns how long to wait after an announce before making an
+// early one: minInterval, doubled for each of the last empty announces that
+// returned no peers, but never longer than the regular interval
+func announceBackoff(minInterval, interval time.Duration, empty int) time.Duration {
+	wait := minInterval
+	for i := 0; i < empty && wait < interval; i++ {
+		wait *= 2
+	}
+	return max(min(wait, interval), minInterval)
+}
+
+// discoverDHT looks the torrent up in the DHT and hands the peers it finds
+// to the worker pool
+func (d *Downloader) discoverDHT(ctx context.Context) {
+	peers, err := dht.Lookup(ctx, d.torrent.Info.InfoHash)
+	if err != nil {
+		if ctx.Err() == nil && d.config.Verbose {
+			fmt.Printf("DHT error: %v\n", err)
+		}
+		return
+	}
+	if added := d.pool.addInfos(tracker.NewPeers(peers, tracker.SourceDHT)); added > 0 && d.config.Verbose {
+		fmt.Printf("DHT returned %d new peers\n", added)
+	}
+}
+
+// discoverPEX hands peers learned over PEX to the worker pool
+func (d *Downloader) discoverPEX(peers []netip.AddrPort) {
+	if added := d.pool.addInfos(tracker.NewPeers(peers, tracker.SourcePEX)); added > 0 && d.config.Verbose {
+		fmt.Printf("PEX returned %d new peers\n", added)
+	}
+}
+
+// configurePeer applies the config's timeouts, request sizes and rate limit
+// to p before a worker connects to it
+func (d *Downloader) configurePeer(p *peer.Peer) {
+	p.ConnectTimeout = d.config.ConnectTimeout
+	p.ReadTimeout = d.config.PeerReadTimeout
+	p.PipelineDepth = d.config.PipelineDepth
+	p.BlockSize = d.config.BlockSize
+	p.ListenPort = d.config.ListenPort
+	p.NumPieces = d.numPieces
+	p.Choked = true // until it tells us otherwise
+	if d.limiter != nil {
+		p.Limiter = d.limiter
+	}
+	if d.swarm != nil {
+		p.OnPex = d.discoverPEX
+	}
+}
+
+// announce reports a lifecycle event to the tracker, or to every tracker
+// with AnnounceAll. Failures are not fatal to the download.
+func (d *Downloader) announce(event string) {
+	if !d.config.AnnounceAll {
+		d.announceTo("", event)
+		return
+	}
+	uploaded, downloaded, left := d.transferTotals()
+	results := d.torrent.AnnounceAll(event, uploaded, downloaded, left, d.announceOptions()...)
+	if d.config.Verbose {
+		for _, r := range results {
+			if r.Err != nil && !errors.Is(r.Err, tracker.ErrNoPeers) {
+				fmt.Printf("Tracker error: %s: %v\n", r.URL, r.Err)
+			}
+		}
+	}
+}
+
+// announceTo reports an event to trackerURL with this session's transfer
+// totals, or fails over through the announce-list if trackerURL is empty
+func (d *Downloader) announceTo(trackerURL, event string) (*tracker.TrackerResponse, error) {
+	uploaded, downloaded, left := d.transferTotals()
+	var tres *tracker.TrackerResponse
+	var err error
+	if trackerURL == "" {
+		tres, err = d.torrent.AnnounceEvent(event, uploaded, downloaded, left, d.announceOptions()...)
+	} else {
+		tres, err = d.torrent.AnnounceTo(trackerURL, event, uploaded, downloaded, left, d.announceOptions()...)
+		if errors.Is(err, tracker.ErrNoPeers) {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", trackerURL, err)
+		}
+	}
+	if d.config.Verbose {
+		if err != nil {
+			fmt.Printf("Tracker error: %v\n", err)
+		} else if tres.Warning != "" {
+			fmt.Printf("Tracker warning: %s\n", tres.Warning)
+		}
+	}
+	return tres, err
+}
+
+// transferTotals returns this session's upload and download totals and the
+// bytes of wanted pieces still to verify, as reported to trackers. Counting
+// only wanted pieces lets left reach 0 when some files are skipped.
+func (d *Downloader) transferTotals() (uploaded, downloaded, left int) {
+	if d.seeder != nil {
+		uploaded = int(d.seeder.Uploaded())
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	missing := peer.NewBitField(d.numPieces)
+	for j := range missing {
+		missing[j] = d.wanted[j] &^ d.done[j]
+	}
+	left = int(d.torrent.Info.CompletedBytes(missing))
+	return uploaded, int(d.completedBytes - d.resumedBytes), left
+}
+
+// announceOptions returns the request options every announce uses
+func (d *Downloader) announceOptions() []tracker.RequestOption {
+	port := d.config.AnnouncePort
+	if port == 0 {
+		port = d.config.ListenPort
+	}
+	return []tracker.RequestOption{
+		tracker.WithPort(port),
+		tracker.WithRetries(d.config.TrackerRetries, d.config.TrackerBackoff),
+		tracker.WithHTTPClient(d.config.TrackerClient),
+		tracker.WithCompact(!d.config.NoCompact),
+	}
+}
+
+// finishStream flushes the streamed output and, once every piece is on disk,
+// discards the resume file
+func (d *Downloader) finishStream() error {
+	if err := d.store.Sync(); err != nil {
+		return fmt.Errorf("error flushing output: %w", err)
+	}
+	if d.resume != nil && d.complete() {
+		return d.resume.remove()
 	}
-	close(d.workQueue)
 	return nil
 }
 
-// collectResults gathers downloaded pieces
-func (d *Downloader) collectResults() ([][]byte, error) {
-	numPieces := len(d.torrent.Info.PieceHashes())
-	pieces := make([][]byte, numPieces)
+// complete reports whether every wanted piece has been verified
+func (d *Downloader) complete() bool {
+	return d.remaining == 0
+}
+
+// collectResults gathers downloaded pieces, storing each one as it arrives
+func (d *Downloader) collectResults() error {
 
 	// Progress ticker
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
+	errs := d.errors
 	for {
 		select {
 		case <-d.ctx.Done():
-			return nil, fmt.Errorf("download timeout")
+			return &TimeoutError{
+				Duration:         time.Since(d.started).Round(time.Millisecond),
+				PiecesTotal:      d.numWanted,
+				PiecesDownloaded: d.numWanted - d.remaining,
+				Pieces:           d.Bitfield(),
+				Err:              d.ctx.Err(),
+			}
 
 		case result, ok := <-d.results:
 			if !ok {
-				// Results channel closed, all workers done
-				return pieces, nil
+				// Results channel closed, all workers done; keep their last words
+				if errs != nil {
+					for err := range errs {
+						d.recordWorkerError(err)
+					}
+				}
+				return nil
 			}
 
-			pieces[result.Index] = result.Payload
+			if err := d.storePiece(result.Index, result.Payload); err != nil {
+				return err
+			}
+			if d.complete() {
+				return nil
+			}
 
-		case err := <-d.errors:
-			if d.config.Verbose {
-				fmt.Printf("Worker error: %v\n", err)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
 			}
+			d.recordWorkerError(err)
 
 		}
 	}
 }
 
-// validatePieces checks that all pieces were downloaded
-func (d *Downloader) validatePieces(pieces [][]byte) error {
+// recordWorkerError keeps the latest error from each peer for DownloadError
+func (d *Downloader) recordWorkerError(err *WorkerError) {
+	if d.config.Verbose {
+		if errors.Is(err, peer.ErrPeerDisconnected) {
+			fmt.Printf("Peer %s disconnected during %s\n", err.PeerAddr, err.Phase)
+		} else {
+			fmt.Printf("Worker error: %v\n", err)
+		}
+	}
+	d.workerErrors[err.PeerAddr] = err
+}
+
+// validatePieces checks that all pieces were downloaded, reporting the
+// missing ones along with the last error each peer hit
+func (d *Downloader) validatePieces() error {
 	var missing []int
 
-	for i, piece := range pieces {
-		if piece == nil {
+	for i := range d.numPieces {
+		if d.wanted.HasPiece(i) && !d.done.HasPiece(i) {
 			missing = append(missing, i)
 		}
 	}
@@ -177,63 +738,136 @@ func (d *Downloader) validatePieces(pieces [][]byte) error {
 		return &DownloadError{
 			TorrentName:  d.torrent.Info.Name,
 			FailedPieces: missing,
-			TotalPieces:  len(pieces),
+			TotalPieces:  d.numWanted,
+			WorkerErrors: d.workerErrors,
 		}
 	}
 
 	return nil
 }
 
-// SaveFile saves downloaded data to appropriate file(s)
-func (d *Downloader) SaveFile(downloadPath string, data []byte) error {
-	files := d.torrent.Info.GetFiles()
-
-	if d.torrent.Info.IsSingleFile() {
-		// Single file: just write it
-		return os.WriteFile(downloadPath, data, 0644)
+// SaveFile saves downloaded data to appropriate file(s) and returns the paths
+// written. With WithNoOverwrite, it fails with an error wrapping fs.ErrExist
+// if any of them already exists, before writing anything.
+func (d *Downloader) SaveFile(downloadPath string, data []byte) ([]string, error) {
+	files, err := d.storageFiles(downloadPath)
+	if err != nil {
+		return nil, err
 	}
-	// Multi-file: create directory structure and split data
-	baseDir := filepath.Join(filepath.Dir(downloadPath), d.torrent.Info.Name)
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
-		return fmt.Errorf("error creating base directory: %w", err)
+	var written []string
+	for i := range files {
+		files[i].Exclusive = d.config.NoOverwrite
+		if !files[i].Skip {
+			written = append(written, files[i].Path)
+		}
 	}
 
-	offset := 0
-	for _, fileInfo := range files {
-		// Construct file path
-		pathComponents := append([]string{baseDir}, fileInfo.Path...)
-		filePath := filepath.Join(pathComponents...)
+	s, err := storage.Open(files, d.config.UseMmap)
+	if err != nil {
+		return nil, fmt.Errorf("error opening output storage: %w", err)
+	}
 
-		// Create parent directories
-		parentDir := filepath.Dir(filePath)
-		if err := os.MkdirAll(parentDir, 0755); err != nil {
-			return fmt.Errorf("error creating directory %s: %w", parentDir, err)
+	if _, err = s.WriteAt(data, 0); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error writing output: %w", err)
+	}
+	if err = s.Sync(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error flushing output: %w", err)
+	}
+
+	if d.config.Verbose && !d.torrent.Info.IsSingleFile() {
+		for _, f := range files {
+			if f.Skip {
+				continue
+			}
+			fmt.Printf("Wrote file: %s (%d bytes)\n", f.Path, f.Length)
 		}
+	}
 
-		// Extract file data
-		fileData := data[offset : offset+fileInfo.Length]
+	if err = s.Close(); err != nil {
+		return nil, err
+	}
 
-		// Write file
-		if err := os.WriteFile(filePath, fileData, 0644); err != nil {
-			return fmt.Errorf("error writing file %s: %w", filePath, err)
+	// The output now holds every piece; progress no longer needs tracking
+	if d.resume != nil {
+		if err = d.resume.remove(); err != nil {
+			return nil, err
 		}
-
-		fmt.Printf("Wrote file: %s (%d bytes)\n", filePath, fileInfo.Length)
-		offset += fileInfo.Length
 	}
+	return written, nil
+}
 
-	return nil
+// OutputFiles returns the files a download to downloadPath writes, without
+// creating anything. Files left out by WithFileSelection are only marked Skip
+// once Download has started.
+func (d *Downloader) OutputFiles(downloadPath string) ([]storage.File, error) {
+	return d.storageFiles(downloadPath)
 }
 
-func DownloadFile(t *metainfo.TorrentFile, peers []peer.Peer, maxWorkers int, downloadPath string) error {
-	d := New(t, peers, WithMaxWorkers(maxWorkers))
-	fileBytes, err := d.Download()
-	if err != nil {
-		return err
+// storageFiles lays out the torrent's file(s) on disk relative to downloadPath,
+// itself relative to Config.OutputDir if set. Single-file torrents are written
+// to downloadPath itself; multi-file torrents go in a directory named after
+// the torrent next to it. Names and paths from the torrent that could land
+// outside that directory are refused.
+func (d *Downloader) storageFiles(downloadPath string) ([]storage.File, error) {
+	if d.config.OutputDir != "" && !filepath.IsAbs(downloadPath) {
+		downloadPath = filepath.Join(d.config.OutputDir, downloadPath)
+	}
+	if d.torrent.Info.IsSingleFile() {
+		return []storage.File{{
+			Path:    downloadPath,
+			Length:  int64(d.torrent.Info.Length),
+			Perm:    d.config.FilePerm,
+			DirPerm: d.config.DirPerm,
+		}}, nil
 	}
 
-	if err = d.SaveFile(downloadPath, fileBytes); err != nil {
-		return err
+	outputDir := filepath.Dir(downloadPath)
+	baseDir, err := metainfo.SafeJoin(outputDir, d.torrent.Info.Name)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	files := make([]storage.File, 0, len(d.torrent.Info.Files))
+	for i, fileInfo := range d.torrent.Info.GetFiles() {
+		path, err := metainfo.SafeJoin(baseDir, fileInfo.Path...)
+		if err != nil {
+			return nil, fmt.Errorf("file %d: %w", i, err)
+		}
+		files = append(files, storage.File{
+			Path:    path,
+			Length:  int64(fileInfo.Length),
+			Skip:    !d.fileSelected(i),
+			Perm:    d.config.FilePerm,
+			DirPerm: d.config.DirPerm,
+		})
+	}
+	return files, nil
+}
+
+// DownloadFile downloads the torrent to downloadPath, streaming pieces to disk as
+// they arrive and keeping progress in downloadPath + ".part" so an interrupted
+// download can be resumed by running it again. Pass WithListen to
+// DownloadFileCtx to upload verified pieces as well, and WithDHT, WithPEX,
+// WithAnnounceAll or WithWebSeeds to find more sources.
+func DownloadFile(t *metainfo.TorrentFile, peers []peer.Peer, maxWorkers int, downloadPath string) error {
+	return DownloadFileCtx(context.Background(), t, peers, maxWorkers, downloadPath)
+}
+
+// DownloadFileCtx is DownloadFile bounded by ctx as well as Config.Timeout,
+// which WithTimeout sets. Cancelling ctx stops the download, keeping the
+// pieces verified so far for the next run, and tells the tracker we stopped.
+// opts are applied after DownloadFile's own settings.
+func DownloadFileCtx(ctx context.Context, t *metainfo.TorrentFile, peers []peer.Peer, maxWorkers int, downloadPath string,
+	opts ...Option) error {
+	opts = append([]Option{
+		WithMaxWorkers(maxWorkers),
+		WithStreamToDisk(downloadPath),
+		WithResume(downloadPath + ".part"),
+	}, opts...)
+
+	ctx, cancel := context.WithTimeout(ctx, newConfig(opts).Timeout)
+	defer cancel()
+	_, err := NewContext(ctx, t, peers, opts...).Download()
+	return err
 }
@@ -1,10 +1,19 @@
 package downloader
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
 )
 
+// ErrPieceTimeout is returned, wrapped, when a piece attempt runs past
+// Config.PieceTimeout
+var ErrPieceTimeout = errors.New("piece download timed out")
+
 type DownloadError struct {
 	TorrentName  string
 	FailedPieces []int
@@ -27,13 +36,48 @@ func (e *WorkerError) Error() string {
 	return fmt.Sprintf("worker for peer %s failed during %s: %v", e.PeerAddr, e.Phase, e.Err)
 }
 
+func (e *WorkerError) Unwrap() error {
+	return e.Err
+}
+
+// WebSeedStatusError is returned, wrapped, when a web seed answers a range
+// request with anything but the data
+type WebSeedStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *WebSeedStatusError) Error() string {
+	return fmt.Sprintf("web seed %s answered %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// permanent reports whether asking again can't help: a 4xx status other
+// than a timeout or rate limiting
+func (e *WebSeedStatusError) permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 &&
+		e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+// TimeoutError is returned when a download's context ends, by timing out or
+// being cancelled, before every wanted piece is in. Pieces marks the ones
+// that are; see Download for getting at their data.
 type TimeoutError struct {
 	Duration         time.Duration
 	PiecesTotal      int
 	PiecesDownloaded int
+	Pieces           peer.BitField
+	Err              error // the context's error
 }
 
 func (e *TimeoutError) Error() string {
+	if errors.Is(e.Err, context.Canceled) {
+		return fmt.Sprintf("download cancelled after %v: only %d/%d pieces completed",
+			e.Duration, e.PiecesDownloaded, e.PiecesTotal)
+	}
 	return fmt.Sprintf("download timeout after %v: only %d/%d pieces completed",
 		e.Duration, e.PiecesDownloaded, e.PiecesTotal)
 }
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
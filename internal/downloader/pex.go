@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// pexInterval is how often we send each peer a PEX update (BEP 11 asks for
+// no more than one a minute)
+const pexInterval = time.Minute
+
+// swarm tracks the peers we have working connections to, which is what we
+// share with other peers over PEX
+type swarm struct {
+	mu    sync.Mutex
+	peers map[netip.AddrPort]bool
+}
+
+func newSwarm() *swarm {
+	return &swarm{peers: make(map[netip.AddrPort]bool)}
+}
+
+func (s *swarm) join(addr netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[addr] = true
+}
+
+func (s *swarm) leave(addr netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, addr)
+}
+
+// snapshot returns the connected peers other than except
+func (s *swarm) snapshot(except netip.AddrPort) map[netip.AddrPort]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make(map[netip.AddrPort]bool, len(s.peers))
+	for addr := range s.peers {
+		if addr != except {
+			peers[addr] = true
+		}
+	}
+	return peers
+}
+
+// sharePeers sends the peer a PEX update with the connections gained and lost
+// since the last one, once the peer supports ut_pex and pexInterval has passed
+func (w *Worker) sharePeers() error {
+	if w.swarm == nil || !w.peer.SupportsPex() || time.Since(w.lastPex) < pexInterval {
+		return nil
+	}
+	w.lastPex = time.Now()
+
+	current := w.swarm.snapshot(w.peer.Addr())
+	var added, dropped []netip.AddrPort
+	for addr := range current {
+		if !w.pexSent[addr] && len(added) < peer.MaxPexPeers {
+			added = append(added, addr)
+		}
+	}
+	for addr := range w.pexSent {
+		if !current[addr] && len(dropped) < peer.MaxPexPeers {
+			dropped = append(dropped, addr)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	if err := w.peer.SendPex(added, dropped); err != nil {
+		return err
+	}
+	for _, addr := range added {
+		w.pexSent[addr] = true
+	}
+	for _, addr := range dropped {
+		delete(w.pexSent, addr)
+	}
+	return nil
+}
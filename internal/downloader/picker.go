@@ -0,0 +1,186 @@
+package downloader
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// Strategy decides the order in which pieces are handed out to workers.
+type Strategy int
+
+const (
+	// Rarest hands out the pieces advertised by the fewest connected peers first,
+	// so rare pieces aren't starved while every worker chases common ones.
+	Rarest Strategy = iota
+	// Sequential hands out pieces in index order, which suits streaming playback.
+	Sequential
+	// Random hands out pieces in a random order.
+	Random
+)
+
+type pieceState int
+
+const (
+	piecePending pieceState = iota
+	pieceInFlight
+	pieceDone
+)
+
+// piecePicker hands out pieces to workers according to a Strategy, tracking
+// which pieces are pending, in flight or done, and how many connected peers
+// advertise each piece.
+type piecePicker struct {
+	mu           sync.Mutex
+	strategy     Strategy
+	work         []*PieceWork
+	state        []pieceState
+	availability []int
+	order        []int // candidate order for Sequential and Random
+	remaining    int   // pieces not yet done
+
+	// In-flight pieces open to other workers, when sharing is enabled
+	shares    map[int]*sharedPiece
+	blockSize uint32
+
+	changed chan struct{} // closed and replaced whenever state changes
+}
+
+// newPiecePicker creates a picker over work, where work[i] describes piece i.
+// Pieces already marked in done are never handed out.
+func newPiecePicker(work []*PieceWork, done peer.BitField, strategy Strategy) *piecePicker {
+	pp := &piecePicker{
+		strategy:     strategy,
+		work:         work,
+		state:        make([]pieceState, len(work)),
+		availability: make([]int, len(work)),
+		order:        make([]int, len(work)),
+		changed:      make(chan struct{}),
+	}
+	for i := range work {
+		pp.order[i] = i
+		if done.HasPiece(i) {
+			pp.state[i] = pieceDone
+		} else {
+			pp.remaining++
+		}
+	}
+	if strategy == Random {
+		rand.Shuffle(len(pp.order), func(i, j int) {
+			pp.order[i], pp.order[j] = pp.order[j], pp.order[i]
+		})
+	}
+	return pp
+}
+
+// addPeer counts a newly connected peer's pieces towards availability
+func (pp *piecePicker) addPeer(bf peer.BitField) {
+	pp.adjustAvailability(bf, 1)
+}
+
+// removePeer discounts a disconnected peer's pieces
+func (pp *piecePicker) removePeer(bf peer.BitField) {
+	pp.adjustAvailability(bf, -1)
+}
+
+func (pp *piecePicker) adjustAvailability(bf peer.BitField, delta int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for i := range pp.availability {
+		if bf.HasPiece(i) {
+			pp.availability[i] += delta
+		}
+	}
+	pp.notify()
+}
+
+// have records that a connected peer acquired the piece at index
+func (pp *piecePicker) have(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if index >= 0 && index < len(pp.availability) {
+		pp.availability[index]++
+		pp.notify()
+	}
+}
+
+// next claims the best pending piece that bf has and skip doesn't exclude.
+// When nothing is available it returns nil along with a channel that is closed
+// the next time the picker's state changes; finished reports whether every
+// piece is done, in which case there is nothing left to wait for.
+func (pp *piecePicker) next(bf peer.BitField, skip func(int) bool) (work *PieceWork, wait <-chan struct{}, finished bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.remaining == 0 {
+		return nil, nil, true
+	}
+
+	best := -1
+	for _, i := range pp.order {
+		if pp.state[i] != piecePending || !bf.HasPiece(i) || (skip != nil && skip(i)) {
+			continue
+		}
+		if pp.strategy != Rarest {
+			best = i
+			break
+		}
+		if best == -1 || pp.availability[i] < pp.availability[best] {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return nil, pp.changed, false
+	}
+	pp.state[best] = pieceInFlight
+	if pp.shares != nil {
+		// Idle workers may want to join it
+		pp.shares[best] = newSharedPiece(pp.work[best], pp.blockSize)
+		pp.notify()
+	}
+	return pp.work[best], nil, false
+}
+
+// pending reports whether any piece bf has is waiting to be claimed,
+// regardless of what a worker skips
+func (pp *piecePicker) pending(bf peer.BitField) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for i, state := range pp.state {
+		if state == piecePending && bf.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// requeue returns an in-flight piece to the pending set so another worker can try it
+func (pp *piecePicker) requeue(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.state[index] == pieceInFlight {
+		pp.state[index] = piecePending
+		delete(pp.shares, index)
+		pp.notify()
+	}
+}
+
+// complete marks an in-flight piece as done
+func (pp *piecePicker) complete(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.state[index] != pieceDone {
+		pp.state[index] = pieceDone
+		pp.remaining--
+		delete(pp.shares, index)
+		pp.notify()
+	}
+}
+
+// notify wakes every worker waiting for a state change. Must hold pp.mu.
+func (pp *piecePicker) notify() {
+	close(pp.changed)
+	pp.changed = make(chan struct{})
+}
@@ -0,0 +1,208 @@
+package downloader
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+)
+
+// workerPool runs up to maxWorkers workers at a time over a growing set of
+// peers. Peers discovered mid-download are queued and picked up as soon as a
+// worker slot frees up, the most recently discovered first. Once the last
+// worker exits with nothing left to run, the pool closes the downloader's
+// results and errors channels.
+//
+// When a worker exits with no spare peer to replace it, the pool signals
+// starved so the downloader can go looking for more.
+//
+// Queued peers go stale: once maxAge is set, those discovered longer ago are
+// dropped instead of dialed, and any peer last discovered that long ago may
+// be queued afresh when a tracker hands it out again.
+//
+// Sources that aren't peers, like web seeds, run through spawn: they don't
+// take a worker slot, but the pool stays open until they return too.
+type workerPool struct {
+	mu         sync.Mutex
+	maxWorkers int
+	maxAge     time.Duration                // how long a discovered peer stays fresh; 0 is forever
+	known      map[netip.AddrPort]time.Time // when each peer was last discovered, to skip duplicates
+	running    map[netip.AddrPort]bool
+	pending    []pendingPeer // freshest first
+	active     int
+	extra      int // goroutines started with spawn still running
+	closed     bool
+
+	run     func(p *peer.Peer)
+	close   func()
+	starved chan struct{}
+}
+
+// pendingPeer is a queued peer and when it was discovered
+type pendingPeer struct {
+	peer  *peer.Peer
+	found time.Time
+}
+
+func newWorkerPool(maxWorkers int, run func(p *peer.Peer), close func()) *workerPool {
+	return &workerPool{
+		maxWorkers: maxWorkers,
+		known:      make(map[netip.AddrPort]time.Time),
+		running:    make(map[netip.AddrPort]bool),
+		run:        run,
+		close:      close,
+		starved:    make(chan struct{}, 1),
+	}
+}
+
+// add queues peers that are new or whose last discovery has gone stale, ahead
+// of the peers already queued, and starts workers for them if there are free
+// slots
+func (wp *workerPool) add(peers ...*peer.Peer) int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed {
+		return 0
+	}
+
+	now := time.Now()
+	var fresh []pendingPeer
+	for _, p := range peers {
+		addr := *p.AddrPort
+		if found, ok := wp.known[addr]; ok && (wp.running[addr] || !wp.stale(found, now)) {
+			continue
+		}
+		wp.forget(addr)
+		wp.known[addr] = now
+		fresh = append(fresh, pendingPeer{peer: p, found: now})
+	}
+	wp.pending = append(fresh, wp.pending...)
+	wp.fill()
+	return len(fresh)
+}
+
+// addInfos queues peers described by a tracker, the DHT or PEX
+func (wp *workerPool) addInfos(infos tracker.Peers) int {
+	peers := make([]*peer.Peer, len(infos))
+	for i, info := range infos {
+		peers[i] = peer.FromInfo(info)
+	}
+	return wp.add(peers...)
+}
+
+// setMaxAge sets how long discovered peers stay fresh, e.g. to a tracker's
+// announce interval. The longest age set so far is kept, so no tracker's
+// peers expire before it is due to hand out new ones.
+func (wp *workerPool) setMaxAge(age time.Duration) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.maxAge = max(wp.maxAge, age)
+}
+
+// raiseMaxWorkers lets up to n workers run at once if that is more than
+// before, starting queued peers in the new slots
+func (wp *workerPool) raiseMaxWorkers(n int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if n > wp.maxWorkers {
+		wp.maxWorkers = n
+		wp.fill()
+	}
+}
+
+// stale reports whether a peer discovered at found is past maxAge. Callers
+// hold mu.
+func (wp *workerPool) stale(found, now time.Time) bool {
+	return wp.maxAge > 0 && now.Sub(found) >= wp.maxAge
+}
+
+// forget drops a queued peer, if addr is one. Callers hold mu.
+func (wp *workerPool) forget(addr netip.AddrPort) {
+	for i, pp := range wp.pending {
+		if *pp.peer.AddrPort == addr {
+			wp.pending = append(wp.pending[:i], wp.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// start launches the first workers, closing the pool straight away if there
+// is nothing to run
+func (wp *workerPool) start() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.fill()
+	wp.closeIfIdle()
+}
+
+// stop closes the pool to new peers, e.g. once the download has everything
+func (wp *workerPool) stop() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.pending = nil
+	wp.closeIfIdle()
+}
+
+// fill starts pending peers while worker slots are free, dropping any that
+// have gone stale while queued. Callers hold mu.
+func (wp *workerPool) fill() {
+	now := time.Now()
+	for wp.active < wp.maxWorkers && len(wp.pending) > 0 {
+		pp := wp.pending[0]
+		wp.pending = wp.pending[1:]
+		if wp.stale(pp.found, now) {
+			continue
+		}
+		wp.active++
+		wp.running[*pp.peer.AddrPort] = true
+		go wp.runWorker(pp.peer)
+	}
+}
+
+func (wp *workerPool) runWorker(p *peer.Peer) {
+	wp.run(p)
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.active--
+	delete(wp.running, *p.AddrPort)
+	wp.fill()
+	if !wp.closed && len(wp.pending) == 0 {
+		select {
+		case wp.starved <- struct{}{}:
+		default:
+		}
+	}
+	wp.closeIfIdle()
+}
+
+// spawn runs fn outside the worker slots, keeping the pool open until it
+// returns
+func (wp *workerPool) spawn(fn func()) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed {
+		return
+	}
+	wp.extra++
+	go func() {
+		fn()
+
+		wp.mu.Lock()
+		defer wp.mu.Unlock()
+		wp.extra--
+		wp.closeIfIdle()
+	}()
+}
+
+// closeIfIdle closes the pool once nothing is running or waiting to run.
+// Callers hold mu.
+func (wp *workerPool) closeIfIdle() {
+	if wp.closed || wp.active > 0 || wp.extra > 0 || len(wp.pending) > 0 {
+		return
+	}
+	wp.closed = true
+	wp.close()
+}
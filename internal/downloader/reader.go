@@ -0,0 +1,101 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// pieceReader reads the torrent's data front to back as pieces are verified
+type pieceReader struct {
+	d     *Downloader
+	pos   int64
+	store storage.Storage // read-only view of the output when streaming to disk
+}
+
+// Reader returns a reader over the torrent's data, in order, for playing
+// media while it downloads. Each Read blocks until the piece at the read
+// position has been verified, so pair it with the Sequential strategy. It
+// returns io.EOF after the last byte, or the download's error if Download
+// ends without the piece it is waiting for. The reader may be created before
+// or during Download, and should be closed when done with.
+func (d *Downloader) Reader() io.ReadCloser {
+	return &pieceReader{d: d}
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	length := int64(r.d.torrent.Info.Length)
+	if r.pos >= length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	pieceLength := int64(r.d.torrent.Info.PieceLength)
+	index := int(r.pos / pieceLength)
+	if err := r.d.waitPiece(index); err != nil {
+		return 0, err
+	}
+
+	// Stop at the end of the piece; the next one may not be in yet
+	end := min(int64(index+1)*pieceLength, length)
+	n, err := r.readAt(p[:min(int64(len(p)), end-r.pos)], r.pos)
+	r.pos += int64(n)
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// readAt reads verified data from memory or, when streaming, from our own
+// handle on the output files, which stays usable after Download closes its own
+func (r *pieceReader) readAt(p []byte, off int64) (int, error) {
+	if r.d.config.StreamPath == "" {
+		return r.d.ReadAt(p, off)
+	}
+	if r.store == nil {
+		files, err := r.d.storageFiles(r.d.config.StreamPath)
+		if err != nil {
+			return 0, err
+		}
+		if r.store, err = storage.OpenReadOnly(files); err != nil {
+			return 0, fmt.Errorf("error opening output for reading: %w", err)
+		}
+	}
+	return r.store.ReadAt(p, off)
+}
+
+func (r *pieceReader) Close() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Close()
+}
+
+// waitPiece blocks until the piece at index is verified or the download ends
+// without it
+func (d *Downloader) waitPiece(index int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.done.HasPiece(index) {
+		if d.finished {
+			if d.finishErr != nil {
+				return d.finishErr
+			}
+			return fmt.Errorf("piece %d was not downloaded", index)
+		}
+		d.pieceReady.Wait()
+	}
+	return nil
+}
+
+// finish records how Download ended and wakes any readers waiting on a piece
+func (d *Downloader) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finished = true
+	d.finishErr = err
+	d.pieceReady.Broadcast()
+}
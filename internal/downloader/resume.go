@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// resumeMagic identifies a resume file
+const resumeMagic = "BTRS"
+
+// resumeFile persists download progress so an interrupted download can pick up
+// where it left off. Layout:
+//
+//	magic (4) | info hash (20) | bitfield of verified pieces | piece data
+//
+// Piece i's data lives at dataOffset + i*PieceLength. When the download streams
+// to disk, the output storage already holds the data, so only the bitfield is
+// kept here.
+type resumeFile struct {
+	path        string
+	f           *os.File
+	info        *metainfo.Info
+	bitfield    peer.BitField
+	dataOffset  int64
+	bitfieldOff int64
+
+	store storage.Storage // external piece data; nil to keep data in f
+}
+
+// openResume opens or creates the resume file at path. A file that belongs to a
+// different torrent (or is corrupt) is discarded and progress starts over.
+// store, if non-nil, is where piece data is read back from on resume.
+func openResume(path string, info *metainfo.Info, store storage.Storage) (*resumeFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening resume file: %w", err)
+	}
+
+	numPieces := len(info.PieceHashes())
+	r := &resumeFile{
+		path:        path,
+		f:           f,
+		info:        info,
+		bitfield:    peer.NewBitField(numPieces),
+		bitfieldOff: int64(len(resumeMagic) + len(info.InfoHash)),
+		store:       store,
+	}
+	r.dataOffset = r.bitfieldOff + int64(len(r.bitfield))
+
+	header := make([]byte, r.dataOffset)
+	_, err = io.ReadFull(f, header)
+	switch {
+	case err == nil && string(header[:len(resumeMagic)]) == resumeMagic &&
+		bytes.Equal(header[len(resumeMagic):r.bitfieldOff], info.InfoHash[:]):
+		copy(r.bitfield, header[r.bitfieldOff:])
+		return r, nil
+	case err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF):
+		f.Close()
+		return nil, fmt.Errorf("error reading resume file: %w", err)
+	}
+
+	// New or foreign file: start from an empty bitfield
+	if err = f.Truncate(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error resetting resume file: %w", err)
+	}
+	copy(header, resumeMagic)
+	copy(header[len(resumeMagic):], info.InfoHash[:])
+	if _, err = f.WriteAt(header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error writing resume header: %w", err)
+	}
+	return r, nil
+}
+
+// load calls found for each previously saved piece. Pieces whose data no
+// longer matches their hash are skipped and will be downloaded again.
+func (r *resumeFile) load(lengthOf func(int) uint32, found func(index int, data []byte)) error {
+	for i, hash := range r.info.PieceHashes() {
+		if !r.bitfield.HasPiece(i) {
+			continue
+		}
+		data := make([]byte, lengthOf(i))
+		if _, err := r.readPiece(data, i); err != nil {
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			return fmt.Errorf("error reading saved piece %d: %w", i, err)
+		}
+		if !bytes.Equal(metainfo.HashPiece(data), hash) {
+			continue
+		}
+		found(i, data)
+	}
+	return nil
+}
+
+// readPiece reads a saved piece from the external store or the resume file
+func (r *resumeFile) readPiece(data []byte, index int) (int, error) {
+	if r.store != nil {
+		return r.store.ReadAt(data, int64(index)*int64(r.info.PieceLength))
+	}
+	return r.f.ReadAt(data, r.pieceOffset(index))
+}
+
+// save persists a verified piece. The data is written before its bit is set,
+// so a crash in between only loses the piece rather than corrupting it.
+// With an external store the caller has already written the data there.
+func (r *resumeFile) save(index int, data []byte) error {
+	if r.store == nil {
+		if _, err := r.f.WriteAt(data, r.pieceOffset(index)); err != nil {
+			return fmt.Errorf("error saving piece %d: %w", index, err)
+		}
+	}
+	r.bitfield.SetPiece(index)
+	byteIndex := index / 8
+	if _, err := r.f.WriteAt(r.bitfield[byteIndex:byteIndex+1], r.bitfieldOff+int64(byteIndex)); err != nil {
+		return fmt.Errorf("error saving progress for piece %d: %w", index, err)
+	}
+	return nil
+}
+
+// pieceOffset returns where piece index's data lives in the file
+func (r *resumeFile) pieceOffset(index int) int64 {
+	return r.dataOffset + int64(index)*int64(r.info.PieceLength)
+}
+
+func (r *resumeFile) close() error {
+	return r.f.Close()
+}
+
+// remove deletes the resume file once the download has been saved
+func (r *resumeFile) remove() error {
+	r.f.Close()
+	return os.Remove(r.path)
+}
@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// selectPieces works out which pieces the download needs: all of them unless
+// Config.Files selects some files, in which case only the pieces overlapping
+// a selected file. Needed pieces that also overlap an unselected file are
+// marked partial, since only part of their data ends up on disk.
+func (d *Downloader) selectPieces() error {
+	d.wanted = make(peer.BitField, len(d.done))
+	d.partial = make(peer.BitField, len(d.done))
+
+	files := d.torrent.Info.GetFiles()
+	if d.config.Files == nil {
+		d.selected = nil
+	} else {
+		d.selected = make(map[int]bool, len(d.config.Files))
+		for _, index := range d.config.Files {
+			if index < 0 || index >= len(files) {
+				return fmt.Errorf("invalid file selection: index %d out of range [0, %d)", index, len(files))
+			}
+			d.selected[index] = true
+		}
+	}
+
+	pieceLength := int64(d.torrent.Info.PieceLength)
+	var fileStart int64
+	for i, f := range files {
+		fileEnd := fileStart + int64(f.Length)
+		if f.Length > 0 {
+			first, last := int(fileStart/pieceLength), int((fileEnd-1)/pieceLength)
+			for index := first; index <= last; index++ {
+				if d.fileSelected(i) {
+					d.wanted.SetPiece(index)
+				} else {
+					d.partial.SetPiece(index)
+				}
+			}
+		}
+		fileStart = fileEnd
+	}
+
+	for j := range d.partial {
+		d.partial[j] &= d.wanted[j]
+	}
+	d.numWanted = 0
+	for index := range d.numPieces {
+		if d.wanted.HasPiece(index) {
+			d.numWanted++
+		}
+	}
+	d.remaining = d.numWanted
+	return nil
+}
+
+// fileSelected reports whether the file at index is part of the download
+func (d *Downloader) fileSelected(index int) bool {
+	return d.selected == nil || d.selected[index]
+}
+
+// skipped returns the pieces the picker shouldn't hand out: those already
+// verified and those no selected file needs
+func (d *Downloader) skipped() peer.BitField {
+	skip := append(peer.BitField(nil), d.done...)
+	for index := range d.numPieces {
+		if !d.wanted.HasPiece(index) {
+			skip.SetPiece(index)
+		}
+	}
+	return skip
+}
@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// sharedPiece holds the blocks of an in-flight piece that several workers
+// download together when Config.SharePieces is set. Each block is claimed by
+// one worker at a time; whoever fills the last one assembles the piece.
+type sharedPiece struct {
+	requests []peer.BlockRequest
+	blocks   [][]byte
+	claimed  []bool
+	missing  int  // blocks not yet received
+	workers  int  // workers currently on the piece
+	solo     bool // closed to new workers after failing its hash check
+}
+
+func newSharedPiece(work *PieceWork, blockSize uint32) *sharedPiece {
+	requests := peer.BlockRequests(uint32(work.Index), work.Length, blockSize)
+	return &sharedPiece{
+		requests: requests,
+		blocks:   make([][]byte, len(requests)),
+		claimed:  make([]bool, len(requests)),
+		missing:  len(requests),
+		workers:  1,
+	}
+}
+
+// unclaimed reports whether any block is still free to claim
+func (sp *sharedPiece) unclaimed() bool {
+	for i := range sp.requests {
+		if !sp.claimed[i] && sp.blocks[i] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// enableSharing makes every piece handed out by next joinable by other
+// workers, in blocks of blockSize (BlockSize from the internal package if 0)
+func (pp *piecePicker) enableSharing(blockSize uint32) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if blockSize == 0 {
+		blockSize = internal.BlockSize
+	}
+	pp.shares = make(map[int]*sharedPiece)
+	pp.blockSize = blockSize
+}
+
+// join claims a place on an in-flight piece that bf has and that still has
+// unclaimed blocks, for a worker with no pending piece of its own. It returns
+// nil if there is none.
+func (pp *piecePicker) join(bf peer.BitField, skip func(int) bool) *PieceWork {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, i := range pp.order {
+		sp := pp.shares[i]
+		if sp == nil || sp.solo || !bf.HasPiece(i) || (skip != nil && skip(i)) || !sp.unclaimed() {
+			continue
+		}
+		sp.workers++
+		return pp.work[i]
+	}
+	return nil
+}
+
+// claimBlocks hands out up to max unclaimed blocks of the shared piece at
+// index, or none once every block is claimed or received
+func (pp *piecePicker) claimBlocks(index, max int) []peer.BlockRequest {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	sp := pp.shares[index]
+	if sp == nil {
+		return nil
+	}
+	var reqs []peer.BlockRequest
+	for i, req := range sp.requests {
+		if len(reqs) == max {
+			break
+		}
+		if !sp.claimed[i] && sp.blocks[i] == nil {
+			sp.claimed[i] = true
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// releaseBlocks frees claimed blocks that weren't received so another worker
+// on the piece can fetch them
+func (pp *piecePicker) releaseBlocks(index int, reqs []peer.BlockRequest) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	sp := pp.shares[index]
+	if sp == nil {
+		return
+	}
+	for _, req := range reqs {
+		sp.claimed[pp.blockIndex(req)] = false
+	}
+	pp.notify()
+}
+
+// fillBlocks stores received blocks in the shared piece at index. The call
+// that fills the last block gets the assembled piece back, for verifying.
+func (pp *piecePicker) fillBlocks(index int, reqs []peer.BlockRequest, blocks [][]byte) []byte {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	sp := pp.shares[index]
+	if sp == nil {
+		return nil
+	}
+	filled := false
+	for i, req := range reqs {
+		b := pp.blockIndex(req)
+		sp.claimed[b] = false
+		if sp.blocks[b] == nil {
+			sp.blocks[b] = blocks[i]
+			sp.missing--
+			filled = true
+		}
+	}
+	if !filled || sp.missing > 0 {
+		return nil
+	}
+	piece := make([]byte, 0, pp.work[index].Length)
+	for _, block := range sp.blocks {
+		piece = append(piece, block...)
+	}
+	return piece
+}
+
+// resetBlocks discards the shared piece's blocks after it failed its hash
+// check. There is no telling which peer sent bad data, so no new workers may
+// join it: the next attempt comes from as few peers as possible.
+func (pp *piecePicker) resetBlocks(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	sp := pp.shares[index]
+	if sp == nil {
+		return
+	}
+	clear(sp.blocks)
+	clear(sp.claimed)
+	sp.missing = len(sp.blocks)
+	sp.solo = true
+	pp.notify()
+}
+
+// leave takes a worker off the shared piece at index. Once the last one
+// leaves an unfinished piece, it goes back to pending.
+func (pp *piecePicker) leave(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	sp := pp.shares[index]
+	if sp == nil {
+		return
+	}
+	sp.workers--
+	if sp.workers == 0 && pp.state[index] == pieceInFlight {
+		delete(pp.shares, index)
+		pp.state[index] = piecePending
+		pp.notify()
+	}
+}
+
+// blockIndex returns the position of req among its piece's blocks
+func (pp *piecePicker) blockIndex(req peer.BlockRequest) int {
+	return int(req.Begin / pp.blockSize)
+}
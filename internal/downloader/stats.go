@@ -0,0 +1,50 @@
+package downloader
+
+import "sort"
+
+// PeerStats summarizes what a worker got out of one peer over a download
+type PeerStats struct {
+	Addr       string
+	Attempted  int   // pieces claimed from the picker
+	Downloaded int   // pieces verified and handed back
+	Failed     int   // pieces the peer couldn't deliver
+	Bytes      int64 // verified piece bytes received
+}
+
+// FailureRate is the fraction of attempted pieces that failed
+func (s PeerStats) FailureRate() float64 {
+	if s.Attempted == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Attempted)
+}
+
+// collectStats aggregates the stats workers send as they exit, until the
+// pool closes the stats channel
+func (d *Downloader) collectStats(done chan<- struct{}) {
+	defer close(done)
+	for s := range d.stats {
+		d.mu.Lock()
+		total := d.peerStats[s.Addr]
+		total.Addr = s.Addr
+		total.Attempted += s.Attempted
+		total.Downloaded += s.Downloaded
+		total.Failed += s.Failed
+		total.Bytes += s.Bytes
+		d.peerStats[s.Addr] = total
+		d.mu.Unlock()
+	}
+}
+
+// Stats returns per-peer statistics for every peer a worker ran against,
+// sorted by address. Once Download returns it covers every worker.
+func (d *Downloader) Stats() []PeerStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := make([]PeerStats, 0, len(d.peerStats))
+	for _, s := range d.peerStats {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
@@ -0,0 +1,257 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// webSeed downloads whole pieces from a BEP 19 web seed: an HTTP server with
+// a copy of the torrent's files, read by byte range. It claims pieces from
+// the same picker as the peer workers and hands them to the same results.
+type webSeed struct {
+	url     string
+	torrent *metainfo.TorrentFile
+	config  Config
+	client  *http.Client
+	limiter *rateLimiter
+
+	attempted    int
+	downloaded   int
+	failed       int
+	bytes        int64
+	failStreak   int
+	failedPieces map[int]bool // pieces the seed couldn't deliver
+}
+
+// fileRange is the part of one file a piece covers
+type fileRange struct {
+	url    string
+	offset int64
+	length int64
+}
+
+// runWebSeed downloads from the web seed at rawURL until every piece is done,
+// it fails or ctx is done
+func (d *Downloader) runWebSeed(ctx context.Context, rawURL string) {
+	ws := &webSeed{
+		url:          rawURL,
+		torrent:      d.torrent,
+		config:       d.config,
+		client:       http.DefaultClient,
+		limiter:      d.limiter,
+		failedPieces: make(map[int]bool),
+	}
+	err := ws.run(ctx, d.picker, d.results, d.errors)
+	d.stats <- ws.Stats()
+	if err == nil {
+		return
+	}
+	workerErr, ok := err.(*WorkerError)
+	if !ok {
+		workerErr = &WorkerError{
+			PeerAddr: ws.url,
+			Phase:    "web seed",
+			Err:      err,
+		}
+	}
+	ws.report(ctx, d.errors, workerErr)
+}
+
+// Stats reports what the web seed has delivered so far, under its URL
+func (ws *webSeed) Stats() PeerStats {
+	return PeerStats{
+		Addr:       ws.url,
+		Attempted:  ws.attempted,
+		Downloaded: ws.downloaded,
+		Failed:     ws.failed,
+		Bytes:      ws.bytes,
+	}
+}
+
+// run claims pieces from the picker until every piece is done. A web seed
+// has every piece, so it only waits while the rest are in flight elsewhere.
+func (ws *webSeed) run(ctx context.Context, picker *piecePicker,
+	results chan<- *PieceResult, errors chan<- *WorkerError) error {
+	numPieces := ws.torrent.Info.NumPieces()
+	all := peer.NewBitField(numPieces)
+	for i := range numPieces {
+		all.SetPiece(i)
+	}
+
+	for {
+		skip := func(i int) bool { return ws.failedPieces[i] }
+		work, wait, finished := picker.next(all, skip)
+		if finished {
+			return nil
+		}
+		if work == nil {
+			if err := waitForWork(ctx, picker, all, wait, ws.failedPieces); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ws.attempted++
+		piece, err := ws.fetchPiece(ctx, work)
+		if err != nil {
+			picker.requeue(work.Index)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			ws.failed++
+			ws.failStreak++
+			ws.failedPieces[work.Index] = true
+
+			// A seed that doesn't have the files won't get them by asking
+			// again; one that keeps failing is dropped like a peer would be
+			downloadErr := &WorkerError{
+				PeerAddr: ws.url,
+				Phase:    "web seed",
+				Err:      fmt.Errorf("piece %d: %w", work.Index, err),
+			}
+			if statusErr, ok := asWebSeedStatus(err); ok && statusErr.permanent() {
+				return downloadErr
+			}
+			if ws.config.MaxPeerFailures > 0 && ws.failStreak >= ws.config.MaxPeerFailures {
+				downloadErr.Err = fmt.Errorf("dropping web seed after %d failed pieces in a row: %w",
+					ws.failStreak, downloadErr.Err)
+				return downloadErr
+			}
+			ws.report(ctx, errors, downloadErr)
+			continue
+		}
+
+		picker.complete(work.Index)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case results <- &PieceResult{
+			Index:   work.Index,
+			Payload: piece,
+		}:
+			ws.downloaded++
+			ws.bytes += int64(len(piece))
+			ws.failStreak = 0
+		}
+	}
+}
+
+// report sends a non-fatal error to the downloader without blocking past cancellation
+func (ws *webSeed) report(ctx context.Context, errors chan<- *WorkerError, err *WorkerError) {
+	select {
+	case errors <- err:
+	case <-ctx.Done():
+	}
+}
+
+// fetchPiece downloads and verifies a piece, one range request per file it
+// spans, bounded by PieceTimeout
+func (ws *webSeed) fetchPiece(ctx context.Context, work *PieceWork) ([]byte, error) {
+	if ws.config.PieceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ws.config.PieceTimeout)
+		defer cancel()
+	}
+
+	offset := int64(work.Index) * int64(ws.torrent.Info.PieceLength)
+	piece := make([]byte, 0, work.Length)
+	for _, r := range ws.ranges(offset, int64(work.Length)) {
+		if ws.limiter != nil {
+			if err := ws.limiter.WaitN(ctx, int(r.length)); err != nil {
+				return nil, err
+			}
+		}
+		data, err := ws.fetchRange(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		piece = append(piece, data...)
+	}
+
+	if !bytes.Equal(metainfo.HashPiece(piece), work.Hash) {
+		return nil, fmt.Errorf("invalid piece hash for piece %d", work.Index)
+	}
+	return piece, nil
+}
+
+// fetchRange reads one file range from the seed. Servers that ignore the
+// Range header are only usable for ranges at the start of a file.
+func (ws *webSeed) fetchRange(ctx context.Context, r fileRange) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web seed URL: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.length-1))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent &&
+		(resp.StatusCode != http.StatusOK || r.offset != 0) {
+		return nil, &WebSeedStatusError{URL: r.url, StatusCode: resp.StatusCode}
+	}
+
+	data := make([]byte, r.length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("error reading from web seed: %w", err)
+	}
+	return data, nil
+}
+
+// ranges maps length bytes of the torrent's data, starting at offset, onto
+// the files that hold them
+func (ws *webSeed) ranges(offset, length int64) []fileRange {
+	var ranges []fileRange
+	var fileStart int64
+	for _, f := range ws.torrent.Info.GetFiles() {
+		fileEnd := fileStart + int64(f.Length)
+		if f.Length > 0 && fileEnd > offset && fileStart < offset+length {
+			start := max(offset, fileStart)
+			end := min(offset+length, fileEnd)
+			ranges = append(ranges, fileRange{
+				url:    ws.fileURL(f),
+				offset: start - fileStart,
+				length: end - start,
+			})
+		}
+		fileStart = fileEnd
+	}
+	return ranges
+}
+
+// fileURL returns where the seed serves f. A single-file torrent's URL names
+// the file itself unless it ends in a slash; a multi-file torrent's is the
+// directory holding the torrent's top-level directory.
+func (ws *webSeed) fileURL(f metainfo.FileInfo) string {
+	info := ws.torrent.Info
+	if info.IsSingleFile() {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(info.Name)
+		}
+		return ws.url
+	}
+
+	base := strings.TrimSuffix(ws.url, "/") + "/" + url.PathEscape(info.Name)
+	for _, component := range f.Path {
+		base += "/" + url.PathEscape(component)
+	}
+	return base
+}
+
+// asWebSeedStatus finds a WebSeedStatusError in err's chain
+func asWebSeedStatus(err error) (*WebSeedStatusError, bool) {
+	var statusErr *WebSeedStatusError
+	ok := errors.As(err, &statusErr)
+	return statusErr, ok
+}
@@ -2,8 +2,12 @@
 package downloader
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal"
@@ -11,41 +15,110 @@ import (
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
 )
 
+// PeerClient is the connection to a peer that a Worker downloads through.
+// *peer.Peer is the real implementation; anything else lets the worker loop
+// run against scripted pieces and errors.
+type PeerClient interface {
+	Addr() netip.AddrPort
+	Connect() error
+	Close() error
+	Handshake(infoHash [20]byte, ext bool) (*peer.Handshake, error)
+	SendExtensionHandshake(metadataSize int, pex bool) error
+	WriteMessage(messageID byte, payload []byte) error
+	AwaitUnchoke() error
+	IsChoked() bool
+	Pieces() peer.BitField
+	GetPiece(ctx context.Context, pieceHash []byte, pieceLength, pieceIndex uint32) ([]byte, error)
+	GetBlocks(ctx context.Context, requests []peer.BlockRequest) ([][]byte, error)
+	IdleFor() time.Duration
+	SendKeepAlive() error
+	SupportsPex() bool
+	SendPex(added, dropped []netip.AddrPort) error
+}
+
 // Worker handles downloading pieces from a single peer
 type Worker struct {
-	peer    *peer.Peer
+	peer    PeerClient
 	torrent *metainfo.TorrentFile
 	config  Config
 
 	attempted  int
 	downloaded int
 	failed     int
+	bytes      int64
+	failStreak int // pieces failed since the last one delivered
+
+	known        peer.BitField // peer's pieces as last reported to the picker
+	failedPieces map[int]bool  // pieces this peer couldn't deliver
+
+	// PEX, when enabled: the peers we're connected to and what we've told
+	// this one about them so far
+	swarm   *swarm
+	pexSent map[netip.AddrPort]bool
+	lastPex time.Time
+
+	// dialing, if set, is shared by all workers to limit dials in progress
+	dialing chan struct{}
 }
 
-// NewWorker creates a new worker for a peer
-func NewWorker(p *peer.Peer, t *metainfo.TorrentFile, cfg Config) *Worker {
+// NewWorker creates a new worker for a peer. A *peer.Peer should already
+// carry the timeouts and limits from cfg; see Downloader.configurePeer.
+func NewWorker(p PeerClient, t *metainfo.TorrentFile, cfg Config) *Worker {
 	return &Worker{
-		peer:    p,
-		torrent: t,
-		config:  cfg,
+		peer:         p,
+		torrent:      t,
+		config:       cfg,
+		failedPieces: make(map[int]bool),
+		pexSent:      make(map[netip.AddrPort]bool),
 	}
 }
 
 // Run executes the worker's download loop
-func (w *Worker) Run(ctx context.Context, workQueue <-chan *PieceWork, results chan<- *PieceResult, errors chan<- *WorkerError) error {
+func (w *Worker) Run(ctx context.Context, picker *piecePicker, results chan<- *PieceResult, errors chan<- *WorkerError) error {
 	// Connect to peer
 	if err := w.connect(ctx); err != nil {
 		return err
 	}
-	defer w.peer.Conn.Close()
+	defer w.peer.Close()
+
+	// Unblock whatever read or write is in progress once we're cancelled
+	stop := context.AfterFunc(ctx, func() { w.peer.Close() })
+	defer stop()
+
+	// Keep the connection alive while we wait on the peer or the queue
+	keepAliveCtx, stopKeepAlive := context.WithCancel(ctx)
+	defer stopKeepAlive()
+	go w.keepAlive(keepAliveCtx)
 
 	// Setup connection
 	if err := w.setup(); err != nil {
 		return err
 	}
 
+	// Share this peer over PEX for as long as we're connected
+	if w.swarm != nil {
+		w.swarm.join(w.peer.Addr())
+		defer w.swarm.leave(w.peer.Addr())
+	}
+
+	// Advertise this peer's pieces to the picker for as long as we're connected
+	w.known = append(peer.BitField(nil), w.peer.Pieces()...)
+	picker.addPeer(w.known)
+	defer func() { picker.removePeer(w.known) }()
+
 	// Download pieces
-	return w.downloadLoop(ctx, workQueue, results, errors)
+	return w.downloadLoop(ctx, picker, results, errors)
+}
+
+// Stats reports what the worker has got out of its peer so far
+func (w *Worker) Stats() PeerStats {
+	return PeerStats{
+		Addr:       w.peer.Addr().String(),
+		Attempted:  w.attempted,
+		Downloaded: w.downloaded,
+		Failed:     w.failed,
+		Bytes:      w.bytes,
+	}
 }
 
 // connect establishes connection to the peer
@@ -57,9 +130,18 @@ func (w *Worker) connect(ctx context.Context) error {
 	default:
 	}
 
+	if w.dialing != nil {
+		select {
+		case w.dialing <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-w.dialing }()
+	}
+
 	if err := w.peer.Connect(); err != nil {
 		return &WorkerError{
-			PeerAddr: w.peer.AddrPort.String(),
+			PeerAddr: w.peer.Addr().String(),
 			Phase:    "connection",
 			Err:      err,
 		}
@@ -68,104 +150,255 @@ func (w *Worker) connect(ctx context.Context) error {
 	return nil
 }
 
+// keepAlive sends a keep-alive whenever we've been silent for KeepAliveInterval,
+// so the peer doesn't drop us while a piece or the work queue stalls
+func (w *Worker) keepAlive(ctx context.Context) {
+	const interval = internal.KeepAliveInterval * time.Second
+	ticker := time.NewTicker(interval / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.peer.IdleFor() < interval {
+				continue
+			}
+			if err := w.peer.SendKeepAlive(); err != nil {
+				return
+			}
+		}
+	}
+}
+
 // setup performs handshake and initial protocol exchange
 func (w *Worker) setup() error {
-	// Handshake
-	_, err := w.peer.Handshake(w.torrent.Info.InfoHash, false)
+	// Handshake, offering the extension protocol if we want PEX
+	h, err := w.peer.Handshake(w.torrent.Info.InfoHash, w.swarm != nil)
 	if err != nil {
 		return &WorkerError{
-			PeerAddr: w.peer.AddrPort.String(),
+			PeerAddr: w.peer.Addr().String(),
 			Phase:    "handshake",
 			Err:      err,
 		}
 	}
 
-	// Read bitfield
-	_, err = w.peer.ReadBitfield()
-	if err != nil {
-		return &WorkerError{
-			PeerAddr: w.peer.AddrPort.String(),
-			Phase:    "bitfield",
-			Err:      err,
+	// Extension handshake, so the peer knows it can send us PEX updates
+	if w.swarm != nil && h.Reserved[internal.ExtensionBitPosition]&internal.ExtensionID != 0 {
+		if err = w.peer.SendExtensionHandshake(0, true); err != nil {
+			return &WorkerError{
+				PeerAddr: w.peer.Addr().String(),
+				Phase:    "extension handshake",
+				Err:      err,
+			}
 		}
 	}
 
 	// Send interested
-	msg, err := w.peer.SendInterested()
-	if err != nil {
+	if err = w.peer.WriteMessage(internal.MessageInterested, nil); err != nil {
 		return &WorkerError{
-			PeerAddr: w.peer.AddrPort.String(),
+			PeerAddr: w.peer.Addr().String(),
 			Phase:    "interested",
 			Err:      err,
 		}
 	}
 
-	// Wait for unchoke
-	if msg.ID != internal.MessageUnchoke {
+	// Wait for unchoke. The bitfield and any have messages arrive meanwhile,
+	// in whatever order the peer sends them.
+	if err = w.peer.AwaitUnchoke(); err != nil {
 		return &WorkerError{
-			PeerAddr: w.peer.AddrPort.String(),
+			PeerAddr: w.peer.Addr().String(),
 			Phase:    "unchoke",
-			Err:      fmt.Errorf("expected unchoke (1), got %d", msg.ID),
+			Err:      err,
 		}
 	}
 
 	return nil
 }
 
-// downloadLoop processes work items from the queue
-func (w *Worker) downloadLoop(ctx context.Context, workQueue <-chan *PieceWork,
+// waitForWork blocks until the picker's state changes or ctx is done. When the
+// only pending pieces bf has are ones in failed, nobody else may ever take
+// them, so failed is cleared after FailedPieceRetryDelay to try them again.
+func waitForWork(ctx context.Context, picker *piecePicker, bf peer.BitField,
+	wait <-chan struct{}, failed map[int]bool) error {
+	var retry <-chan time.Time
+	if len(failed) > 0 && picker.pending(bf) {
+		timer := time.NewTimer(internal.FailedPieceRetryDelay * time.Millisecond)
+		defer timer.Stop()
+		retry = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wait:
+	case <-retry:
+		clear(failed)
+	}
+	return nil
+}
+
+// downloadLoop claims pieces from the picker until every piece is done
+func (w *Worker) downloadLoop(ctx context.Context, picker *piecePicker,
 	results chan<- *PieceResult, errors chan<- *WorkerError) error {
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-
-		case work, ok := <-workQueue:
-			if !ok {
-				// Queue closed, we're done
-				if w.config.Verbose {
-					fmt.Printf("Worker %s: attempted=%d, downloaded=%d, failed=%d\n",
-						w.peer.AddrPort.String(), w.attempted, w.downloaded, w.failed)
-				}
-				return nil
+		if err := w.sharePeers(); err != nil {
+			return &WorkerError{
+				PeerAddr: w.peer.Addr().String(),
+				Phase:    "pex",
+				Err:      err,
 			}
+		}
 
-			w.attempted++
-
-			// Check if peer has this piece
-			if !w.peer.Bitfield.HasPiece(work.Index) {
-				continue // Skip pieces this peer doesn't have
+		skip := func(i int) bool { return w.failedPieces[i] }
+		work, wait, finished := picker.next(w.peer.Pieces(), skip)
+		if finished {
+			if w.config.Verbose {
+				fmt.Printf("Worker %s: attempted=%d, downloaded=%d, failed=%d\n",
+					w.peer.Addr().String(), w.attempted, w.downloaded, w.failed)
 			}
+			return nil
+		}
 
-			// Download the piece with retries
-			piece, err := w.downloadPieceWithRetry(ctx, work)
-			if err != nil {
-				w.failed++
-				errors <- &WorkerError{
-					PeerAddr: w.peer.AddrPort.String(),
-					Phase:    "download",
-					Err:      fmt.Errorf("piece %d: %w", work.Index, err),
-				}
-				continue
+		// Nothing this peer can serve right now: help with a piece someone else
+		// is downloading if sharing, or wait for a piece to be requeued
+		if work == nil && w.config.SharePieces {
+			work = picker.join(w.peer.Pieces(), skip)
+		}
+		if work == nil {
+			if err := waitForWork(ctx, picker, w.peer.Pieces(), wait, w.failedPieces); err != nil {
+				return err
 			}
+			continue
+		}
 
-			// Send result
-			select {
-			case <-ctx.Done():
+		w.attempted++
+
+		// Download the piece with retries
+		fetch := w.fetchPiece
+		if w.config.SharePieces {
+			fetch = func(ctx context.Context, work *PieceWork) ([]byte, error) {
+				return w.fetchShared(ctx, picker, work)
+			}
+		}
+		piece, err := w.downloadPieceWithRetry(ctx, work, fetch)
+		w.syncAvailability(picker)
+		if err != nil {
+			if w.config.SharePieces {
+				picker.leave(work.Index)
+			} else {
+				picker.requeue(work.Index)
+			}
+			if ctx.Err() != nil {
 				return ctx.Err()
-			case results <- &PieceResult{
-				Index:   work.Index,
-				Payload: piece,
-			}:
-				w.downloaded++
 			}
+			w.failed++
+			w.failStreak++
+			w.failedPieces[work.Index] = true
+
+			// A silent or departed peer is dropped, as is one that keeps
+			// failing; its piece goes to someone else
+			downloadErr := &WorkerError{
+				PeerAddr: w.peer.Addr().String(),
+				Phase:    "download",
+				Err:      fmt.Errorf("piece %d: %w", work.Index, err),
+			}
+			if isTimeout(err) || isDisconnected(err) {
+				return downloadErr
+			}
+			if w.config.MaxPeerFailures > 0 && w.failStreak >= w.config.MaxPeerFailures {
+				downloadErr.Err = fmt.Errorf("dropping peer after %d failed pieces in a row: %w",
+					w.failStreak, downloadErr.Err)
+				return downloadErr
+			}
+			w.report(ctx, errors, downloadErr)
+			continue
+		}
+
+		// The other workers on a shared piece hold its remaining blocks
+		if piece == nil {
+			picker.leave(work.Index)
+			continue
+		}
+
+		// Send result
+		picker.complete(work.Index)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case results <- &PieceResult{
+			Index:   work.Index,
+			Payload: piece,
+		}:
+			w.downloaded++
+			w.bytes += int64(len(piece))
+			w.failStreak = 0
+		}
+	}
+}
+
+// syncAvailability reports pieces the peer announced via have messages since
+// the last sync, so the picker's rarity counts stay current
+func (w *Worker) syncAvailability(picker *piecePicker) {
+	for i := range len(w.peer.Pieces()) * 8 {
+		if w.peer.Pieces().HasPiece(i) && !w.known.HasPiece(i) {
+			picker.have(i)
 		}
 	}
+	w.known = append(w.known[:0], w.peer.Pieces()...)
+}
+
+// report sends a non-fatal error to the downloader without blocking past cancellation
+func (w *Worker) report(ctx context.Context, errors chan<- *WorkerError, err *WorkerError) {
+	select {
+	case errors <- err:
+	case <-ctx.Done():
+	}
 }
 
-// downloadPieceWithRetry attempts to download a piece with retries
-func (w *Worker) downloadPieceWithRetry(ctx context.Context, work *PieceWork) ([]byte, error) {
+// fetchPiece downloads and verifies a whole piece from the peer
+func (w *Worker) fetchPiece(ctx context.Context, work *PieceWork) ([]byte, error) {
+	return w.peer.GetPiece(ctx, work.Hash, work.Length, uint32(work.Index))
+}
+
+// fetchShared downloads blocks of a shared piece until none are left to
+// claim. It returns the verified piece if this worker received the last
+// block, or nil if other workers still hold the remaining ones.
+func (w *Worker) fetchShared(ctx context.Context, picker *piecePicker, work *PieceWork) ([]byte, error) {
+	depth := w.config.PipelineDepth
+	if depth <= 0 {
+		depth = internal.MaxPipelineRequests
+	}
+	for {
+		reqs := picker.claimBlocks(work.Index, depth)
+		if len(reqs) == 0 {
+			return nil, nil
+		}
+		blocks, err := w.peer.GetBlocks(ctx, reqs)
+		if err != nil {
+			picker.releaseBlocks(work.Index, reqs)
+			return nil, err
+		}
+		piece := picker.fillBlocks(work.Index, reqs, blocks)
+		if piece == nil {
+			continue
+		}
+		if !bytes.Equal(metainfo.HashPiece(piece), work.Hash) {
+			picker.resetBlocks(work.Index)
+			return nil, fmt.Errorf("invalid piece hash for piece %d", work.Index)
+		}
+		return piece, nil
+	}
+}
+
+// downloadPieceWithRetry attempts to download a piece with fetch, retrying.
+// Being choked mid-piece doesn't use up an attempt, but a peer that keeps
+// choking us fails the piece after MaxPieceChokes from the internal package.
+func (w *Worker) downloadPieceWithRetry(ctx context.Context, work *PieceWork,
+	fetch func(context.Context, *PieceWork) ([]byte, error)) ([]byte, error) {
 	var lastErr error
+	chokes := 0
 
 	for attempt := 0; attempt < w.config.MaxRetries; attempt++ {
 		// Check context
@@ -175,12 +408,37 @@ func (w *Worker) downloadPieceWithRetry(ctx context.Context, work *PieceWork) ([
 		default:
 		}
 
+		// Pause while choked; requests sent now would be discarded
+		if w.peer.IsChoked() {
+			if err := w.awaitUnchoke(); err != nil {
+				return nil, err
+			}
+		}
+
 		// Attempt download
-		piece, err := w.peer.GetPiece(work.Hash, work.Length, uint32(work.Index))
+		piece, err := w.fetchWithTimeout(ctx, work, fetch)
 		if err == nil {
 			return piece, nil // Success!
 		}
 
+		// Being choked mid-piece isn't the piece's fault: wait and try again,
+		// up to a point
+		if errors.Is(err, peer.ErrChoked) {
+			chokes++
+			if chokes >= internal.MaxPieceChokes {
+				return nil, fmt.Errorf("choked %d times: %w", chokes, err)
+			}
+			attempt--
+			continue
+		}
+
+		// Retrying a peer that has gone silent would only wait out the timeout
+		// again, one that hung up can't answer, and one that rejected the
+		// request won't serve it either
+		if isTimeout(err) || isDisconnected(err) || errors.Is(err, peer.ErrRejected) {
+			return nil, err
+		}
+
 		lastErr = err
 
 		// Backoff before retry
@@ -188,7 +446,7 @@ func (w *Worker) downloadPieceWithRetry(ctx context.Context, work *PieceWork) ([
 			backoff := time.Duration(attempt+1) * 100 * time.Millisecond
 			if w.config.Verbose {
 				fmt.Printf("Worker %s: retry %d/%d for piece %d after %v: %v\n",
-					w.peer.AddrPort.String(), attempt+1, w.config.MaxRetries,
+					w.peer.Addr().String(), attempt+1, w.config.MaxRetries,
 					work.Index, backoff, err)
 			}
 
@@ -203,3 +461,48 @@ func (w *Worker) downloadPieceWithRetry(ctx context.Context, work *PieceWork) ([
 
 	return nil, fmt.Errorf("failed after %d retries: %w", w.config.MaxRetries, lastErr)
 }
+
+// fetchWithTimeout makes one attempt at a piece, bounded by PieceTimeout
+func (w *Worker) fetchWithTimeout(ctx context.Context, work *PieceWork,
+	fetch func(context.Context, *PieceWork) ([]byte, error)) ([]byte, error) {
+	if w.config.PieceTimeout <= 0 {
+		return fetch(ctx, work)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, w.config.PieceTimeout)
+	defer cancel()
+	piece, err := fetch(attemptCtx, work)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() != nil {
+		return nil, fmt.Errorf("%w after %v", ErrPieceTimeout, w.config.PieceTimeout)
+	}
+	return piece, err
+}
+
+// isTimeout reports whether err is a peer read that hit its deadline, or a
+// piece attempt that ran past PieceTimeout
+func isTimeout(err error) bool {
+	if errors.Is(err, ErrPieceTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isDisconnected reports whether err is the peer closing the connection
+func isDisconnected(err error) bool {
+	return errors.Is(err, peer.ErrPeerDisconnected)
+}
+
+// awaitUnchoke blocks until the peer unchokes us again
+func (w *Worker) awaitUnchoke() error {
+	if w.config.Verbose {
+		fmt.Printf("Worker %s: choked, waiting for unchoke\n", w.peer.Addr().String())
+	}
+	if err := w.peer.AwaitUnchoke(); err != nil {
+		return &WorkerError{
+			PeerAddr: w.peer.Addr().String(),
+			Phase:    "unchoke",
+			Err:      err,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// fakePeer is a PeerClient that serves pieces from data, or the errors
+// scripted in failures, without a connection
+type fakePeer struct {
+	data        []byte // the torrent's content as this peer has it
+	pieceLength int
+	pieces      peer.BitField
+
+	mu       sync.Mutex
+	failures []error // returned by the next GetPiece calls, in order
+	choked   bool
+	requests []uint32 // piece indexes asked of GetPiece
+	unchokes int      // calls to AwaitUnchoke
+}
+
+func (f *fakePeer) Addr() netip.AddrPort { return netip.MustParseAddrPort("192.0.2.1:6881") }
+func (f *fakePeer) Connect() error       { return nil }
+func (f *fakePeer) Close() error         { return nil }
+
+func (f *fakePeer) Handshake(infoHash [20]byte, ext bool) (*peer.Handshake, error) {
+	return &peer.Handshake{InfoHash: infoHash}, nil
+}
+
+func (f *fakePeer) SendExtensionHandshake(metadataSize int, pex bool) error { return nil }
+func (f *fakePeer) WriteMessage(messageID byte, payload []byte) error       { return nil }
+
+func (f *fakePeer) AwaitUnchoke() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unchokes++
+	f.choked = false
+	return nil
+}
+
+func (f *fakePeer) IsChoked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.choked
+}
+
+func (f *fakePeer) Pieces() peer.BitField { return f.pieces }
+
+// GetPiece returns the next scripted failure, if any, and otherwise the
+// piece from data, verified against pieceHash as *peer.Peer does. A
+// peer.ErrChoked failure leaves the peer choking us.
+func (f *fakePeer) GetPiece(ctx context.Context, pieceHash []byte, pieceLength, pieceIndex uint32) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, pieceIndex)
+
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		if errors.Is(err, peer.ErrChoked) {
+			f.choked = true
+		}
+		return nil, err
+	}
+
+	begin := int(pieceIndex) * f.pieceLength
+	piece := f.data[begin : begin+int(pieceLength)]
+	if !bytes.Equal(metainfo.HashPiece(piece), pieceHash) {
+		return nil, fmt.Errorf("invalid piece hash for piece %d", pieceIndex)
+	}
+	return piece, nil
+}
+
+func (f *fakePeer) GetBlocks(ctx context.Context, requests []peer.BlockRequest) ([][]byte, error) {
+	return nil, errors.New("fakePeer does not serve blocks")
+}
+
+func (f *fakePeer) IdleFor() time.Duration                        { return 0 }
+func (f *fakePeer) SendKeepAlive() error                          { return nil }
+func (f *fakePeer) SupportsPex() bool                             { return false }
+func (f *fakePeer) SendPex(added, dropped []netip.AddrPort) error { return nil }
+
+// testTorrent returns a single-file torrent of data in pieces of pieceLength
+// bytes, with the work for each piece
+func testTorrent(data []byte, pieceLength int) (*metainfo.TorrentFile, []*PieceWork) {
+	info := &metainfo.Info{Name: "file", Length: len(data), PieceLength: pieceLength}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		info.Pieces = append(info.Pieces, metainfo.HashPiece(data[begin:min(begin+pieceLength, len(data))])...)
+	}
+
+	work := make([]*PieceWork, info.NumPieces())
+	for i := range work {
+		hash, _ := info.PieceHash(i)
+		length, _ := info.PieceLengthAt(i)
+		work[i] = &PieceWork{Index: i, Hash: hash, Length: length}
+	}
+	return &metainfo.TorrentFile{Info: info}, work
+}
+
+// allPieces returns a bitfield holding every one of numPieces pieces
+func allPieces(numPieces int) peer.BitField {
+	bf := peer.NewBitField(numPieces)
+	for i := range numPieces {
+		bf.SetPiece(i)
+	}
+	return bf
+}
+
+func TestDownloadPieceWithRetrySucceeds(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 8)
+	tf, work := testTorrent(data, 32)
+	fp := &fakePeer{data: data, pieceLength: 32, failures: []error{errors.New("bad block")}}
+	w := NewWorker(fp, tf, Config{MaxRetries: 3})
+
+	piece, err := w.downloadPieceWithRetry(context.Background(), work[1], w.fetchPiece)
+	if err != nil {
+		t.Fatalf("downloadPieceWithRetry: %v", err)
+	}
+	if !bytes.Equal(piece, data[32:]) {
+		t.Errorf("got piece %q, want %q", piece, data[32:])
+	}
+	if len(fp.requests) != 2 {
+		t.Errorf("peer was asked %d times, want 2", len(fp.requests))
+	}
+}
+
+func TestDownloadPieceWithRetryGivesUp(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 8)
+	tf, work := testTorrent(data, 32)
+	errBad := errors.New("bad block")
+	fp := &fakePeer{data: data, pieceLength: 32, failures: []error{errBad, errBad, errBad, errBad}}
+	w := NewWorker(fp, tf, Config{MaxRetries: 3})
+
+	_, err := w.downloadPieceWithRetry(context.Background(), work[0], w.fetchPiece)
+	if !errors.Is(err, errBad) {
+		t.Fatalf("got %v, want the last failure", err)
+	}
+	if len(fp.requests) != 3 {
+		t.Errorf("peer was asked %d times, want MaxRetries (3)", len(fp.requests))
+	}
+}
+
+func TestDownloadPieceWithRetryChoke(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 8)
+	tf, work := testTorrent(data, 32)
+	fp := &fakePeer{data: data, pieceLength: 32, failures: []error{peer.ErrChoked, peer.ErrChoked}}
+	// Chokes don't use up attempts, so one is enough
+	w := NewWorker(fp, tf, Config{MaxRetries: 1})
+
+	piece, err := w.downloadPieceWithRetry(context.Background(), work[0], w.fetchPiece)
+	if err != nil {
+		t.Fatalf("downloadPieceWithRetry: %v", err)
+	}
+	if !bytes.Equal(piece, data[:32]) {
+		t.Errorf("got piece %q, want %q", piece, data[:32])
+	}
+	if fp.unchokes != 2 {
+		t.Errorf("waited for %d unchokes, want 2", fp.unchokes)
+	}
+	if fp.choked {
+		t.Error("peer still choking after the piece arrived")
+	}
+}
+
+func TestDownloadPieceWithRetryChokeLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 8)
+	tf, work := testTorrent(data, 32)
+	fp := &fakePeer{data: data, pieceLength: 32}
+	for range internal.MaxPieceChokes + 1 {
+		fp.failures = append(fp.failures, peer.ErrChoked)
+	}
+	w := NewWorker(fp, tf, Config{MaxRetries: 3})
+
+	_, err := w.downloadPieceWithRetry(context.Background(), work[0], w.fetchPiece)
+	if !errors.Is(err, peer.ErrChoked) {
+		t.Fatalf("got %v, want ErrChoked", err)
+	}
+	if len(fp.requests) != internal.MaxPieceChokes {
+		t.Errorf("peer was asked %d times, want MaxPieceChokes (%d)", len(fp.requests), internal.MaxPieceChokes)
+	}
+}
+
+func TestWorkerRequeuesPieceOnHashFailure(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 8)
+	tf, work := testTorrent(data, 32)
+	picker := newPiecePicker(work, nil, Sequential)
+	results := make(chan *PieceResult, len(work))
+	errs := make(chan *WorkerError, len(work))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A peer with corrupt data fails its piece and is dropped
+	corrupt := bytes.Clone(data)
+	corrupt[0] ^= 0xFF
+	bad := &fakePeer{data: corrupt, pieceLength: 32, pieces: allPieces(len(work))}
+	cfg := Config{MaxRetries: 1, MaxPeerFailures: 1}
+	err := NewWorker(bad, tf, cfg).Run(ctx, picker, results, errs)
+	if err == nil {
+		t.Fatal("worker with corrupt data succeeded")
+	}
+	if len(bad.requests) != 1 || bad.requests[0] != 0 {
+		t.Fatalf("bad peer was asked for pieces %v, want [0]", bad.requests)
+	}
+
+	// The piece it failed goes back to the picker for a good peer
+	good := &fakePeer{data: data, pieceLength: 32, pieces: allPieces(len(work))}
+	if err := NewWorker(good, tf, cfg).Run(ctx, picker, results, errs); err != nil {
+		t.Fatalf("worker with good data: %v", err)
+	}
+	close(results)
+	got := map[int]bool{}
+	for r := range results {
+		got[r.Index] = true
+	}
+	if !got[0] || !got[1] {
+		t.Errorf("got pieces %v, want 0 and 1", got)
+	}
+}
+
+func TestWorkerRetriesFailedPieceAlone(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 8)
+	tf, work := testTorrent(data, 32)
+	picker := newPiecePicker(work, nil, Sequential)
+	results := make(chan *PieceResult, len(work))
+	errs := make(chan *WorkerError, len(work))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The only peer fails its first attempt at piece 0, and with nobody else
+	// to take it has to try again itself
+	fp := &fakePeer{data: data, pieceLength: 32, pieces: allPieces(len(work)), failures: []error{errors.New("bad block")}}
+	if err := NewWorker(fp, tf, Config{MaxRetries: 1}).Run(ctx, picker, results, errs); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	close(results)
+	got := map[int]bool{}
+	for r := range results {
+		got[r.Index] = true
+	}
+	if !got[0] || !got[1] {
+		t.Errorf("got pieces %v, want 0 and 1", got)
+	}
+	if want := []uint32{0, 1, 0}; fmt.Sprint(fp.requests) != fmt.Sprint(want) {
+		t.Errorf("peer was asked for pieces %v, want %v", fp.requests, want)
+	}
+}
@@ -0,0 +1,130 @@
+package metainfo
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+)
+
+// AnnounceResult is one tracker's answer to AnnounceAll. Response may be set
+// alongside tracker.ErrNoPeers.
+type AnnounceResult struct {
+	URL      string
+	Response *tracker.TrackerResponse
+	Err      error
+}
+
+// AnnounceAll reports an event to every tracker in the announce-list at once
+// instead of failing over tier by tier. Each tracker gets
+// internal.TrackerAnnounceTimeout to answer, so a slow one can't hold up the
+// rest; those that miss it are reported with a timeout error. Results are in
+// TrackerURLs order.
+func (t TorrentFile) AnnounceAll(event string, uploaded, downloaded, left int,
+	opts ...tracker.RequestOption) []AnnounceResult {
+	urls := t.TrackerURLs()
+
+	type indexed struct {
+		i   int
+		res AnnounceResult
+	}
+	// Buffered so trackers answering after the deadline don't block
+	done := make(chan indexed, len(urls))
+	for i, trackerURL := range urls {
+		go func() {
+			tres, err := t.AnnounceTo(trackerURL, event, uploaded, downloaded, left, opts...)
+			done <- indexed{i, AnnounceResult{URL: trackerURL, Response: tres, Err: err}}
+		}()
+	}
+
+	results := make([]AnnounceResult, len(urls))
+	answered := make([]bool, len(urls))
+	timeout := time.After(internal.TrackerAnnounceTimeout * time.Second)
+collect:
+	for range urls {
+		select {
+		case r := <-done:
+			results[r.i] = r.res
+			answered[r.i] = true
+		case <-timeout:
+			break collect
+		}
+	}
+	for i, trackerURL := range urls {
+		if !answered[i] {
+			results[i] = AnnounceResult{
+				URL: trackerURL,
+				Err: fmt.Errorf("no answer within %ds", internal.TrackerAnnounceTimeout),
+			}
+		}
+	}
+	return results
+}
+
+// Swarm is what the trackers together report about a torrent's swarm
+type Swarm struct {
+	Peers    tracker.Peers
+	Seeders  int // the most seeders any tracker reported; 0 if none did
+	Leechers int // the most leechers any tracker reported; 0 if none did
+}
+
+// GetAllPeers announces to every tracker at once with AnnounceAll and returns
+// the union of the peers they hand out, each address once. It only fails if
+// no tracker returned any peers.
+func (t TorrentFile) GetAllPeers(opts ...tracker.RequestOption) (tracker.Peers, error) {
+	swarm, err := t.GetSwarm(opts...)
+	return swarm.Peers, err
+}
+
+// GetSwarm is GetAllPeers, also returning the swarm's size. Each tracker only
+// sees part of the swarm, so the largest counts reported are kept.
+func (t TorrentFile) GetSwarm(opts ...tracker.RequestOption) (Swarm, error) {
+	results := t.AnnounceAll(tracker.EventStarted, 0, 0, t.Info.Length, opts...)
+	swarm := Swarm{Peers: MergePeers(results)}
+	for _, r := range results {
+		if r.Response != nil {
+			swarm.Seeders = max(swarm.Seeders, r.Response.Seeders)
+			swarm.Leechers = max(swarm.Leechers, r.Response.Leechers)
+		}
+	}
+	if len(swarm.Peers) > 0 {
+		return swarm, nil
+	}
+
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.URL, r.Err))
+		}
+	}
+	if len(errs) == 0 {
+		errs = append(errs, tracker.ErrNoPeers)
+	}
+	return Swarm{}, fmt.Errorf("failed to get peers from trackers: %w", errors.Join(errs...))
+}
+
+// MergePeers de-duplicates the peers from a set of announce results by
+// address, keeping the order they were first seen in. A peer ID from any
+// tracker that listed one is kept.
+func MergePeers(results []AnnounceResult) tracker.Peers {
+	var peers tracker.Peers
+	seen := make(map[netip.AddrPort]int)
+	for _, r := range results {
+		if r.Response == nil {
+			continue
+		}
+		for _, p := range r.Response.Peers {
+			i, ok := seen[p.AddrPort]
+			if !ok {
+				seen[p.AddrPort] = len(peers)
+				peers = append(peers, p)
+			} else if peers[i].ID == [20]byte{} {
+				peers[i].ID = p.ID
+			}
+		}
+	}
+	return peers
+}
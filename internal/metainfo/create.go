@@ -0,0 +1,211 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+)
+
+// Piece length bounds used when choosing a default for a new torrent
+const (
+	minPieceLength   = 1 << 14 // 16KB
+	maxPieceLength   = 1 << 24 // 16MB
+	targetPieceCount = 1500
+)
+
+// DefaultPieceLength picks a power-of-two piece length that splits totalSize
+// into roughly targetPieceCount pieces, between 16KB and 16MB.
+func DefaultPieceLength(totalSize int64) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalSize/int64(pieceLength) > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// CreateTorrent builds a torrent for the file or directory at path, announcing
+// to trackerURL. A directory becomes a multi-file torrent containing every
+// regular file below it. If pieceLength is 0, DefaultPieceLength is used.
+func CreateTorrent(path, trackerURL string, pieceLength int) (*TorrentFile, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	info := &Info{Name: filepath.Base(filepath.Clean(path))}
+	var diskPaths []string
+
+	if stat.IsDir() {
+		info.Files, diskPaths, err = walkFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Files) == 0 {
+			return nil, fmt.Errorf("directory %s contains no files", path)
+		}
+		for _, f := range info.Files {
+			info.Length += f.Length
+		}
+	} else {
+		info.Length = int(stat.Size())
+		diskPaths = []string{path}
+	}
+
+	if info.Length == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	if pieceLength == 0 {
+		pieceLength = DefaultPieceLength(int64(info.Length))
+	}
+	if pieceLength < 0 {
+		return nil, fmt.Errorf("invalid piece length: %d", pieceLength)
+	}
+	info.PieceLength = pieceLength
+
+	info.Pieces, err = hashPieces(diskPaths, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Raw = info.serializeInfo()
+	info.InfoHash = sha1.Sum(info.Raw)
+
+	return &TorrentFile{
+		Announce:     trackerURL,
+		Trackers:     [][]string{{trackerURL}},
+		Info:         info,
+		CreatedBy:    internal.ClientVersion,
+		CreationDate: time.Now(),
+	}, nil
+}
+
+// walkFiles lists the regular files below dir in lexical order, returning
+// their torrent file entries and their paths on disk
+func walkFiles(dir string) ([]FileInfo, []string, error) {
+	var (
+		files     []FileInfo
+		diskPaths []string
+	)
+
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, FileInfo{
+			Length: int(fileInfo.Size()),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		diskPaths = append(diskPaths, p)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error walking %s: %w", dir, err)
+	}
+	return files, diskPaths, nil
+}
+
+// hashPieces reads the files back to back, as if they were one stream, and
+// returns the concatenated SHA1 hashes of each pieceLength-sized piece
+func hashPieces(diskPaths []string, pieceLength int) ([]byte, error) {
+	var (
+		pieces []byte
+		buf    = make([]byte, pieceLength)
+		filled int
+	)
+
+	for _, p := range diskPaths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", p, err)
+		}
+
+		for {
+			n, err := io.ReadFull(f, buf[filled:])
+			filled += n
+			if filled == pieceLength {
+				pieces = append(pieces, HashPiece(buf)...)
+				filled = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("error reading %s: %w", p, err)
+			}
+		}
+		f.Close()
+	}
+
+	// The last piece is whatever is left over
+	if filled > 0 {
+		pieces = append(pieces, HashPiece(buf[:filled])...)
+	}
+	return pieces, nil
+}
+
+// Serialize bencodes the torrent for writing to a .torrent file
+func (t TorrentFile) Serialize() []byte {
+	rawInfo := t.Info.Raw
+	if rawInfo == nil {
+		rawInfo = t.Info.serializeInfo()
+	}
+
+	out := []byte("d")
+	if t.Announce != "" {
+		out = append(out, fmt.Sprintf("8:announce%d:%s", len(t.Announce), t.Announce)...)
+	}
+	if len(t.Trackers) > 1 {
+		out = append(out, "13:announce-listl"...)
+		for _, tier := range t.Trackers {
+			out = append(out, 'l')
+			for _, url := range tier {
+				out = append(out, fmt.Sprintf("%d:%s", len(url), url)...)
+			}
+			out = append(out, 'e')
+		}
+		out = append(out, 'e')
+	}
+	if t.Comment != "" {
+		out = append(out, fmt.Sprintf("7:comment%d:%s", len(t.Comment), t.Comment)...)
+	}
+	if t.CreatedBy != "" {
+		out = append(out, fmt.Sprintf("10:created by%d:%s", len(t.CreatedBy), t.CreatedBy)...)
+	}
+	if !t.CreationDate.IsZero() {
+		out = append(out, fmt.Sprintf("13:creation datei%de", t.CreationDate.Unix())...)
+	}
+	if t.Encoding != "" {
+		out = append(out, fmt.Sprintf("8:encoding%d:%s", len(t.Encoding), t.Encoding)...)
+	}
+	out = append(out, "4:info"...)
+	out = append(out, rawInfo...)
+	if len(t.URLList) > 0 {
+		out = append(out, "8:url-listl"...)
+		for _, url := range t.URLList {
+			out = append(out, fmt.Sprintf("%d:%s", len(url), url)...)
+		}
+		out = append(out, 'e')
+	}
+	out = append(out, 'e')
+	return out
+}
@@ -0,0 +1,56 @@
+package metainfo
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+)
+
+// torrentClient bounds .torrent downloads so a slow server can't block us
+var torrentClient = &http.Client{
+	Timeout: internal.TorrentFetchTimeout * time.Second,
+}
+
+// isTorrentURL reports whether path names a torrent to fetch over HTTP rather
+// than a local file
+func isTorrentURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// fetchTorrent downloads a .torrent file, refusing bodies over
+// internal.MaxTorrentFileSize
+func fetchTorrent(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("User-Agent", internal.UserAgent)
+
+	resp, err := torrentClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	if resp.ContentLength > internal.MaxTorrentFileSize {
+		return nil, fmt.Errorf("torrent file is %d bytes, over the %d byte limit",
+			resp.ContentLength, internal.MaxTorrentFileSize)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, internal.MaxTorrentFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	if len(body) > internal.MaxTorrentFileSize {
+		return nil, fmt.Errorf("torrent file is over the %d byte limit", internal.MaxTorrentFileSize)
+	}
+	return body, nil
+}
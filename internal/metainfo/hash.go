@@ -3,6 +3,8 @@ package metainfo
 import (
 	"crypto/sha1"
 	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
 )
 
 // HashPiece computes the SHA1 hash of a piece for verification
@@ -13,6 +15,25 @@ func HashPiece(piece []byte) []byte {
 	return sha
 }
 
+// VerifyCanonicalInfo decodes a raw info dict, re-encodes it canonically (keys
+// sorted, no redundant digits) and reports whether the re-encoding hashes to
+// expected. It doesn't when the original encoding wasn't canonical, in which
+// case only the exact original bytes give the right info hash.
+func VerifyCanonicalInfo(raw []byte, expected [20]byte) (bool, error) {
+	decoded, err := bencode.Decode(raw)
+	if err != nil {
+		return false, fmt.Errorf("error decoding info dict: %w", err)
+	}
+	if _, ok := decoded.(map[string]interface{}); !ok {
+		return false, fmt.Errorf("info is not a dictionary")
+	}
+	encoded, err := bencode.Encode(decoded)
+	if err != nil {
+		return false, fmt.Errorf("error re-encoding info dict: %w", err)
+	}
+	return sha1.Sum(encoded) == expected, nil
+}
+
 // urlEncodeInfoHash URL-encodes a hexadecimal-represented info hash
 func URLEncodeInfoHash(infoHash string) string {
 	urlEncodedHash := ""
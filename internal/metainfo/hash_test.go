@@ -0,0 +1,44 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+func TestVerifyCanonicalInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want bool
+	}{
+		{"canonical", "d6:lengthi16e4:name4:file12:piece lengthi16ee", true},
+		{"unsorted keys", "d4:name4:file6:lengthi16e12:piece lengthi16ee", false},
+		{"integer with a plus sign", "d6:lengthi+16e4:name4:file12:piece lengthi16ee", false},
+		{"duplicate key", "d6:lengthi16e6:lengthi16e4:name4:file12:piece lengthi16ee", false},
+	}
+	for _, tt := range tests {
+		ok, err := VerifyCanonicalInfo([]byte(tt.raw), sha1.Sum([]byte(tt.raw)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ok != tt.want {
+			t.Errorf("%s: VerifyCanonicalInfo = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestVerifyCanonicalInfoWrongHash(t *testing.T) {
+	raw := []byte("d6:lengthi16e4:name4:filee")
+	if ok, err := VerifyCanonicalInfo(raw, [20]byte{}); err != nil || ok {
+		t.Errorf("VerifyCanonicalInfo = %v, %v with the wrong hash, want false", ok, err)
+	}
+}
+
+func TestVerifyCanonicalInfoInvalid(t *testing.T) {
+	for _, raw := range []string{"d6:lengthi016ee", "li16ee", "d6:length"} {
+		if _, err := VerifyCanonicalInfo([]byte(raw), sha1.Sum([]byte(raw))); err == nil {
+			t.Errorf("VerifyCanonicalInfo(%q) succeeded", raw)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package metainfo
 
 import (
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
 )
 
 // Info represents the 'info' dictionary from a torrent file.
@@ -15,6 +19,15 @@ type Info struct {
 	Pieces      []byte
 	InfoHash    [20]byte
 	Files       []FileInfo
+
+	// Private is set for torrents from private trackers (BEP 27). Peers must
+	// then only come from the tracker, never from the DHT or PEX.
+	Private bool
+
+	// Raw holds the exact bencoded info dictionary as it appeared in the
+	// torrent or metadata. The info hash is computed over these bytes, since
+	// re-encoding the parsed fields drops keys this struct doesn't model.
+	Raw []byte
 }
 
 type FileInfo struct {
@@ -22,19 +35,36 @@ type FileInfo struct {
 	Path   []string
 }
 
+// FileEntry describes a file in the torrent for listing: its index in
+// GetFiles order, its path joined with '/', and the pieces it overlaps.
+// Empty files overlap no pieces and have -1 for both.
+type FileEntry struct {
+	Index      int
+	Path       string
+	Length     int
+	FirstPiece int
+	LastPiece  int
+}
+
 // NewInfo constructs an Info struct from the 'info' dictionary
 func NewInfo(infoMap map[string]interface{}) (*Info, error) {
-	name, ok := infoMap["name"].(string)
-	if !ok {
-		return nil, fmt.Errorf("error accessing info name: not a string")
+	name, err := bencode.GetString(infoMap, "name")
+	if err != nil {
+		return nil, fmt.Errorf("error accessing info name: %w", err)
+	}
+	pieceLength, err := bencode.GetInt(infoMap, "piece length")
+	if err != nil {
+		return nil, fmt.Errorf("error accessing info piece length: %w", err)
 	}
-	pieceLength, ok := infoMap["piece length"].(int)
-	if !ok {
-		return nil, fmt.Errorf("error accessing info piece length: not an int")
+	// Pieces are split into blocks and held in memory, so their length must
+	// be positive and bounded
+	if pieceLength <= 0 || pieceLength > internal.MaxPieceLength {
+		return nil, fmt.Errorf("invalid info piece length %d: must be between 1 and %d",
+			pieceLength, internal.MaxPieceLength)
 	}
-	pieces, ok := infoMap["pieces"].([]byte)
-	if !ok {
-		return nil, fmt.Errorf("error accessing info pieces: not a byte slice")
+	pieces, err := bencode.GetBytes(infoMap, "pieces")
+	if err != nil {
+		return nil, fmt.Errorf("error accessing info pieces: %w", err)
 	}
 
 	info := &Info{
@@ -42,62 +72,77 @@ func NewInfo(infoMap map[string]interface{}) (*Info, error) {
 		PieceLength: pieceLength,
 		Pieces:      pieces,
 	}
-	if length, ok := infoMap["length"].(int); ok {
-		info.Length = length
-	} else if filesInterface, ok := infoMap["files"].([]interface{}); ok {
+	if private, err := bencode.GetInt(infoMap, "private"); err == nil {
+		info.Private = private == 1
+	}
+
+	// Some torrents carry both keys; files is what multi-file clients read
+	if filesInterface, err := bencode.GetList(infoMap, "files"); err == nil {
 		files, err := parseFiles(filesInterface)
 		if err != nil {
 			return nil, err
 		}
 		info.Files = files
-
-		info.Length = 0
 		for _, f := range files {
 			info.Length += f.Length
 		}
-	} else {
-		return nil, fmt.Errorf("error creating info")
+	} else if !errors.Is(err, bencode.ErrKeyNotFound) {
+		return nil, fmt.Errorf("error accessing info files: %w", err)
+	} else if info.Length, err = bencode.GetInt(infoMap, "length"); err != nil {
+		return nil, fmt.Errorf("error accessing info length: %w", err)
+	} else if info.Length < 0 {
+		return nil, fmt.Errorf("invalid info length %d", info.Length)
 	}
-	if !ok {
-		return nil, fmt.Errorf("error accessing info length: not an int")
+
+	if err := info.validatePieces(); err != nil {
+		return nil, err
 	}
 
 	return info, nil
 }
 
-func parseFiles(filesInterface []interface{}) ([]FileInfo, error) {
-	var files []FileInfo
+// validatePieces checks that the pieces blob holds whole SHA-1 hashes, one for
+// each PieceLength chunk of the torrent's data
+func (i Info) validatePieces() error {
+	if len(i.Pieces)%20 != 0 {
+		return fmt.Errorf("invalid info pieces: length %d is not a multiple of 20", len(i.Pieces))
+	}
+	numPieces := len(i.Pieces) / 20
+	want := (i.Length + i.PieceLength - 1) / i.PieceLength
+	if numPieces != want {
+		return fmt.Errorf("invalid info pieces: %d hashes for %d bytes in %d-byte pieces (want %d)",
+			numPieces, i.Length, i.PieceLength, want)
+	}
+	return nil
+}
 
-	for i, fileInterface := range filesInterface {
-		fileMap, ok := fileInterface.(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("file %d is not a map", i)
-		}
+// parseFiles reads a multi-file torrent's file list. Zero-length files are
+// kept, since they still have to be created, but an empty list is refused:
+// with no files the torrent would read as single-file.
+func parseFiles(filesInterface []interface{}) ([]FileInfo, error) {
+	if len(filesInterface) == 0 {
+		return nil, fmt.Errorf("info files list is empty")
+	}
+	var entries []struct {
+		Length *int      `bencode:"length"`
+		Path   *[]string `bencode:"path"`
+	}
+	if err := bencode.UnmarshalDecoded(filesInterface, &entries); err != nil {
+		return nil, fmt.Errorf("info files: %w", err)
+	}
 
-		length, ok := fileMap["length"].(int)
-		if !ok {
-			return nil, fmt.Errorf("file %d length is not an int", i)
+	files := make([]FileInfo, len(entries))
+	for i, entry := range entries {
+		if entry.Length == nil {
+			return nil, fmt.Errorf("file %d: \"length\": %w", i, bencode.ErrKeyNotFound)
 		}
-
-		pathInterface, ok := fileMap["path"].([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("file %d path is not a list", i)
+		if *entry.Length < 0 {
+			return nil, fmt.Errorf("file %d: invalid length %d", i, *entry.Length)
 		}
-
-		// Convert path components to strings
-		var path []string
-		for j, component := range pathInterface {
-			pathStr, ok := component.(string)
-			if !ok {
-				return nil, fmt.Errorf("file %d path component %d is not a string", i, j)
-			}
-			path = append(path, pathStr)
+		if entry.Path == nil {
+			return nil, fmt.Errorf("file %d: \"path\": %w", i, bencode.ErrKeyNotFound)
 		}
-
-		files = append(files, FileInfo{
-			Length: length,
-			Path:   path,
-		})
+		files[i] = FileInfo{Length: *entry.Length, Path: *entry.Path}
 	}
 
 	return files, nil
@@ -121,11 +166,66 @@ func (i Info) GetFiles() []FileInfo {
 	return i.Files
 }
 
-// getInfoHash returns the SHA1 hash of the bencoded info dictionary
+// TotalLength returns the combined size of every file in the torrent
+func (i Info) TotalLength() int {
+	total := 0
+	for _, f := range i.GetFiles() {
+		total += f.Length
+	}
+	return total
+}
+
+// FileAtOffset maps a global byte offset, counted from the start of the first
+// file, onto the index of the file holding that byte and the offset within
+// it. Offsets outside the torrent return -1 for both.
+func (i Info) FileAtOffset(offset int) (fileIndex int, fileOffset int) {
+	if offset < 0 {
+		return -1, -1
+	}
+	fileStart := 0
+	for j, f := range i.GetFiles() {
+		if offset < fileStart+f.Length {
+			return j, offset - fileStart
+		}
+		fileStart += f.Length
+	}
+	return -1, -1
+}
+
+// FileEntries lists the torrent's files along with the range of pieces each
+// one occupies
+func (i Info) FileEntries() []FileEntry {
+	files := i.GetFiles()
+	entries := make([]FileEntry, len(files))
+	offset := 0
+	for j, f := range files {
+		entry := FileEntry{
+			Index:      j,
+			Path:       strings.Join(f.Path, "/"),
+			Length:     f.Length,
+			FirstPiece: -1,
+			LastPiece:  -1,
+		}
+		if f.Length > 0 && i.PieceLength > 0 {
+			entry.FirstPiece = offset / i.PieceLength
+			entry.LastPiece = (offset + f.Length - 1) / i.PieceLength
+		}
+		entries[j] = entry
+		offset += f.Length
+	}
+	return entries
+}
+
+// getInfoHash returns the SHA1 hash of the bencoded info dictionary.
+// The original bytes are used when available; otherwise the dictionary is
+// re-serialized from the parsed fields.
 func (i Info) getInfoHash() [20]byte {
 	infoHash := [20]byte{}
 	hasher := sha1.New()
-	bencodedBytes := i.serializeInfo()
+	bencodedBytes := i.Raw
+	if bencodedBytes == nil {
+		bencodedBytes = i.serializeInfo()
+	}
 	hasher.Write(bencodedBytes)
 
 	sha := hasher.Sum(nil)
@@ -138,7 +238,10 @@ func (i Info) GetHexInfoHash() string {
 	return fmt.Sprintf("%x", i.getInfoHash())
 }
 
-// serializeInfo bencodes the Info struct
+// serializeInfo bencodes the Info struct. Only the fields Info models are
+// written, in canonical order, so the result hashes to the real info hash
+// only if the original dict had no other keys and was canonically encoded
+// (see VerifyCanonicalInfo). Hash Raw instead whenever it is available.
 func (i Info) serializeInfo() []byte {
 	var infoB []byte = []byte{'d'}
 
@@ -178,6 +281,10 @@ func (i Info) serializeInfo() []byte {
 		infoB = append(infoB, pieces...)
 	}
 
+	if i.Private {
+		infoB = append(infoB, []byte("7:privatei1e")...)
+	}
+
 	infoB = append(infoB, 'e')
 	return infoB
 }
@@ -185,21 +292,83 @@ func (i Info) serializeInfo() []byte {
 // HexPieceHashes formats piece hashes for display in hexadecimal format
 func (i Info) HexPieceHashes() []string {
 	var pieceHashes []string
-	pieces := i.Pieces
-	for j := 0; j < len(pieces); j += 20 {
-		piece := pieces[j : j+20]
-		pieceHashes = append(pieceHashes, fmt.Sprintf("%x", piece))
+	for _, hash := range i.PieceHashes() {
+		pieceHashes = append(pieceHashes, fmt.Sprintf("%x", hash))
 	}
 
 	return pieceHashes
 }
 
-// PieceHashes returns piece hashes as [][]byte
+// NumPieces returns the number of whole hashes in the pieces blob
+func (i Info) NumPieces() int {
+	return len(i.Pieces) / 20
+}
+
+// checkPieceIndex validates the pieces blob and that index is within it
+func (i Info) checkPieceIndex(index int) error {
+	if len(i.Pieces)%20 != 0 {
+		return fmt.Errorf("pieces length %d is not a multiple of 20", len(i.Pieces))
+	}
+	if index < 0 || index >= i.NumPieces() {
+		return fmt.Errorf("piece index %d out of range [0, %d)", index, i.NumPieces())
+	}
+	return nil
+}
+
+// PieceHash returns the SHA-1 hash of the piece at index
+func (i Info) PieceHash(index int) ([]byte, error) {
+	if err := i.checkPieceIndex(index); err != nil {
+		return nil, err
+	}
+	return i.Pieces[index*20 : index*20+20], nil
+}
+
+// PieceLengthAt returns the length of the piece at index. Every piece is
+// PieceLength bytes except the last, which holds whatever remains.
+func (i Info) PieceLengthAt(index int) (uint32, error) {
+	if err := i.checkPieceIndex(index); err != nil {
+		return 0, err
+	}
+	numPieces := i.NumPieces()
+	if index < numPieces-1 {
+		return uint32(i.PieceLength), nil
+	}
+	return uint32(int64(i.Length) - int64(i.PieceLength)*int64(numPieces-1)), nil
+}
+
+// PieceSet reports which pieces are held, e.g. a peer.BitField
+type PieceSet interface {
+	HasPiece(index int) bool
+}
+
+// CompletedBytes sums the lengths of the pieces in have, counting the short
+// last piece at its real length
+func (i Info) CompletedBytes(have PieceSet) int64 {
+	var total int64
+	for index := range i.NumPieces() {
+		if have.HasPiece(index) {
+			length, _ := i.PieceLengthAt(index)
+			total += int64(length)
+		}
+	}
+	return total
+}
+
+// PercentComplete returns how much of the torrent's data the pieces in have
+// cover, from 0 to 100. An empty torrent is complete.
+func (i Info) PercentComplete(have PieceSet) float64 {
+	if i.Length <= 0 {
+		return 100
+	}
+	return float64(i.CompletedBytes(have)) * 100 / float64(i.Length)
+}
+
+// PieceHashes returns piece hashes as [][]byte. A truncated hash at the end
+// of a malformed pieces blob is left out.
 func (i Info) PieceHashes() [][]byte {
-	pieces := i.Pieces
-	var piecesSlice [][]byte
-	for j := 0; j < len(pieces); j += 20 {
-		piecesSlice = append(piecesSlice, pieces[j:j+20])
+	piecesSlice := make([][]byte, 0, i.NumPieces())
+	for j := range i.NumPieces() {
+		piecesSlice = append(piecesSlice, i.Pieces[j*20:j*20+20])
 	}
 	return piecesSlice
 }
@@ -0,0 +1,203 @@
+package metainfo
+
+import (
+	"strings"
+	"testing"
+)
+
+// singleFileInfo returns an Info for one file of length bytes in pieces of
+// pieceLength bytes
+func singleFileInfo(t *testing.T, length, pieceLength int) *Info {
+	t.Helper()
+	numPieces := (length + pieceLength - 1) / pieceLength
+	info, err := NewInfo(map[string]interface{}{
+		"name":         "file",
+		"length":       length,
+		"piece length": pieceLength,
+		"pieces":       strings.Repeat("h", numPieces*20),
+	})
+	if err != nil {
+		t.Fatalf("NewInfo: %v", err)
+	}
+	return info
+}
+
+func TestPieceLengthAt(t *testing.T) {
+	tests := []struct {
+		name        string
+		length      int
+		pieceLength int
+		want        []uint32
+	}{
+		{"exact multiple", 32, 16, []uint32{16, 16}},
+		{"short last piece", 45, 16, []uint32{16, 16, 13}},
+		{"single short piece", 5, 16, []uint32{5}},
+	}
+	for _, tt := range tests {
+		info := singleFileInfo(t, tt.length, tt.pieceLength)
+		for index, want := range tt.want {
+			got, err := info.PieceLengthAt(index)
+			if err != nil || got != want {
+				t.Errorf("%s: PieceLengthAt(%d) = %d, %v, want %d", tt.name, index, got, err, want)
+			}
+		}
+	}
+}
+
+func TestPieceLengthAtMalformedPieces(t *testing.T) {
+	info := Info{Length: 32, PieceLength: 16, Pieces: make([]byte, 39)}
+	if _, err := info.PieceLengthAt(0); err == nil {
+		t.Error("PieceLengthAt succeeded with a 39-byte pieces blob")
+	}
+}
+
+func TestFileAtOffset(t *testing.T) {
+	info, err := NewInfo(testInfo())
+	if err != nil {
+		t.Fatalf("NewInfo: %v", err)
+	}
+	if got := info.TotalLength(); got != 45 {
+		t.Errorf("TotalLength() = %d, want 45", got)
+	}
+
+	tests := []struct {
+		offset, fileIndex, fileOffset int
+	}{
+		{0, 0, 0},
+		{9, 0, 9},
+		{10, 1, 0},
+		// Piece 1 starts in the middle of the second file
+		{16, 1, 6},
+		{29, 1, 19},
+		{30, 2, 0},
+		{44, 2, 14},
+		{45, -1, -1},
+		{-1, -1, -1},
+	}
+	for _, tt := range tests {
+		fileIndex, fileOffset := info.FileAtOffset(tt.offset)
+		if fileIndex != tt.fileIndex || fileOffset != tt.fileOffset {
+			t.Errorf("FileAtOffset(%d) = %d, %d, want %d, %d",
+				tt.offset, fileIndex, fileOffset, tt.fileIndex, tt.fileOffset)
+		}
+	}
+}
+
+func TestNewInfoValidatesPieces(t *testing.T) {
+	tests := []struct {
+		name   string
+		pieces int
+	}{
+		{"39-byte pieces blob", 39},
+		{"too few hashes", 2 * 20},
+		{"too many hashes", 4 * 20},
+	}
+	for _, tt := range tests {
+		info := testInfo()
+		info["pieces"] = strings.Repeat("h", tt.pieces)
+		if _, err := NewInfo(info); err == nil {
+			t.Errorf("%s: NewInfo succeeded", tt.name)
+		}
+	}
+}
+
+func TestPieceHash(t *testing.T) {
+	info := singleFileInfo(t, 45, 16)
+	info.Pieces = []byte(strings.Repeat("a", 20) + strings.Repeat("b", 20) + strings.Repeat("c", 20))
+
+	for index, want := range []string{"a", "b", "c"} {
+		got, err := info.PieceHash(index)
+		if err != nil || string(got) != strings.Repeat(want, 20) {
+			t.Errorf("PieceHash(%d) = %q, %v", index, got, err)
+		}
+	}
+	for _, index := range []int{-1, 3, 1 << 30} {
+		if _, err := info.PieceHash(index); err == nil {
+			t.Errorf("PieceHash(%d) succeeded", index)
+		}
+	}
+}
+
+func TestNewInfoZeroLengthFile(t *testing.T) {
+	m := testInfo()
+	files := m["files"].([]interface{})
+	m["files"] = append(files[:1], append([]interface{}{
+		map[string]interface{}{"length": 0, "path": []interface{}{"empty"}},
+	}, files[1:]...)...)
+
+	info, err := NewInfo(m)
+	if err != nil {
+		t.Fatalf("NewInfo: %v", err)
+	}
+	if len(info.Files) != 4 || info.Files[1].Length != 0 || info.Length != 45 {
+		t.Fatalf("got files %v with length %d", info.Files, info.Length)
+	}
+
+	entry := info.FileEntries()[1]
+	if entry.FirstPiece != -1 || entry.LastPiece != -1 {
+		t.Errorf("empty file overlaps pieces %d to %d", entry.FirstPiece, entry.LastPiece)
+	}
+	// Offset 10 is the first byte of the file after the empty one
+	if fileIndex, fileOffset := info.FileAtOffset(10); fileIndex != 2 || fileOffset != 0 {
+		t.Errorf("FileAtOffset(10) = %d, %d, want 2, 0", fileIndex, fileOffset)
+	}
+}
+
+func TestNewInfoPrefersFiles(t *testing.T) {
+	m := testInfo()
+	m["length"] = 999
+
+	info, err := NewInfo(m)
+	if err != nil {
+		t.Fatalf("NewInfo: %v", err)
+	}
+	if info.IsSingleFile() || len(info.Files) != 3 || info.Length != 45 {
+		t.Errorf("got %d files with length %d, want the 3 files of 45 bytes", len(info.Files), info.Length)
+	}
+}
+
+// pieceSet is a PieceSet holding the pieces set to true
+type pieceSet []bool
+
+func (s pieceSet) HasPiece(index int) bool { return index < len(s) && s[index] }
+
+func TestCompletedBytes(t *testing.T) {
+	info := singleFileInfo(t, 45, 16)
+
+	tests := []struct {
+		name    string
+		have    pieceSet
+		bytes   int64
+		percent float64
+	}{
+		{"no pieces", pieceSet{false, false, false}, 0, 0},
+		{"first piece", pieceSet{true, false, false}, 16, 16 * 100.0 / 45},
+		{"short last piece", pieceSet{false, false, true}, 13, 13 * 100.0 / 45},
+		{"all pieces", pieceSet{true, true, true}, 45, 100},
+		{"bits past the last piece", pieceSet{true, true, true, true}, 45, 100},
+	}
+	for _, tt := range tests {
+		if got := info.CompletedBytes(tt.have); got != tt.bytes {
+			t.Errorf("%s: CompletedBytes = %d, want %d", tt.name, got, tt.bytes)
+		}
+		if got := info.PercentComplete(tt.have); got != tt.percent {
+			t.Errorf("%s: PercentComplete = %v, want %v", tt.name, got, tt.percent)
+		}
+	}
+}
+
+func TestNewInfoPieceLength(t *testing.T) {
+	for _, pieceLength := range []int{0, -16} {
+		m := testInfo()
+		m["piece length"] = pieceLength
+		if _, err := NewInfo(m); err == nil {
+			t.Errorf("NewInfo accepted piece length %d", pieceLength)
+		}
+	}
+
+	m := testInfo()
+	delete(m, "piece length")
+	if _, err := NewInfo(m); err == nil {
+		t.Error("NewInfo accepted an info dict without a piece length")
+	}
+}
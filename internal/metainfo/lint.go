@@ -0,0 +1,204 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// Lint checks the structural validity of a .torrent file's contents without
+// touching the network. Every problem found is returned, not just the first;
+// a nil result means the torrent is well-formed.
+func Lint(contents []byte) []error {
+	var problems []error
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if len(contents) == 0 {
+		report("file is empty")
+		return problems
+	}
+
+	decoded, end, err := bencode.DecodeAt(contents, 0)
+	if err != nil {
+		report("bencode: %v", err)
+		return problems
+	}
+	if end != len(contents) {
+		report("trailing data: %d bytes after the top-level value", len(contents)-end)
+	}
+	// Decoding keeps the last of duplicate keys; other clients may not
+	if _, err = bencode.DecodeStrict(contents); err != nil {
+		report("bencode: %v", err)
+	}
+
+	d, ok := decoded.(map[string]interface{})
+	if !ok {
+		report("top-level value is not a dictionary")
+		return problems
+	}
+	if _, err = parseAnnounceList(d["announce-list"]); err != nil {
+		report("%v", err)
+	}
+	if _, ok = d["announce"].(string); !ok && d["announce-list"] == nil {
+		report("announce is missing or not a string")
+	}
+
+	infoMap, ok := d["info"].(map[string]interface{})
+	if !ok {
+		report("info is missing or not a dictionary")
+		return problems
+	}
+	problems = append(problems, lintInfo(infoMap)...)
+
+	// The info hash is computed over the raw info bytes, so they must be locatable
+	_, spans, err := bencode.DecodeDictSpans(contents)
+	if err != nil {
+		report("info hash: %v", err)
+	} else if span, ok := spans["info"]; !ok || span.End <= span.Start {
+		report("info hash: could not locate the info dictionary bytes")
+	} else {
+		raw := contents[span.Start:span.End]
+		if ok, err := VerifyCanonicalInfo(raw, sha1.Sum(raw)); err == nil && !ok {
+			report("info dictionary is not canonically bencoded; clients that re-encode it will compute a different info hash")
+		}
+	}
+
+	return problems
+}
+
+// lintInfo checks the keys of an info dictionary
+func lintInfo(infoMap map[string]interface{}) []error {
+	var problems []error
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if name, ok := infoMap["name"].(string); !ok || name == "" {
+		report("info name is missing or not a non-empty string")
+	} else if err := ValidatePathComponent(name); err != nil {
+		report("info name: %v", err)
+	}
+
+	pieceLength, ok := infoMap["piece length"].(int)
+	if !ok {
+		report("info piece length is missing or not an int")
+	} else if pieceLength <= 0 {
+		report("info piece length must be positive, got %d", pieceLength)
+	} else if pieceLength > internal.MaxPieceLength {
+		report("info piece length %d is larger than the %d we accept", pieceLength, internal.MaxPieceLength)
+	}
+
+	var pieces []byte
+	switch p := infoMap["pieces"].(type) {
+	case []byte:
+		pieces = p
+	case string:
+		pieces = []byte(p)
+	default:
+		report("info pieces is missing or not a string")
+	}
+	if len(pieces)%20 != 0 {
+		report("info pieces length %d is not a multiple of 20", len(pieces))
+	}
+
+	length, hasLength := infoMap["length"].(int)
+	filesList, hasFiles := infoMap["files"].([]interface{})
+	switch {
+	case hasFiles:
+		if hasLength {
+			report("info has both length and files; files is used")
+		}
+		if len(filesList) == 0 {
+			report("info files list is empty")
+		}
+		length = 0
+		for i, f := range filesList {
+			fileMap, ok := f.(map[string]interface{})
+			if !ok {
+				report("file %d is not a dictionary", i)
+				continue
+			}
+			fileLength, ok := fileMap["length"].(int)
+			if !ok || fileLength < 0 {
+				report("file %d length is missing or invalid", i)
+			} else {
+				length += fileLength
+			}
+			path, ok := fileMap["path"].([]interface{})
+			if !ok || len(path) == 0 {
+				report("file %d path is missing or empty", i)
+				continue
+			}
+			for j, component := range path {
+				c, ok := component.(string)
+				if !ok {
+					report("file %d path component %d is not a string", i, j)
+					continue
+				}
+				if err := ValidatePathComponent(c); err != nil {
+					report("file %d path component %d: %v", i, j, err)
+				}
+			}
+		}
+	case hasLength:
+		if length < 0 {
+			report("info length must not be negative, got %d", length)
+		}
+	default:
+		report("info has neither length nor files")
+		return problems
+	}
+
+	if pieceLength > 0 && len(pieces)%20 == 0 {
+		expected := (length + pieceLength - 1) / pieceLength
+		if got := len(pieces) / 20; got != expected {
+			report("info has %d piece hashes but length %d with piece length %d needs %d",
+				got, length, pieceLength, expected)
+		}
+	}
+
+	return problems
+}
+
+// ValidatePathComponent rejects path components that are empty or could
+// escape the download directory
+func ValidatePathComponent(c string) error {
+	switch {
+	case c == "":
+		return fmt.Errorf("empty path component")
+	case c == "." || c == "..":
+		return fmt.Errorf("path component %q is not allowed", c)
+	case strings.ContainsAny(c, `/\`):
+		return fmt.Errorf("path component %q contains a path separator", c)
+	case strings.ContainsRune(c, 0):
+		return fmt.Errorf("path component %q contains a NUL byte", c)
+	}
+	return nil
+}
+
+// SafeJoin joins path components taken from a torrent onto base, refusing any
+// that ValidatePathComponent rejects, so that a malicious torrent can't reach
+// outside base
+func SafeJoin(base string, components ...string) (string, error) {
+	if len(components) == 0 {
+		return "", fmt.Errorf("unsafe path in torrent: no path components")
+	}
+	for _, c := range components {
+		if err := ValidatePathComponent(c); err != nil {
+			return "", fmt.Errorf("unsafe path in torrent: %w", err)
+		}
+	}
+
+	path := filepath.Join(append([]string{base}, components...)...)
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe path in torrent: %q escapes %s", strings.Join(components, "/"), base)
+	}
+	return path, nil
+}
@@ -0,0 +1,141 @@
+package metainfo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// testInfo returns a well-formed multi-file info dictionary: 3 pieces of 16
+// bytes holding files of 10, 20 and 15 bytes
+func testInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"name":         "dir",
+		"piece length": 16,
+		"pieces":       strings.Repeat("h", 3*20),
+		"files": []interface{}{
+			map[string]interface{}{"length": 10, "path": []interface{}{"a"}},
+			map[string]interface{}{"length": 20, "path": []interface{}{"sub", "b"}},
+			map[string]interface{}{"length": 15, "path": []interface{}{"c"}},
+		},
+	}
+}
+
+// encodeTorrent bencodes a torrent with the given info dictionary
+func encodeTorrent(t *testing.T, info map[string]interface{}) []byte {
+	t.Helper()
+	contents, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info":     info,
+	})
+	if err != nil {
+		t.Fatalf("encoding torrent: %v", err)
+	}
+	return contents
+}
+
+func TestLintValid(t *testing.T) {
+	if problems := Lint(encodeTorrent(t, testInfo())); problems != nil {
+		t.Errorf("Lint reported problems with a valid torrent: %v", problems)
+	}
+}
+
+func TestLintBroken(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(info map[string]interface{})
+		want   []string
+	}{
+		{
+			name:   "pieces not a multiple of 20",
+			mutate: func(info map[string]interface{}) { info["pieces"] = strings.Repeat("h", 39) },
+			want:   []string{"not a multiple of 20"},
+		},
+		{
+			name:   "wrong number of pieces",
+			mutate: func(info map[string]interface{}) { info["pieces"] = strings.Repeat("h", 20) },
+			want:   []string{"needs 3"},
+		},
+		{
+			name:   "zero piece length",
+			mutate: func(info map[string]interface{}) { info["piece length"] = 0 },
+			want:   []string{"must be positive"},
+		},
+		{
+			name: "path traversal and missing name",
+			mutate: func(info map[string]interface{}) {
+				delete(info, "name")
+				files := info["files"].([]interface{})
+				files[1].(map[string]interface{})["path"] = []interface{}{"..", "b"}
+			},
+			want: []string{"name is missing", "file 1 path component 0"},
+		},
+		{
+			name: "neither length nor files",
+			mutate: func(info map[string]interface{}) {
+				delete(info, "files")
+			},
+			want: []string{"neither length nor files"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := testInfo()
+			tt.mutate(info)
+			problems := Lint(encodeTorrent(t, info))
+			for _, want := range tt.want {
+				if !containsProblem(problems, want) {
+					t.Errorf("no problem mentioning %q in %v", want, problems)
+				}
+			}
+		})
+	}
+}
+
+func TestLintMalformedFile(t *testing.T) {
+	valid := encodeTorrent(t, testInfo())
+	tests := []struct {
+		name     string
+		contents []byte
+		want     string
+	}{
+		{"empty", nil, "empty"},
+		{"truncated", valid[:len(valid)-5], "bencode"},
+		{"trailing data", append(append([]byte{}, valid...), "junk"...), "trailing data"},
+		{"not a dictionary", []byte("li1ee"), "not a dictionary"},
+		{"no info", []byte("d8:announce3:urle"), "info is missing"},
+	}
+	for _, tt := range tests {
+		if problems := Lint(tt.contents); !containsProblem(problems, tt.want) {
+			t.Errorf("%s: no problem mentioning %q in %v", tt.name, tt.want, problems)
+		}
+	}
+}
+
+// containsProblem reports whether any of problems mentions substr
+func containsProblem(problems []error, substr string) bool {
+	for _, p := range problems {
+		if strings.Contains(p.Error(), substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLintNonCanonicalInfo(t *testing.T) {
+	// The info dict's keys are out of order, which Encode would never produce
+	info := "d4:name4:file6:lengthi16e12:piece lengthi16e6:pieces20:" + strings.Repeat("h", 20) + "e"
+	contents := []byte("d8:announce31:http://tracker.example/announce4:info" + info + "e")
+	problems := Lint(contents)
+	if !containsProblem(problems, "not canonically bencoded") {
+		t.Errorf("got %v, want a non-canonical encoding warning", problems)
+	}
+
+	// The same info dict in order is fine
+	if problems := Lint(encodeTorrent(t, map[string]interface{}{
+		"name": "file", "length": 16, "piece length": 16, "pieces": strings.Repeat("h", 20),
+	})); problems != nil {
+		t.Errorf("Lint reported problems with a canonical torrent: %v", problems)
+	}
+}
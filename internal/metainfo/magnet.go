@@ -1,7 +1,9 @@
 package metainfo
 
 import (
+	"encoding/base32"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
@@ -15,29 +17,109 @@ type MagnetLink struct {
 	HexInfoHash string
 }
 
+// DeserializeMagnet parses a magnet URI's info hash and first tracker. The
+// xt value may be percent-encoded, and its urn:btih: prefix and hex digits
+// in any case. A magnet without trackers has an empty TrackerURL.
 func DeserializeMagnet(uri string) (*MagnetLink, error) {
 	magnetUri, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
+	query := magnetUri.Query()
 
-	trackerURL := magnetUri.Query()["tr"][0]
-	hexInfoHash := strings.ReplaceAll(magnetUri.Query()["xt"][0], "urn:btih:", "")
+	var trackerURL string
+	if trackers := query["tr"]; len(trackers) > 0 {
+		trackerURL = trackers[0]
+	}
 
-	var infoHash [20]byte
-	decodedHash, err := hex.DecodeString(hexInfoHash)
+	encodedHash, err := btihParam(query["xt"])
+	if err != nil {
+		return nil, err
+	}
+	infoHash, err := decodeBTIH(encodedHash)
 	if err != nil {
 		return nil, err
 	}
-	copy(infoHash[:], decodedHash)
 
 	return &MagnetLink{
 		TrackerURL:  trackerURL,
 		InfoHash:    infoHash,
-		HexInfoHash: hexInfoHash,
+		HexInfoHash: hex.EncodeToString(infoHash[:]),
 	}, nil
 }
 
+// btihParam finds the BitTorrent info hash among a magnet's xt values and
+// returns it without its urn:btih: prefix
+func btihParam(xts []string) (string, error) {
+	const prefix = "urn:btih:"
+	for _, xt := range xts {
+		// Undo any encoding left over from the query string
+		if unescaped, err := url.QueryUnescape(xt); err == nil {
+			xt = unescaped
+		}
+		xt = strings.TrimSpace(xt)
+		if len(xt) > len(prefix) && strings.EqualFold(xt[:len(prefix)], prefix) {
+			return strings.TrimSpace(xt[len(prefix):]), nil
+		}
+	}
+	if len(xts) == 0 {
+		return "", fmt.Errorf("magnet link has no xt parameter")
+	}
+	return "", fmt.Errorf("magnet link has no urn:btih: info hash in xt %q", xts)
+}
+
+// decodeBTIH decodes a magnet's info hash, which is 40 hex characters or, in
+// older magnets, 32 base32 characters
+func decodeBTIH(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(strings.ToLower(encoded))
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("invalid info hash %q: want 40 hex or 32 base32 characters", encoded)
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash %q: %w", encoded, err)
+	}
+	if len(decoded) != len(infoHash) {
+		return infoHash, fmt.Errorf("invalid info hash %q: decodes to %d bytes, want %d",
+			encoded, len(decoded), len(infoHash))
+	}
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// ToMagnet builds a magnet URI for the torrent with its info hash, name and
+// every tracker it lists, the inverse of DeserializeMagnet
+func ToMagnet(t *TorrentFile) string {
+	var b strings.Builder
+	b.WriteString("magnet:?xt=urn:btih:")
+	b.WriteString(t.Info.GetHexInfoHash())
+	if t.Info.Name != "" {
+		b.WriteString("&dn=")
+		b.WriteString(url.QueryEscape(t.Info.Name))
+	}
+
+	seen := make(map[string]bool)
+	for _, trackerURL := range append([]string{t.Announce}, t.TrackerURLs()...) {
+		if trackerURL == "" || seen[trackerURL] {
+			continue
+		}
+		seen[trackerURL] = true
+		b.WriteString("&tr=")
+		b.WriteString(url.QueryEscape(trackerURL))
+	}
+	return b.String()
+}
+
+// ErrMetadataRejected is returned when a peer answers a metadata request with
+// a reject, typically because it doesn't have that piece of the metadata.
+var ErrMetadataRejected = errors.New("peer rejected metadata request")
+
 type MetadataPiece struct {
 	Piece     int
 	TotalSize int
@@ -59,8 +141,11 @@ func ParseMetadataPiece(payload []byte) (*MetadataPiece, error) {
 	if !ok {
 		return nil, fmt.Errorf("metadata response not a dictionary")
 	}
-	// Check msg_type (should be 1 for data)
+	// Check msg_type (should be 1 for data, or 2 for a reject)
 	msgType, ok := dict["msg_type"].(int)
+	if ok && msgType == 2 {
+		return nil, ErrMetadataRejected
+	}
 	if !ok || msgType != 1 {
 		return nil, fmt.Errorf("invalid msg_type in metadata response")
 	}
@@ -0,0 +1,64 @@
+package metainfo
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+const (
+	testHexHash    = "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"
+	testBase32Hash = "22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7"
+)
+
+// parseMagnetHash returns the hex info hash DeserializeMagnet finds in uri
+func parseMagnetHash(t *testing.T, uri string) string {
+	t.Helper()
+	magnet, err := DeserializeMagnet(uri)
+	if err != nil {
+		t.Fatalf("DeserializeMagnet(%q): %v", uri, err)
+	}
+	if want := hex.EncodeToString(magnet.InfoHash[:]); magnet.HexInfoHash != want {
+		t.Errorf("HexInfoHash %s does not match InfoHash %s", magnet.HexInfoHash, want)
+	}
+	return magnet.HexInfoHash
+}
+
+func TestDeserializeMagnetEncodings(t *testing.T) {
+	for _, hash := range []string{testHexHash, testBase32Hash} {
+		uri := "magnet:?xt=urn:btih:" + hash + "&tr=http%3A%2F%2Ftracker.example%2Fannounce"
+		if got := parseMagnetHash(t, uri); got != testHexHash {
+			t.Errorf("%s decoded to %s, want %s", hash, got, testHexHash)
+		}
+	}
+}
+
+func TestDeserializeMagnetNormalizesXT(t *testing.T) {
+	tests := []string{
+		"magnet:?xt=urn:btih:D69F91E6b2ae4c542468D1073A71D4EA13879A7F",
+		"magnet:?xt=URN:BTIH:" + testHexHash,
+		"magnet:?xt=urn%3Abtih%3A" + testHexHash,
+		"magnet:?xt=urn%253Abtih%253A" + testHexHash,
+		"magnet:?xt=%20urn:btih:" + testHexHash + "%20",
+		"magnet:?xt=urn:btih:22pzdzvsvzgfijdi2edtu4ou5ijypgt7",
+		"magnet:?xt=urn:sha1:abc&xt=urn:btih:" + testHexHash,
+	}
+	for _, uri := range tests {
+		if got := parseMagnetHash(t, uri); got != testHexHash {
+			t.Errorf("%s decoded to %s, want %s", uri, got, testHexHash)
+		}
+	}
+}
+
+func TestDeserializeMagnetInvalidXT(t *testing.T) {
+	tests := []string{
+		"magnet:?dn=name",
+		"magnet:?xt=urn:sha1:" + testHexHash,
+		"magnet:?xt=urn:btih:" + testHexHash[:38],
+		"magnet:?xt=urn:btih:" + testHexHash[:39] + "g",
+	}
+	for _, uri := range tests {
+		if _, err := DeserializeMagnet(uri); err == nil {
+			t.Errorf("DeserializeMagnet(%q) succeeded", uri)
+		}
+	}
+}
@@ -1,11 +1,12 @@
 package metainfo
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"net/netip"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
@@ -38,47 +39,163 @@ func parseTorrent(path string) ([]byte, error) {
 // TorrentFile represents a parsed .torrent file
 type TorrentFile struct {
 	Announce string
+	// Trackers holds the BEP 12 announce-list tiers. When the torrent has no
+	// announce-list, it is a single tier containing Announce.
+	Trackers [][]string
 	Info     *Info
+	// URLList holds the torrent's BEP 19 web seeds: HTTP servers with a copy
+	// of its files, from the url-list key
+	URLList []string
+
+	// Optional informational fields; empty or zero when the torrent omits them
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Encoding     string
 }
 
 // newTorrentFile constructs a TorrentFile given a decoded dictionary of a torrent file's contents
-func newTorrentFile(dict interface{}) (*TorrentFile, error) {
-	d, ok := dict.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("newTorrent: argument is not a map")
+// and the raw bytes of its info dictionary
+func newTorrentFile(d map[string]interface{}, rawInfo []byte) (*TorrentFile, error) {
+	announce, err := bencode.GetString(d, "announce")
+	hasAnnounce := err == nil
+	trackers, err := parseAnnounceList(d["announce-list"])
+	if err != nil {
+		return nil, err
 	}
-	announce, ok := d["announce"].(string)
-	if !ok {
-		return nil, fmt.Errorf("newTorrent: announce is not a string")
+	if len(trackers) == 0 {
+		if !hasAnnounce {
+			return nil, fmt.Errorf("newTorrent: announce is not a string")
+		}
+		trackers = [][]string{{announce}}
+	} else if !hasAnnounce {
+		announce = trackers[0][0]
 	}
-	infoMap, ok := d["info"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("newTorrent: info value is not a map")
+
+	infoMap, err := bencode.GetDict(d, "info")
+	if err != nil {
+		return nil, fmt.Errorf("newTorrent: %w", err)
 	}
 	info, err := NewInfo(infoMap)
 	if err != nil {
 		return nil, fmt.Errorf("error creating Info struct: %w", err)
 	}
 
+	info.Raw = rawInfo
 	info.InfoHash = info.getInfoHash()
-	return &TorrentFile{
+	urlList, err := parseURLList(d["url-list"])
+	if err != nil {
+		return nil, err
+	}
+	t := &TorrentFile{
 		Announce: announce,
+		Trackers: trackers,
 		Info:     info,
-	}, nil
+		URLList:  urlList,
+	}
+	t.Comment, _ = bencode.GetString(d, "comment")
+	t.CreatedBy, _ = bencode.GetString(d, "created by")
+	t.Encoding, _ = bencode.GetString(d, "encoding")
+	if created, err := bencode.GetInt(d, "creation date"); err == nil && created > 0 {
+		t.CreationDate = time.Unix(int64(created), 0)
+	}
+	return t, nil
+}
+
+// parseAnnounceList reads the announce-list key: a list of tiers, each a list of
+// tracker URLs. Empty tiers are dropped; a missing key yields no tiers.
+func parseAnnounceList(value interface{}) ([][]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	tiersList, err := bencode.GetList(value)
+	if err != nil {
+		return nil, fmt.Errorf("newTorrent: announce-list: %w", err)
+	}
+
+	var tiers [][]string
+	for i, tierValue := range tiersList {
+		tierList, err := bencode.GetList(tierValue)
+		if err != nil {
+			return nil, fmt.Errorf("newTorrent: announce-list tier %d: %w", i, err)
+		}
+		var tier []string
+		for j, urlValue := range tierList {
+			url, err := bencode.GetString(urlValue)
+			if err != nil {
+				return nil, fmt.Errorf("newTorrent: announce-list tier %d entry %d: %w", i, j, err)
+			}
+			tier = append(tier, url)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers, nil
+}
+
+// parseURLList reads the url-list key, which holds either a single web seed
+// URL or a list of them. Empty URLs are dropped; a missing key yields none.
+func parseURLList(value interface{}) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if url, err := bencode.GetString(value); err == nil {
+		if url == "" {
+			return nil, nil
+		}
+		return []string{url}, nil
+	}
+	list, err := bencode.GetList(value)
+	if err != nil {
+		return nil, fmt.Errorf("newTorrent: url-list: %w", err)
+	}
+
+	var urls []string
+	for i, urlValue := range list {
+		url, err := bencode.GetString(urlValue)
+		if err != nil {
+			return nil, fmt.Errorf("newTorrent: url-list entry %d: %w", i, err)
+		}
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
 }
 
-// DeserializeTorrent reads and parses a .torrent file from disk.
+// DeserializeTorrent reads and parses a .torrent file from disk, or downloads
+// it first if filePath is an http:// or https:// URL.
 func DeserializeTorrent(filePath string) (*TorrentFile, error) {
+	if isTorrentURL(filePath) {
+		contents, err := fetchTorrent(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching torrent file: %w", err)
+		}
+		return DeserializeTorrentBytes(contents)
+	}
+
 	contents, err := parseTorrent(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing torrent file: %w", err)
 	}
-	decoded, err := bencode.Decode(contents)
+	return DeserializeTorrentBytes(contents)
+}
+
+// DeserializeTorrentBytes parses the contents of a .torrent file already in
+// memory. The info hash is computed over contents, so it must not be modified
+// afterwards.
+func DeserializeTorrentBytes(contents []byte) (*TorrentFile, error) {
+	decoded, spans, err := bencode.DecodeDictSpans(contents)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding torrent file path contents: %w", err)
 	}
 
-	return newTorrentFile(decoded)
+	var rawInfo []byte
+	if span, ok := spans["info"]; ok {
+		rawInfo = contents[span.Start:span.End]
+	}
+	return newTorrentFile(decoded, rawInfo)
 }
 
 // String returns a string representation of the torrent file
@@ -94,6 +211,22 @@ func (t TorrentFile) String() string {
 		}
 	}
 
+	if t.Info.Private {
+		filesInfo = "Private: yes\n" + filesInfo
+	}
+	if t.Encoding != "" {
+		filesInfo = fmt.Sprintf("Encoding: %s\n", t.Encoding) + filesInfo
+	}
+	if !t.CreationDate.IsZero() {
+		filesInfo = fmt.Sprintf("Creation Date: %s\n", t.CreationDate.UTC().Format(time.RFC1123)) + filesInfo
+	}
+	if t.CreatedBy != "" {
+		filesInfo = fmt.Sprintf("Created By: %s\n", t.CreatedBy) + filesInfo
+	}
+	if t.Comment != "" {
+		filesInfo = fmt.Sprintf("Comment: %s\n", t.Comment) + filesInfo
+	}
+
 	return fmt.Sprintf(
 		"Tracker URL: %s\nLength: %d\nInfo Hash: %x\nPiece Length: %d\n%s\nPiece Hashes:\n%s",
 		t.Announce, t.Info.Length, t.Info.getInfoHash(), t.Info.PieceLength,
@@ -102,16 +235,79 @@ func (t TorrentFile) String() string {
 	)
 }
 
-// GetPeers sends a request to the tracker to obtain peers for file download
-func (t TorrentFile) GetPeers() ([]netip.AddrPort, error) {
-	trackerURL := t.Announce
-	infoHash := URLEncodeInfoHash(t.Info.GetHexInfoHash())
+// GetPeers sends a request to the tracker to obtain peers for file download.
+// Trackers are tried tier by tier, in order, until one returns peers. If none
+// has any, the error wraps tracker.ErrNoPeers.
+func (t TorrentFile) GetPeers(opts ...tracker.RequestOption) (tracker.Peers, error) {
+	swarm, err := t.GetTierSwarm(opts...)
+	return swarm.Peers, err
+}
 
-	treq := tracker.NewTrackerRequest(trackerURL, infoHash, t.Info.Length)
-	tres, err := treq.SendRequest()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get peers from tracker: %w", err)
+// GetTierSwarm is GetPeers, also returning the swarm's size as reported by
+// the tracker that answered
+func (t TorrentFile) GetTierSwarm(opts ...tracker.RequestOption) (Swarm, error) {
+	var errs []error
+	for _, trackerURL := range t.TrackerURLs() {
+		tres, err := t.AnnounceTo(trackerURL, tracker.EventStarted, 0, 0, t.Info.Length, opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+			continue
+		}
+		return Swarm{Peers: tres.Peers, Seeders: tres.Seeders, Leechers: tres.Leechers}, nil
+	}
+
+	return Swarm{}, fmt.Errorf("failed to get peers from tracker: %w", errors.Join(errs...))
+}
+
+// AnnounceEvent reports a lifecycle event (see tracker.EventCompleted and
+// tracker.EventStopped), or a periodic re-announce with tracker.EventNone,
+// along with our transfer totals. Trackers are tried in order until one
+// accepts the announce, and its response is returned.
+func (t TorrentFile) AnnounceEvent(event string, uploaded, downloaded, left int,
+	opts ...tracker.RequestOption) (*tracker.TrackerResponse, error) {
+	var errs []error
+	for _, trackerURL := range t.TrackerURLs() {
+		tres, err := t.AnnounceTo(trackerURL, event, uploaded, downloaded, left, opts...)
+		if err != nil && !errors.Is(err, tracker.ErrNoPeers) {
+			errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+			continue
+		}
+		return tres, nil
+	}
+
+	return nil, fmt.Errorf("failed to announce to tracker: %w", errors.Join(errs...))
+}
+
+// AnnounceTo reports an event to a single tracker. Like
+// tracker.TrackerRequest.SendRequest, a response without peers comes back
+// together with tracker.ErrNoPeers.
+func (t TorrentFile) AnnounceTo(trackerURL, event string, uploaded, downloaded, left int,
+	opts ...tracker.RequestOption) (*tracker.TrackerResponse, error) {
+	treq := tracker.NewTrackerRequest(trackerURL, URLEncodeInfoHash(t.Info.GetHexInfoHash()), left)
+	treq.Event = event
+	treq.Uploaded = uploaded
+	treq.Downloaded = downloaded
+	for _, opt := range opts {
+		opt(treq)
 	}
+	return treq.SendRequest()
+}
 
-	return tres.Peers, nil
+// TrackerURLs flattens the tracker tiers into the order they should be tried,
+// listing each tracker once
+func (t TorrentFile) TrackerURLs() []string {
+	if len(t.Trackers) == 0 {
+		return []string{t.Announce}
+	}
+	var urls []string
+	seen := make(map[string]bool)
+	for _, tier := range t.Trackers {
+		for _, trackerURL := range tier {
+			if !seen[trackerURL] {
+				seen[trackerURL] = true
+				urls = append(urls, trackerURL)
+			}
+		}
+	}
+	return urls
 }
@@ -0,0 +1,95 @@
+package metainfo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// VerifyFile checks existing data on disk against the piece hashes and reports
+// which pieces are intact. For a single-file torrent path is the file itself;
+// for a multi-file torrent it is the directory holding the torrent's files.
+// Missing or short files simply fail the pieces they cover.
+func (i Info) VerifyFile(path string) ([]bool, error) {
+	files := i.GetFiles()
+	handles := make([]*os.File, len(files))
+	defer func() {
+		for _, f := range handles {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	for j, fileInfo := range files {
+		filePath := path
+		if !i.IsSingleFile() {
+			var err error
+			if filePath, err = SafeJoin(path, fileInfo.Path...); err != nil {
+				return nil, err
+			}
+		}
+		f, err := os.Open(filePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", filePath, err)
+		}
+		handles[j] = f
+	}
+
+	pieceHashes := i.PieceHashes()
+	valid := make([]bool, len(pieceHashes))
+	buf := make([]byte, i.PieceLength)
+
+	for index, hash := range pieceHashes {
+		begin := int64(index) * int64(i.PieceLength)
+		end := min(begin+int64(i.PieceLength), int64(i.Length))
+		piece := buf[:end-begin]
+
+		ok, err := readAcross(files, handles, piece, begin)
+		if err != nil {
+			return nil, err
+		}
+		valid[index] = ok && bytes.Equal(HashPiece(piece), hash)
+	}
+	return valid, nil
+}
+
+// readAcross fills p with the torrent data starting at the global offset off,
+// reading from whichever files it spans. It returns false if any of that data
+// is missing.
+func readAcross(files []FileInfo, handles []*os.File, p []byte, off int64) (bool, error) {
+	var fileStart int64
+	for j, fileInfo := range files {
+		fileEnd := fileStart + int64(fileInfo.Length)
+		if len(p) == 0 {
+			break
+		}
+		if off >= fileEnd {
+			fileStart = fileEnd
+			continue
+		}
+
+		n := min(int64(len(p)), fileEnd-off)
+		if handles[j] == nil {
+			return false, nil
+		}
+		_, err := handles[j].ReadAt(p[:n], off-fileStart)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error reading %s: %w", handles[j].Name(), err)
+		}
+
+		p = p[n:]
+		off += n
+		fileStart = fileEnd
+	}
+	return len(p) == 0, nil
+}
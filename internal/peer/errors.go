@@ -0,0 +1,23 @@
+package peer
+
+import "errors"
+
+// ErrChoked is returned when the peer chokes us while requests are outstanding.
+// The peer discards those requests, so they must be re-sent after an unchoke.
+var ErrChoked = errors.New("peer choked us")
+
+// ErrRejected is returned when a peer using the Fast Extension rejects one of
+// our block requests. The piece should be requested from another peer.
+var ErrRejected = errors.New("peer rejected request")
+
+// ErrMessageTooLarge is returned when a peer announces a message longer than
+// MaxMessageLength, which would otherwise force a huge allocation.
+var ErrMessageTooLarge = errors.New("peer message too large")
+
+// ErrPeerIDMismatch is returned when a peer's handshake carries a different
+// peer ID from the one the tracker gave for its address.
+var ErrPeerIDMismatch = errors.New("handshake peer id does not match")
+
+// ErrPeerDisconnected is returned when the peer closes or resets the
+// connection, which is normal churn rather than a protocol error.
+var ErrPeerDisconnected = errors.New("peer disconnected")
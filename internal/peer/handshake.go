@@ -28,6 +28,7 @@ func constructHandshakeMessage(infoHash [20]byte, ext bool) ([]byte, error) {
 	if ext {
 		message[25] = internal.ExtensionID
 	}
+	message[20+internal.FastBitPosition] = internal.FastID
 
 	return message, nil
 }
@@ -41,6 +42,7 @@ func constructMagnetHandshakeMessage(infoHash [20]byte) []byte {
 	// Indicate extension support
 	reserved := make([]byte, 8)
 	reserved[internal.ExtensionBitPosition] = internal.ExtensionID
+	reserved[internal.FastBitPosition] = internal.FastID
 	copy(message[20:28], reserved)
 
 	copy(message[28:48], infoHash[:])
@@ -49,13 +51,38 @@ func constructMagnetHandshakeMessage(infoHash [20]byte) []byte {
 	return message
 }
 
+// supportsFast reports whether the handshake advertises the Fast Extension
+func (h *Handshake) supportsFast() bool {
+	return h.Reserved[internal.FastBitPosition]&internal.FastID != 0
+}
+
 type ExtensionHandshakeResponse struct {
 	MetadataSize     int
 	UtMetadataID     int
 	ExtensionMapping map[string]int
 }
 
-func parseExtensionHandshake(payload []byte) (*ExtensionHandshakeResponse, error) {
+// ParseExtensionHandshake decodes a BEP 10 handshake payload, including the
+// leading extended message id. The peer must support ut_metadata.
+func ParseExtensionHandshake(payload []byte) (*ExtensionHandshakeResponse, error) {
+	response, err := decodeExtensionHandshake(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.UtMetadataID == 0 {
+		return nil, fmt.Errorf("peer does not support ut_metadata extension")
+	}
+
+	return response, nil
+}
+
+// decodeExtensionHandshake decodes a BEP 10 handshake payload whatever
+// extensions the peer supports
+func decodeExtensionHandshake(payload []byte) (*ExtensionHandshakeResponse, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("extension handshake too short")
+	}
 	decoded, err := bencode.Decode(payload[1:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode extension handshake: %w", err)
@@ -85,9 +112,5 @@ func parseExtensionHandshake(payload []byte) (*ExtensionHandshakeResponse, error
 		}
 	}
 
-	if response.UtMetadataID == 0 {
-		return nil, fmt.Errorf("peer does not support ut_metadata extension")
-	}
-
 	return response, nil
 }
@@ -0,0 +1,99 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// UtMetadataID is the extended message id we ask peers to use when sending
+// us ut_metadata messages
+const UtMetadataID = 1
+
+// ut_metadata message types (BEP 9)
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// SendExtensionHandshake advertises ut_metadata if we can serve an info dict
+// of metadataSize bytes, and ut_pex if pex is set
+func (p *Peer) SendExtensionHandshake(metadataSize int, pex bool) error {
+	payload, err := p.extensionHandshakePayload(metadataSize > 0, metadataSize, pex)
+	if err != nil {
+		return err
+	}
+	return p.WriteMessage(internal.MessageExtension, payload)
+}
+
+// extensionHandshakePayload builds our BEP 10 handshake: the extensions we
+// accept in "m", metadata_size when we have metadata to serve, and our listen
+// port and client version
+func (p *Peer) extensionHandshakePayload(utMetadata bool, metadataSize int, pex bool) ([]byte, error) {
+	m := map[string]interface{}{}
+	if utMetadata {
+		m["ut_metadata"] = UtMetadataID
+	}
+	if pex {
+		m["ut_pex"] = UtPexID
+	}
+	handshake := map[string]interface{}{
+		"m": m,
+		"v": internal.ClientVersion,
+	}
+	if metadataSize > 0 {
+		handshake["metadata_size"] = metadataSize
+	}
+	if p.ListenPort > 0 {
+		handshake["p"] = p.ListenPort
+	}
+
+	dict, err := bencode.Encode(handshake)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding extension handshake: %w", err)
+	}
+	return append([]byte{0}, dict...), nil
+}
+
+// ServeMetadataRequest answers a ut_metadata request with the requested 16KB
+// piece of metadata, or a reject if the piece is out of range or we have no
+// metadata. payload is the extension message payload, starting with our
+// UtMetadataID, and utMetadataID is the id the peer asked us to use. Messages
+// other than requests are ignored.
+func (p *Peer) ServeMetadataRequest(utMetadataID int, payload, metadata []byte) error {
+	if len(payload) < 2 {
+		return fmt.Errorf("metadata message too short")
+	}
+	var msg struct {
+		MsgType int  `bencode:"msg_type"`
+		Piece   *int `bencode:"piece"`
+	}
+	if err := bencode.Unmarshal(payload[1:], &msg); err != nil {
+		return fmt.Errorf("failed to decode metadata message: %w", err)
+	}
+	if msg.MsgType != metadataRequest {
+		return nil
+	}
+	if msg.Piece == nil {
+		return fmt.Errorf("no piece index in metadata request")
+	}
+	piece := *msg.Piece
+
+	begin := piece * internal.MetadataPieceSize
+	reply := map[string]interface{}{"msg_type": metadataReject, "piece": piece}
+	var data []byte
+	if len(metadata) > 0 && piece >= 0 && begin < len(metadata) {
+		reply["msg_type"] = metadataData
+		reply["total_size"] = len(metadata)
+		data = metadata[begin:min(begin+internal.MetadataPieceSize, len(metadata))]
+	}
+
+	encoded, err := bencode.Encode(reply)
+	if err != nil {
+		return fmt.Errorf("error encoding metadata reply: %w", err)
+	}
+	message := append([]byte{byte(utMetadataID)}, encoded...)
+	return p.WriteMessage(internal.MessageExtension, append(message, data...))
+}
@@ -0,0 +1,76 @@
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+)
+
+// serveMetadata has a client request a metadata piece over a pipe from a
+// peer holding metadata, and returns the reply the client parsed
+func serveMetadata(t *testing.T, metadata []byte, piece int) (*metainfo.MetadataPiece, error) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	client, server := &Peer{Conn: clientConn}, &Peer{Conn: serverConn}
+
+	const serverUtMetadataID = 3
+	serveErr := make(chan error, 1)
+	go func() {
+		msg, err := server.ReadMessage()
+		if err == nil {
+			if msg.ID != internal.MessageExtension || msg.Payload[0] != serverUtMetadataID {
+				t.Errorf("server got message %d for extension %d", msg.ID, msg.Payload[0])
+			}
+			err = server.ServeMetadataRequest(UtMetadataID, msg.Payload, metadata)
+		}
+		serveErr <- err
+	}()
+
+	got, err := client.RequestMetadataPiece(serverUtMetadataID, piece)
+	if serr := <-serveErr; serr != nil {
+		t.Fatalf("ServeMetadataRequest: %v", serr)
+	}
+	return got, err
+}
+
+func TestServeMetadataRequest(t *testing.T) {
+	metadata := bytes.Repeat([]byte("0123456789"), 2000)
+
+	tests := []struct {
+		piece int
+		begin int
+		end   int
+	}{
+		{piece: 0, begin: 0, end: internal.MetadataPieceSize},
+		{piece: 1, begin: internal.MetadataPieceSize, end: len(metadata)},
+	}
+	for _, tt := range tests {
+		got, err := serveMetadata(t, metadata, tt.piece)
+		if err != nil {
+			t.Fatalf("piece %d: %v", tt.piece, err)
+		}
+		if got.Piece != tt.piece || got.TotalSize != len(metadata) {
+			t.Errorf("piece %d: got piece %d of total_size %d", tt.piece, got.Piece, got.TotalSize)
+		}
+		if !bytes.Equal(got.Data, metadata[tt.begin:tt.end]) {
+			t.Errorf("piece %d: got %d bytes that don't match the metadata", tt.piece, len(got.Data))
+		}
+	}
+}
+
+func TestServeMetadataRequestReject(t *testing.T) {
+	metadata := bytes.Repeat([]byte("x"), 100)
+
+	if _, err := serveMetadata(t, metadata, 1); !errors.Is(err, metainfo.ErrMetadataRejected) {
+		t.Errorf("piece past the metadata: got %v, want a reject", err)
+	}
+	if _, err := serveMetadata(t, nil, 0); !errors.Is(err, metainfo.ErrMetadataRejected) {
+		t.Errorf("no metadata: got %v, want a reject", err)
+	}
+}
@@ -2,16 +2,22 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/bits"
 	"net"
 	"net/netip"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
 )
 
 // Peer represents a network connection to another BitTorrent client.
@@ -19,10 +25,74 @@ type Peer struct {
 	AddrPort *netip.AddrPort
 	ID       [20]byte
 
+	// ExpectedID, if set, is the peer ID the tracker listed for this address;
+	// Handshake refuses a peer answering with any other. Compact peer lists
+	// carry no IDs, so it is usually zero and unchecked.
+	ExpectedID [20]byte
+
+	// Source is where the peer's address was learned
+	Source tracker.PeerSource
+
 	Conn   net.Conn
 	Choked bool
 
 	Bitfield BitField
+
+	// Fast is set when both sides negotiated the Fast Extension (BEP 6),
+	// which allows Have All, Have None and Reject Request messages.
+	// NumPieces sizes the bitfield a Have All expands to, and is what the
+	// peer's bitfield and have messages are checked against; while it is 0,
+	// e.g. before a magnet's metadata arrives, haves are only held to
+	// MaxPieces from the internal package.
+	Fast      bool
+	NumPieces int
+
+	// ReadTimeout bounds each read from the peer, so one that goes silent
+	// fails instead of blocking forever; 0 means no limit
+	ReadTimeout time.Duration
+
+	// ConnectTimeout bounds the TCP dial in Connect; 0 uses ConnectionTimeout
+	// from the internal package
+	ConnectTimeout time.Duration
+
+	// PipelineDepth is how many block requests GetPiece keeps in flight and
+	// BlockSize how large each one is; zero values use MaxPipelineRequests
+	// and BlockSize from the internal package
+	PipelineDepth int
+	BlockSize     uint32
+
+	// Limiter, if set, throttles block requests to cap download throughput
+	Limiter Limiter
+
+	// PexID is the id the peer wants its ut_pex messages sent with; 0 until
+	// its extension handshake arrives, or if it doesn't support PEX
+	PexID int
+
+	// Extensions is the peer's extension handshake, once it has arrived
+	Extensions *ExtensionHandshakeResponse
+
+	// OnPex, if set, receives the peers announced in the peer's PEX messages
+	OnPex func(added []netip.AddrPort)
+
+	// ListenPort is the port we accept peers on, advertised as "p" in our
+	// extension handshake; 0 leaves it out
+	ListenPort int
+
+	writeMu   sync.Mutex // serializes writes from the worker and its keep-alive loop
+	lastWrite time.Time
+}
+
+// FromInfo returns an unconnected peer for a descriptor from a tracker, the
+// DHT or PEX, expecting the peer ID the tracker listed for it, if any
+func FromInfo(info tracker.PeerInfo) *Peer {
+	addr := info.AddrPort
+	return &Peer{AddrPort: &addr, ExpectedID: info.ID, Source: info.Source}
+}
+
+// Limiter paces downloads. WaitN blocks until n more bytes may be requested,
+// returning early with ctx's error if ctx is done first.
+type Limiter interface {
+	WaitN(ctx context.Context, n int) error
 }
 
 // BitField is a compact representation of which pieces a peer has.
@@ -37,7 +107,11 @@ type PeerMessage struct {
 
 // Connect establishes a TCP connection to the peer
 func (p *Peer) Connect() error {
-	conn, err := net.DialTimeout("tcp", p.AddrPort.String(), internal.ConnectionTimeout*time.Second)
+	timeout := p.ConnectTimeout
+	if timeout <= 0 {
+		timeout = internal.ConnectionTimeout * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", p.AddrPort.String(), timeout)
 	if err != nil {
 		return fmt.Errorf("error connecting to peer: %w", err)
 	}
@@ -45,40 +119,121 @@ func (p *Peer) Connect() error {
 	return nil
 }
 
+// Close closes the connection to the peer, if there is one
+func (p *Peer) Close() error {
+	if p.Conn == nil {
+		return nil
+	}
+	return p.Conn.Close()
+}
+
+// Addr returns the peer's address
+func (p *Peer) Addr() netip.AddrPort {
+	return *p.AddrPort
+}
+
+// IsChoked reports whether the peer is choking us
+func (p *Peer) IsChoked() bool {
+	return p.Choked
+}
+
+// Pieces returns the pieces the peer has told us it has
+func (p *Peer) Pieces() BitField {
+	return p.Bitfield
+}
+
 // Handshake performs the BitTorrent handshake with a peer.
 func (p *Peer) Handshake(infoHash [20]byte, ext bool) (*Handshake, error) {
-	c := p.Conn
 	message, err := constructHandshakeMessage(infoHash, ext)
 	if err != nil {
 		return nil, fmt.Errorf("error constructing peer handshake message: %w", err)
 	}
-	_, err = c.Write(message)
+	err = p.write(message)
 	if err != nil {
 		return nil, fmt.Errorf("error writing peer handshake message to connection: %w", err)
 	}
+	p.setReadDeadline()
 	h, err := readHandshake(p.Conn)
 	if err != nil {
 		return nil, err
 	}
 	if infoHash != h.InfoHash {
-		return h, fmt.Errorf("handshake info hash does not match torrent info hash: %w", err)
-
+		return h, fmt.Errorf("handshake info hash does not match torrent info hash")
+	}
+	if err = p.checkPeerID(h); err != nil {
+		return h, err
 	}
 
 	copy(p.ID[:], h.PeerID[:])
+	p.Fast = h.supportsFast()
+	if err = p.sendHaveNone(); err != nil {
+		return h, err
+	}
 
 	return h, nil
 }
 
+// sendHaveNone tells a Fast Extension peer we have no pieces to offer. BEP 6
+// requires a bitfield, have all or have none as the first message once the
+// extension is negotiated, and an outbound connection only downloads.
+func (p *Peer) sendHaveNone() error {
+	if !p.Fast {
+		return nil
+	}
+	if err := p.WriteMessage(internal.MessageHaveNone, nil); err != nil {
+		return fmt.Errorf("error sending have none: %w", err)
+	}
+	return nil
+}
+
+// checkPeerID compares the handshake's peer ID with ExpectedID, if set
+func (p *Peer) checkPeerID(h *Handshake) error {
+	if p.ExpectedID != [20]byte{} && h.PeerID != p.ExpectedID {
+		return fmt.Errorf("%w: got %x, want %x", ErrPeerIDMismatch, h.PeerID, p.ExpectedID)
+	}
+	return nil
+}
+
+// Accept answers the handshake of an inbound connection. The remote peer
+// speaks first; its info hash must match ours before we reply.
+func Accept(conn net.Conn, infoHash [20]byte) (*Peer, *Handshake, error) {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing remote address: %w", err)
+	}
+	p := &Peer{AddrPort: &addrPort, Conn: conn}
+
+	h, err := readHandshake(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.InfoHash != infoHash {
+		return nil, h, fmt.Errorf("inbound handshake for unknown info hash %x", h.InfoHash)
+	}
+	copy(p.ID[:], h.PeerID[:])
+	p.Fast = h.supportsFast()
+
+	// Only advertise the extension protocol to peers that speak it
+	ext := h.Reserved[internal.ExtensionBitPosition]&internal.ExtensionID != 0
+	message, err := constructHandshakeMessage(infoHash, ext)
+	if err != nil {
+		return nil, h, fmt.Errorf("error constructing peer handshake message: %w", err)
+	}
+	if err = p.write(message); err != nil {
+		return nil, h, fmt.Errorf("error writing peer handshake message to connection: %w", err)
+	}
+	return p, h, nil
+}
+
 func (p *Peer) MagnetHandshake(infoHash [20]byte) (*Handshake, error) {
-	c := p.Conn
 	message := constructMagnetHandshakeMessage(infoHash)
 
-	_, err := c.Write(message)
+	err := p.write(message)
 	if err != nil {
 		return nil, fmt.Errorf("error writing magnet handshake message: %w", err)
 	}
 
+	p.setReadDeadline()
 	h, err := readHandshake(p.Conn)
 	if err != nil {
 		return nil, err
@@ -87,31 +242,55 @@ func (p *Peer) MagnetHandshake(infoHash [20]byte) (*Handshake, error) {
 	if !bytes.Equal(infoHash[:], h.InfoHash[:]) {
 		return nil, fmt.Errorf("handshake info hash mismatch")
 	}
+	if err = p.checkPeerID(h); err != nil {
+		return nil, err
+	}
 
 	copy(p.ID[:], h.PeerID[:])
+	p.Fast = h.supportsFast()
 
 	// Check if peer supports extension protocol
 	if h.Reserved[internal.ExtensionBitPosition]&internal.ExtensionID == 0 {
 		return nil, fmt.Errorf("peer does not support extension protocol")
 	}
+	if err = p.sendHaveNone(); err != nil {
+		return nil, err
+	}
 
 	return h, nil
 }
 
+// ExtensionHandshake sends our extension handshake and returns the peer's,
+// which must support ut_metadata. A handshake the peer sent earlier, e.g.
+// while we read its bitfield, is used as is; otherwise messages are read
+// until it arrives, recording any haves and skipping anything else.
 func (p *Peer) ExtensionHandshake() (*ExtensionHandshakeResponse, error) {
-	payload := append([]byte{0}, []byte("d1:md11:ut_metadatai1eee")...)
-
-	// Message ID 20 for extension protocol
-	msg, err := p.SendMessage(20, payload)
+	payload, err := p.extensionHandshakePayload(true, 0, true)
 	if err != nil {
+		return nil, err
+	}
+	if err = p.WriteMessage(internal.MessageExtension, payload); err != nil {
 		return nil, fmt.Errorf("failed to send extension handshake: %w", err)
 	}
 
-	if msg.ID != internal.MessageExtension {
-		return nil, fmt.Errorf("expected extension message (20), got %d", msg.ID)
+	for p.Extensions == nil {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extension handshake: %w", err)
+		}
+		switch msg.ID {
+		case internal.MessageExtension:
+			p.handleExtension(msg)
+		case internal.MessageHave:
+			if err = p.handleHave(msg); err != nil {
+				return nil, err
+			}
+		}
 	}
-
-	return parseExtensionHandshake(msg.Payload)
+	if p.Extensions.UtMetadataID == 0 {
+		return nil, fmt.Errorf("peer does not support ut_metadata extension")
+	}
+	return p.Extensions, nil
 }
 
 // readHandshake reads and parses a handshake message from the connection
@@ -148,15 +327,25 @@ func readHandshake(conn net.Conn) (*Handshake, error) {
 
 	// Validate handshake message
 	if h.PstrLen != internal.ProtocolStringLength || string(h.Pstr[:]) != internal.ProtocolString {
-		fmt.Println(string(h.Pstr[:]))
-		err = fmt.Errorf("invalid handshake: %w", err)
+		return h, fmt.Errorf("invalid handshake: protocol %q", h.Pstr[:])
 	}
-	return h, err
+	return h, nil
 }
 
 // SendMessage sends a message to the peer and waits for a response.
 // Used for messages that expect an immediate reply.
 func (p *Peer) SendMessage(messageID byte, payload []byte) (*PeerMessage, error) {
+	if err := p.WriteMessage(messageID, payload); err != nil {
+		return nil, err
+	}
+
+	response, err := p.ReadMessage()
+
+	return response, err
+}
+
+// WriteMessage sends a message to the peer without waiting for a response.
+func (p *Peer) WriteMessage(messageID byte, payload []byte) error {
 	length := uint32(len(payload) + 1)
 	message := make([]byte, 4+length)
 
@@ -164,31 +353,60 @@ func (p *Peer) SendMessage(messageID byte, payload []byte) (*PeerMessage, error)
 	message[4] = messageID
 	copy(message[5:], payload)
 
-	if _, err := p.Conn.Write(message); err != nil {
-		return nil, err
-	}
+	return p.write(message)
+}
 
-	response, err := p.ReadMessage()
+// SendKeepAlive sends a zero-length message so the peer doesn't drop an idle connection.
+func (p *Peer) SendKeepAlive() error {
+	return p.write(make([]byte, 4))
+}
 
-	return response, err
+// IdleFor returns how long it has been since we last wrote to the peer.
+func (p *Peer) IdleFor() time.Duration {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return time.Since(p.lastWrite)
+}
+
+// write sends raw bytes to the peer. Writes are serialized so a background
+// keep-alive can't interleave with a message.
+func (p *Peer) write(b []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if _, err := p.Conn.Write(b); err != nil {
+		return err
+	}
+	p.lastWrite = time.Now()
+	return nil
 }
 
 // ReadMessage reads one complete message from the peer.
-// Blocks until a full message is received.
+// Blocks until a full message is received. Zero-length keep-alive frames are
+// returned as a message with ID MessageKeepAlive and no payload.
 func (p *Peer) ReadMessage() (*PeerMessage, error) {
 	var err error
+	p.setReadDeadline()
 	lenBytes := make([]byte, 4)
 	if _, err = io.ReadFull(p.Conn, lenBytes); err != nil {
-		return nil, fmt.Errorf("error reading length of peer message: %w", err)
+		return nil, readError("error reading length of peer message", err)
 	}
 
 	length := binary.BigEndian.Uint32(lenBytes)
+	if length == 0 {
+		// Keep-alive: no ID, no payload
+		return &PeerMessage{ID: internal.MessageKeepAlive}, nil
+	}
+	if length > internal.MaxMessageLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, length)
+	}
+
 	buf := make([]byte, length)
 	r := bytes.NewReader(buf)
 
 	_, err = io.ReadFull(p.Conn, buf)
 	if err != nil {
-		return nil, fmt.Errorf("error reading data stream into buffer: %w", err)
+		return nil, readError("error reading data stream into buffer", err)
 	}
 	id, err := r.ReadByte()
 	if err != nil {
@@ -208,19 +426,83 @@ func (p *Peer) ReadMessage() (*PeerMessage, error) {
 
 }
 
-// ReadBitfield reads and stores the peer's bitfield message.
-func (p *Peer) ReadBitfield() (*PeerMessage, error) {
-	msg, err := p.ReadMessage()
-	if err != nil {
-		return msg, fmt.Errorf("failed to read bitfield: %w", err)
+// readError wraps a failed read from the peer, marking the peer closing or
+// resetting the connection with ErrPeerDisconnected
+func readError(msg string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return fmt.Errorf("%s: %w: %w", msg, ErrPeerDisconnected, err)
 	}
-	if msg.ID != internal.MessageBitfield {
-		return msg, fmt.Errorf("expected bitfield (5), got %d", msg.ID)
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// setReadDeadline gives the next read ReadTimeout to complete
+func (p *Peer) setReadDeadline() {
+	if p.ReadTimeout > 0 {
+		p.Conn.SetReadDeadline(time.Now().Add(p.ReadTimeout))
+	}
+}
+
+// ReadBitfield reads and stores the peer's bitfield message. Extension, have
+// and choke messages the peer sends first are handled along the way, with
+// haves kept on top of the bitfield once it arrives.
+func (p *Peer) ReadBitfield() (*PeerMessage, error) {
+	for {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			return msg, fmt.Errorf("failed to read bitfield: %w", err)
+		}
+
+		switch msg.ID {
+		case internal.MessageExtension:
+			p.handleExtension(msg)
+		case internal.MessageHave:
+			if err = p.handleHave(msg); err != nil {
+				return msg, err
+			}
+		case internal.MessageChoke:
+			p.Choked = true
+		case internal.MessageUnchoke:
+			p.Choked = false
+		default:
+			ok, err := p.handleBitfield(msg)
+			if err != nil {
+				return msg, err
+			}
+			if !ok {
+				return msg, fmt.Errorf("expected bitfield (5), got %d", msg.ID)
+			}
+			return msg, nil
+		}
 	}
+}
 
-	p.Bitfield = msg.Payload
+// handleBitfield applies a bitfield, or a have all or have none message from
+// a fast extension peer, keeping any pieces already announced with have
+// messages. It reports false for any other message.
+func (p *Peer) handleBitfield(msg *PeerMessage) (bool, error) {
+	haves := p.Bitfield
+	switch {
+	case msg.ID == internal.MessageBitfield:
+		if err := p.setBitfield(msg.Payload); err != nil {
+			return true, err
+		}
+	case msg.ID == internal.MessageHaveAll && p.Fast:
+		p.Bitfield = NewBitField(p.NumPieces)
+		for i := range p.NumPieces {
+			p.Bitfield.SetPiece(i)
+		}
+	case msg.ID == internal.MessageHaveNone && p.Fast:
+		p.Bitfield = NewBitField(p.NumPieces)
+	default:
+		return false, nil
+	}
 
-	return msg, nil
+	for i := range len(haves) * 8 {
+		if haves.HasPiece(i) {
+			p.ApplyHave(uint32(i))
+		}
+	}
+	return true, nil
 }
 
 // SendInterested sends a message to the peer communicating we're interested in downloading from them
@@ -228,6 +510,38 @@ func (p *Peer) SendInterested() (*PeerMessage, error) {
 	return p.SendMessage(2, nil)
 }
 
+// AwaitUnchoke reads messages until the peer unchokes us, tracking choke state
+// along the way. Peers commonly send have messages or keep us choked for a
+// while after we declare interest, and some send their bitfield late or not
+// at all, so pieces announced either way are recorded and anything else is
+// skipped.
+func (p *Peer) AwaitUnchoke() error {
+	for {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("error waiting for unchoke: %w", err)
+		}
+
+		switch msg.ID {
+		case internal.MessageUnchoke:
+			p.Choked = false
+			return nil
+		case internal.MessageChoke:
+			p.Choked = true
+		case internal.MessageHave:
+			if err = p.handleHave(msg); err != nil {
+				return err
+			}
+		case internal.MessageExtension:
+			p.handleExtension(msg)
+		default:
+			if _, err = p.handleBitfield(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // SendRequest requests a specific block from a piece.
 // index: which piece, begin: byte offset within piece, block: number of bytes
 func (p *Peer) SendRequest(index, begin, block uint32) (*PeerMessage, error) {
@@ -258,6 +572,17 @@ func (p *Peer) constructPieceRequest(index, begin, length uint32) []byte {
 
 }
 
+// SendCancel tells the peer we no longer want a block we requested.
+// The payload has the same shape as a request: index, begin, length.
+func (p *Peer) SendCancel(index, begin, length uint32) error {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], index)
+	binary.BigEndian.PutUint32(payload[4:8], begin)
+	binary.BigEndian.PutUint32(payload[8:12], length)
+
+	return p.WriteMessage(internal.MessageCancel, payload)
+}
+
 // BlockRequest represents a single block request within a piece
 type BlockRequest struct {
 	Index  uint32
@@ -265,82 +590,180 @@ type BlockRequest struct {
 	Length uint32
 }
 
+// BlockRequests splits a piece into requests of blockSize bytes, the last
+// possibly shorter. A zero blockSize uses BlockSize from the internal package.
+func BlockRequests(pieceIndex, pieceLength, blockSize uint32) []BlockRequest {
+	if blockSize == 0 {
+		blockSize = internal.BlockSize
+	}
+
+	var requests []BlockRequest
+	var begin uint32 = 0
+	remaining := pieceLength
+
+	for remaining > 0 {
+		blockLen := blockSize
+		if remaining < blockSize {
+			blockLen = remaining
+		}
+
+		requests = append(requests, BlockRequest{
+			Index:  pieceIndex,
+			Begin:  begin,
+			Length: blockLen,
+		})
+
+		begin += blockLen
+		remaining -= blockLen
+	}
+	return requests
+}
+
 // sendRequestOnly sends a request without waiting for a response.
 // Used in pipelining to send multiple requests back-to-back.
 func (p *Peer) sendRequestOnly(index, begin, length uint32) error {
 	request := p.constructPieceRequest(index, begin, length)
 
-	if _, err := p.Conn.Write(request); err != nil {
+	if err := p.write(request); err != nil {
 		return fmt.Errorf("error writing request to connection: %w", err)
 	}
 
 	return nil
 }
 
-// getBlocks downloads multiple blocks using TCP pipelining.
-// Pipelining allows us to send up to MaxPipelineRequests without waiting,
+// GetBlocks downloads multiple blocks using TCP pipelining.
+// Pipelining allows us to send up to PipelineDepth requests without waiting,
 // keeping the connection busy and dramatically improving download speed.
-func (p *Peer) getBlocks(requests []BlockRequest) ([][]byte, error) {
+// Blocks may arrive in any order and are matched to their request by piece
+// index and offset; a block nobody asked for is an error.
+// If ctx is cancelled, blocks still in flight are cancelled with the peer.
+func (p *Peer) GetBlocks(ctx context.Context, requests []BlockRequest) ([][]byte, error) {
 	numBlocks := len(requests)
 	blocks := make([][]byte, numBlocks)
 
+	depth := p.PipelineDepth
+	if depth <= 0 {
+		depth = internal.MaxPipelineRequests
+	}
+
 	requested := 0
 	received := 0
+	inFlight := make(map[[2]uint32]int) // request position by piece index and offset
+
+	// outstanding lists the requests sent but not yet answered
+	outstanding := func() []BlockRequest {
+		var reqs []BlockRequest
+		for _, i := range inFlight {
+			reqs = append(reqs, requests[i])
+		}
+		return reqs
+	}
+
+	// Unblock the read below as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		p.Conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
 
 	for received < numBlocks {
-		for requested < numBlocks && requested-received < internal.MaxPipelineRequests {
+		for requested < numBlocks && requested-received < depth {
 			req := requests[requested]
 
+			if p.Limiter != nil {
+				if err := p.Limiter.WaitN(ctx, int(req.Length)); err != nil {
+					p.cancelBlocks(outstanding())
+					return nil, err
+				}
+			}
 			if err := p.sendRequestOnly(req.Index, req.Begin, req.Length); err != nil {
 				return nil, fmt.Errorf("error sending request for block %d: %w", requested, err)
 			}
+			inFlight[[2]uint32{req.Index, req.Begin}] = requested
 			requested++
 		}
+		if ctx.Err() != nil {
+			p.cancelBlocks(outstanding())
+			return nil, ctx.Err()
+		}
 		msg, err := p.ReadMessage()
 		if err != nil {
+			if ctx.Err() != nil {
+				p.cancelBlocks(outstanding())
+				return nil, ctx.Err()
+			}
 			return nil, fmt.Errorf("error reading message for block %d: %w", received, err)
 		}
-		if msg.ID != internal.MessagePiece {
-			return nil, fmt.Errorf("expected piece message (7), got %d", msg.ID)
+		switch msg.ID {
+		case internal.MessagePiece:
+		case internal.MessageChoke:
+			// Outstanding requests are dropped by the peer once it chokes us
+			p.Choked = true
+			return nil, ErrChoked
+		case internal.MessageHave:
+			if err = p.handleHave(msg); err != nil {
+				return nil, err
+			}
+			continue
+		case internal.MessageExtension:
+			p.handleExtension(msg)
+			continue
+		case internal.MessageRejectRequest:
+			if !p.Fast || len(msg.Payload) != 12 {
+				continue
+			}
+			// The peer won't send this block, so the piece has to come from elsewhere
+			index := binary.BigEndian.Uint32(msg.Payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.Payload[4:8])
+			if _, ok := inFlight[[2]uint32{index, begin}]; ok {
+				p.cancelBlocks(outstanding())
+				return nil, fmt.Errorf("%w: piece %d begin %d", ErrRejected, index, begin)
+			}
+			continue
+		default:
+			// Have, unchoke and other messages may be interleaved with blocks
+			continue
 		}
 
 		if len(msg.Payload) < 8 {
 			return nil, fmt.Errorf("piece message payload too short: %d bytes", len(msg.Payload))
 		}
-
+		index := binary.BigEndian.Uint32(msg.Payload[0:4])
+		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
 		blockData := msg.Payload[8:]
-		blocks[received] = blockData
+
+		i, ok := inFlight[[2]uint32{index, begin}]
+		if !ok {
+			return nil, fmt.Errorf("unexpected block for piece %d at offset %d", index, begin)
+		}
+		if uint32(len(blockData)) != requests[i].Length {
+			return nil, fmt.Errorf("block for piece %d at offset %d has %d bytes, want %d",
+				index, begin, len(blockData), requests[i].Length)
+		}
+		delete(inFlight, [2]uint32{index, begin})
+		blocks[i] = blockData
 		received++
 	}
 	return blocks, nil
 }
 
-// GetPiece downloads and verifies a complete piece.
-// Breaks the piece into 16KB blocks and uses pipelining for download efficiency.
-func (p *Peer) GetPiece(pieceHash []byte, pieceLength, pieceIndex uint32) ([]byte, error) {
-	piece := make([]byte, 0, pieceLength)
-
-	var requests []BlockRequest
-	var begin uint32 = 0
-	remaining := pieceLength
-
-	for remaining > 0 {
-		blockLen := internal.BlockSize
-		if remaining < internal.BlockSize {
-			blockLen = remaining
+// cancelBlocks sends a cancel for each outstanding block request. Errors are
+// ignored: the connection is usually being abandoned anyway.
+func (p *Peer) cancelBlocks(requests []BlockRequest) {
+	for _, req := range requests {
+		if err := p.SendCancel(req.Index, req.Begin, req.Length); err != nil {
+			return
 		}
-
-		requests = append(requests, BlockRequest{
-			Index:  pieceIndex,
-			Begin:  begin,
-			Length: blockLen,
-		})
-
-		begin += blockLen
-		remaining -= blockLen
 	}
+}
+
+// GetPiece downloads and verifies a complete piece.
+// Breaks the piece into BlockSize blocks and uses pipelining for download efficiency.
+// Cancelling ctx aborts the download and cancels any in-flight block requests.
+func (p *Peer) GetPiece(ctx context.Context, pieceHash []byte, pieceLength, pieceIndex uint32) ([]byte, error) {
+	piece := make([]byte, 0, pieceLength)
 
-	blocks, err := p.getBlocks(requests)
+	requests := BlockRequests(pieceIndex, pieceLength, p.BlockSize)
+	blocks, err := p.GetBlocks(ctx, requests)
 	if err != nil {
 		return nil, fmt.Errorf("error downloading blocks: %w", err)
 	}
@@ -356,7 +779,9 @@ func (p *Peer) GetPiece(pieceHash []byte, pieceLength, pieceIndex uint32) ([]byt
 	return piece, nil
 }
 
-// RequestMetadataPiece requests a piece of the metadata
+// RequestMetadataPiece requests a piece of the metadata. Other messages
+// arriving before the reply, such as haves or PEX updates, are handled and
+// skipped.
 func (p *Peer) RequestMetadataPiece(utMetadataID byte, piece int) (*metainfo.MetadataPiece, error) {
 	// Build request message
 	request := fmt.Sprintf("d8:msg_typei0e5:piecei%dee", piece)
@@ -364,58 +789,78 @@ func (p *Peer) RequestMetadataPiece(utMetadataID byte, piece int) (*metainfo.Met
 	payload := append([]byte{utMetadataID}, []byte(request)...)
 
 	msg, err := p.SendMessage(20, payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send metadata request: %w", err)
+	for err == nil && !isMetadataMessage(msg) {
+		switch msg.ID {
+		case internal.MessageHave:
+			if err = p.handleHave(msg); err != nil {
+				return nil, err
+			}
+		case internal.MessageExtension:
+			p.handleExtension(msg)
+		}
+		msg, err = p.ReadMessage()
 	}
-
-	if msg.ID != internal.MessageExtension {
-		return nil, fmt.Errorf("expected extension message (20), got %d", msg.ID)
+	if err != nil {
+		return nil, fmt.Errorf("metadata request failed: %w", err)
 	}
 
 	return metainfo.ParseMetadataPiece(msg.Payload)
 }
 
-func (p *Peer) DownloadMetadata(magnet *metainfo.MagnetLink) (*metainfo.Info, error) {
-	// Perform extension handshake
-	extResp, err := p.ExtensionHandshake()
-	if err != nil {
-		return nil, fmt.Errorf("extension handshake failed: %w", err)
-	}
+// isMetadataMessage reports whether msg is a ut_metadata message sent to us
+func isMetadataMessage(msg *PeerMessage) bool {
+	return msg.ID == internal.MessageExtension && len(msg.Payload) > 0 && msg.Payload[0] == UtMetadataID
+}
 
-	if extResp.MetadataSize == 0 {
-		return nil, fmt.Errorf("peer reported metadata_size of 0")
+// DownloadMetadata fetches the magnet's info dict from this peer alone. Use
+// a MetadataDownload with FetchMetadata to spread it over several peers.
+func (p *Peer) DownloadMetadata(magnet *metainfo.MagnetLink) (*metainfo.Info, error) {
+	md := NewMetadataDownload(magnet.InfoHash)
+	if err := p.FetchMetadata(md); err != nil {
+		return nil, err
 	}
+	return md.Info()
+}
 
-	numPieces := (extResp.MetadataSize + internal.MetadataPieceSize - 1) / internal.MetadataPieceSize
-
-	fmt.Printf("Downloading metadata: %d bytes in %d pieces\n", extResp.MetadataSize, numPieces)
+// MetadataDownload collects a torrent's info dict piece by piece, so that
+// pieces one peer couldn't supply can be fetched from another
+type MetadataDownload struct {
+	infoHash [20]byte
+	metadata []byte
+	have     []bool
+}
 
-	// Download metadata pieces
-	metadata := make([]byte, 0, extResp.MetadataSize)
-	for i := 0; i < numPieces; i++ {
-		fmt.Printf("Requesting metadata piece %d/%d\n", i+1, numPieces)
+// NewMetadataDownload starts collecting the info dict with the given hash
+func NewMetadataDownload(infoHash [20]byte) *MetadataDownload {
+	return &MetadataDownload{infoHash: infoHash}
+}
 
-		piece, err := p.RequestMetadataPiece(byte(extResp.UtMetadataID), i)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get metadata piece %d: %w", i, err)
+// Complete reports whether every metadata piece has been received
+func (md *MetadataDownload) Complete() bool {
+	if md.metadata == nil {
+		return false
+	}
+	for _, ok := range md.have {
+		if !ok {
+			return false
 		}
-
-		metadata = append(metadata, piece.Data...)
 	}
+	return true
+}
 
-	// Trim to exact size
-	if len(metadata) > extResp.MetadataSize {
-		metadata = metadata[:extResp.MetadataSize]
+// Info verifies the collected metadata against the info hash and parses it
+func (md *MetadataDownload) Info() (*metainfo.Info, error) {
+	if !md.Complete() {
+		return nil, fmt.Errorf("metadata incomplete")
 	}
 
-	// Verify info hash
-	calculatedHash := metainfo.HashPiece(metadata)
-	if !bytes.Equal(calculatedHash, magnet.InfoHash[:]) {
+	calculatedHash := metainfo.HashPiece(md.metadata)
+	if !bytes.Equal(calculatedHash, md.infoHash[:]) {
 		return nil, fmt.Errorf("metadata hash mismatch")
 	}
 
 	// Decode metadata (it's a bencoded info dict)
-	decoded, err := bencode.Decode(metadata)
+	decoded, err := bencode.Decode(md.metadata)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode metadata: %w", err)
 	}
@@ -425,23 +870,191 @@ func (p *Peer) DownloadMetadata(magnet *metainfo.MagnetLink) (*metainfo.Info, er
 		return nil, fmt.Errorf("metadata is not a dictionary")
 	}
 
-	return metainfo.NewInfo(infoDict)
+	info, err := metainfo.NewInfo(infoDict)
+	if err != nil {
+		return nil, err
+	}
+	info.Raw = md.metadata
+	return info, nil
+}
+
+// FetchMetadata requests the pieces of md still missing from this peer. The
+// first peer's metadata_size sizes the download; later peers must agree. If
+// the peer rejects a piece or fails mid-way, the pieces received so far are
+// kept so another peer can supply the rest.
+func (p *Peer) FetchMetadata(md *MetadataDownload) error {
+	extResp, err := p.ExtensionHandshake()
+	if err != nil {
+		return fmt.Errorf("extension handshake failed: %w", err)
+	}
+
+	// The size bounds both our buffer and the number of pieces we request,
+	// so don't take a hostile peer's word for it
+	if extResp.MetadataSize <= 0 {
+		return fmt.Errorf("peer reported metadata_size of %d", extResp.MetadataSize)
+	}
+	if extResp.MetadataSize > internal.MaxMetadataSize {
+		return fmt.Errorf("peer reported metadata_size %d, more than the %d we accept",
+			extResp.MetadataSize, internal.MaxMetadataSize)
+	}
+	if md.metadata == nil {
+		md.metadata = make([]byte, extResp.MetadataSize)
+		md.have = make([]bool, (extResp.MetadataSize+internal.MetadataPieceSize-1)/internal.MetadataPieceSize)
+	} else if len(md.metadata) != extResp.MetadataSize {
+		return fmt.Errorf("peer reported metadata_size %d, want %d", extResp.MetadataSize, len(md.metadata))
+	}
+
+	numPieces := len(md.have)
+	fmt.Printf("Downloading metadata: %d bytes in %d pieces\n", extResp.MetadataSize, numPieces)
+
+	// Download metadata pieces, each into its place in the buffer
+	for i := 0; i < numPieces; i++ {
+		if md.have[i] {
+			continue
+		}
+		fmt.Printf("Requesting metadata piece %d/%d\n", i+1, numPieces)
+
+		begin := i * internal.MetadataPieceSize
+		end := min(begin+internal.MetadataPieceSize, extResp.MetadataSize)
+		if err := p.fetchMetadataPiece(byte(extResp.UtMetadataID), i, extResp.MetadataSize, md.metadata[begin:end]); err != nil {
+			return err
+		}
+		md.have[i] = true
+	}
+	return nil
+}
+
+// fetchMetadataPiece requests metadata piece index into buf, which is sized to
+// the piece. A reply for another piece, or one whose size disagrees with the
+// handshake's metadata_size, is discarded and the piece requested again.
+func (p *Peer) fetchMetadataPiece(utMetadataID byte, index, totalSize int, buf []byte) error {
+	var lastErr error
+	for attempt := 0; attempt < internal.MetadataRetries; attempt++ {
+		piece, err := p.RequestMetadataPiece(utMetadataID, index)
+		if err != nil {
+			return fmt.Errorf("failed to get metadata piece %d: %w", index, err)
+		}
+		switch {
+		case piece.Piece != index:
+			lastErr = fmt.Errorf("got metadata piece %d, want %d", piece.Piece, index)
+		case piece.TotalSize != totalSize:
+			lastErr = fmt.Errorf("metadata total_size %d does not match metadata_size %d", piece.TotalSize, totalSize)
+		case len(piece.Data) != len(buf):
+			lastErr = fmt.Errorf("metadata piece %d has %d bytes, want %d", index, len(piece.Data), len(buf))
+		default:
+			copy(buf, piece.Data)
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to get metadata piece %d: %w", index, lastErr)
 }
 
 func (p *Peer) ParseBitfield(msg *PeerMessage) error {
 	if msg.ID != internal.MessageBitfield {
 		return fmt.Errorf("expected bitfield message (id 5), got id %d", msg.ID)
 	}
-	p.Bitfield = msg.Payload
+	return p.setBitfield(msg.Payload)
+}
+
+// setBitfield stores a bitfield received from the peer. When NumPieces is
+// known, a bitfield of the wrong size is refused, and spare bits past the
+// last piece, which the peer should have left clear, are cleared so they
+// don't read as pieces that don't exist.
+func (p *Peer) setBitfield(payload []byte) error {
+	bf := BitField(payload)
+	if p.NumPieces > 0 {
+		if want := len(NewBitField(p.NumPieces)); len(bf) != want {
+			return fmt.Errorf("bitfield has %d bytes, want %d for %d pieces", len(bf), want, p.NumPieces)
+		}
+		for i := p.NumPieces; i < len(bf)*8; i++ {
+			bf.ClearPiece(i)
+		}
+	}
+	p.Bitfield = bf
 	return nil
 }
 
+// ApplyHave records that the peer now has the piece at index, growing the
+// bitfield if the peer's original bitfield was shorter. Indexes past the
+// torrent's pieces, or past MaxPieces while NumPieces is unknown, are ignored
+// so a hostile peer can't make the bitfield huge.
+func (p *Peer) ApplyHave(index uint32) {
+	if index >= p.maxPieces() {
+		return
+	}
+	byteIndex := int(index / 8)
+	if byteIndex >= len(p.Bitfield) {
+		grown := make(BitField, byteIndex+1)
+		copy(grown, p.Bitfield)
+		p.Bitfield = grown
+	}
+	p.Bitfield.SetPiece(int(index))
+}
+
+// handleHave applies a have message's 4-byte piece index to the bitfield
+func (p *Peer) handleHave(msg *PeerMessage) error {
+	if len(msg.Payload) != 4 {
+		return fmt.Errorf("invalid have message payload length: %d", len(msg.Payload))
+	}
+	index := binary.BigEndian.Uint32(msg.Payload)
+	if limit := p.maxPieces(); index >= limit {
+		return fmt.Errorf("have message for piece %d of %d", index, limit)
+	}
+	p.ApplyHave(index)
+	return nil
+}
+
+// maxPieces returns the bound on piece indexes from the peer
+func (p *Peer) maxPieces() uint32 {
+	if p.NumPieces > 0 {
+		return uint32(p.NumPieces)
+	}
+	return internal.MaxPieces
+}
+
+// NewBitField returns an empty bitfield for numPieces pieces, with the spare
+// bits of its last byte clear
+func NewBitField(numPieces int) BitField {
+	return make(BitField, (max(numPieces, 0)+7)/8)
+}
+
+// HasPiece reports whether the piece at index is present. Indices beyond the
+// bitfield read as absent.
 func (bf BitField) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
-	if byteIndex < 0 || byteIndex >= len(bf) {
+	if index < 0 || byteIndex >= len(bf) {
 		return false
 	}
 	// Check if the bit is set (bits are ordered from most significant to least)
 	return bf[byteIndex]>>(7-offset)&1 != 0
 }
+
+// SetPiece marks the piece at index as present. Indices beyond the bitfield are ignored.
+func (bf BitField) SetPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - offset)
+}
+
+// ClearPiece marks the piece at index as absent. Indices beyond the bitfield are ignored.
+func (bf BitField) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << (7 - offset)
+}
+
+// Count returns how many pieces are present
+func (bf BitField) Count() int {
+	n := 0
+	for _, b := range bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+)
+
+// scriptedConn is a net.Conn that reads a fixed byte stream and records
+// everything written to it
+type scriptedConn struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error)         { return c.in.Read(b) }
+func (c *scriptedConn) Write(b []byte) (int, error)        { return c.out.Write(b) }
+func (c *scriptedConn) Close() error                       { return nil }
+func (c *scriptedConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *scriptedConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *scriptedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *scriptedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *scriptedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// scriptedPeer returns a peer reading the concatenated frames from its
+// connection
+func scriptedPeer(frames ...[]byte) (*Peer, *scriptedConn) {
+	conn := &scriptedConn{in: bytes.NewReader(bytes.Join(frames, nil))}
+	return &Peer{Conn: conn}, conn
+}
+
+// frame encodes a message as it appears on the wire
+func frame(id byte, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	b = append(b, id)
+	return append(b, payload...)
+}
+
+func TestReadMessageKeepAlive(t *testing.T) {
+	p, _ := scriptedPeer([]byte{0, 0, 0, 0})
+
+	msg, err := p.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if msg.ID != internal.MessageKeepAlive || len(msg.Payload) != 0 {
+		t.Errorf("got message %d with %d payload bytes, want a keep-alive", msg.ID, len(msg.Payload))
+	}
+}
+
+func TestSendKeepAlive(t *testing.T) {
+	p, conn := scriptedPeer()
+
+	if err := p.SendKeepAlive(); err != nil {
+		t.Fatalf("SendKeepAlive: %v", err)
+	}
+	if got := conn.out.Bytes(); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Errorf("wrote %v, want four zero bytes", got)
+	}
+}
+
+func TestReadMessageAfterKeepAlive(t *testing.T) {
+	p, _ := scriptedPeer([]byte{0, 0, 0, 0}, frame(internal.MessageHave, []byte{0, 0, 0, 7}))
+
+	if msg, err := p.ReadMessage(); err != nil || msg.ID != internal.MessageKeepAlive {
+		t.Fatalf("first ReadMessage = %v, %v, want a keep-alive", msg, err)
+	}
+	msg, err := p.ReadMessage()
+	if err != nil {
+		t.Fatalf("second ReadMessage: %v", err)
+	}
+	if msg.ID != internal.MessageHave || !bytes.Equal(msg.Payload, []byte{0, 0, 0, 7}) {
+		t.Errorf("got message %d with payload %v, want have for piece 7", msg.ID, msg.Payload)
+	}
+}
+
+func TestApplyHave(t *testing.T) {
+	p := &Peer{Bitfield: BitField{0x80}}
+
+	p.ApplyHave(12)
+	if !p.Bitfield.HasPiece(12) {
+		t.Error("HasPiece(12) = false after ApplyHave(12)")
+	}
+	if !p.Bitfield.HasPiece(0) {
+		t.Error("growing the bitfield lost piece 0")
+	}
+	if len(p.Bitfield) != 2 {
+		t.Errorf("bitfield has %d bytes, want 2", len(p.Bitfield))
+	}
+}
+
+func TestApplyHaveOutOfRange(t *testing.T) {
+	p := &Peer{NumPieces: 10, Bitfield: NewBitField(10)}
+	p.ApplyHave(10)
+	if p.Bitfield.Count() != 0 || len(p.Bitfield) != 2 {
+		t.Errorf("have past the last piece changed the bitfield to %v", p.Bitfield)
+	}
+
+	// Without NumPieces, indexes are bounded by MaxPieces
+	p = &Peer{}
+	p.ApplyHave(internal.MaxPieces)
+	if len(p.Bitfield) != 0 {
+		t.Errorf("have for piece %d grew the bitfield to %d bytes", internal.MaxPieces, len(p.Bitfield))
+	}
+	err := p.handleHave(&PeerMessage{ID: internal.MessageHave, Payload: []byte{0xFF, 0xFF, 0xFF, 0xFF}})
+	if err == nil {
+		t.Error("handleHave accepted piece 0xFFFFFFFF")
+	}
+}
+
+func TestSendCancelMatchesRequest(t *testing.T) {
+	p, conn := scriptedPeer()
+
+	if err := p.SendCancel(3, 16384, 1000); err != nil {
+		t.Fatalf("SendCancel: %v", err)
+	}
+
+	want := p.constructPieceRequest(3, 16384, 1000)
+	want[4] = internal.MessageCancel
+	if got := conn.out.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("wrote %v, want %v", got, want)
+	}
+}
+
+func TestNewBitField(t *testing.T) {
+	bf := NewBitField(10)
+	if len(bf) != 2 {
+		t.Fatalf("NewBitField(10) has %d bytes, want 2", len(bf))
+	}
+
+	bf.SetPiece(0)
+	bf.SetPiece(9)
+	for i := 10; i < 16; i++ {
+		if bf.HasPiece(i) {
+			t.Errorf("padding bit %d reads as present", i)
+		}
+	}
+	if bf.Count() != 2 {
+		t.Errorf("Count() = %d, want 2", bf.Count())
+	}
+
+	bf.ClearPiece(0)
+	if bf.HasPiece(0) || !bf.HasPiece(9) || bf.Count() != 1 {
+		t.Errorf("after ClearPiece(0) the bitfield is %08b", bf)
+	}
+}
+
+func TestReadBitfieldTrailingBits(t *testing.T) {
+	// 10 pieces: pieces 0 and 9 set, plus all six padding bits
+	p, _ := scriptedPeer(frame(internal.MessageBitfield, []byte{0x80, 0x7F}))
+	p.NumPieces = 10
+
+	if _, err := p.ReadBitfield(); err != nil {
+		t.Fatalf("ReadBitfield: %v", err)
+	}
+	if !p.Bitfield.HasPiece(0) || !p.Bitfield.HasPiece(9) {
+		t.Errorf("real pieces lost: %08b", p.Bitfield)
+	}
+	if p.Bitfield.Count() != 2 {
+		t.Errorf("spurious trailing bits kept: %08b", p.Bitfield)
+	}
+}
+
+func TestReadBitfieldWrongLength(t *testing.T) {
+	p, _ := scriptedPeer(frame(internal.MessageBitfield, []byte{0xFF, 0xC0, 0x00}))
+	p.NumPieces = 10
+
+	if _, err := p.ReadBitfield(); err == nil {
+		t.Error("ReadBitfield accepted a 3-byte bitfield for 10 pieces")
+	}
+}
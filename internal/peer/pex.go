@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+)
+
+// UtPexID is the extended message id we ask peers to use when sending us
+// ut_pex messages
+const UtPexID = 2
+
+// MaxPexPeers caps the added and dropped lists of a single PEX message (BEP 11)
+const MaxPexPeers = 50
+
+// PexMessage is a ut_pex update: peers the sender has connected to and
+// disconnected from since its last update
+type PexMessage struct {
+	Added   []netip.AddrPort
+	Dropped []netip.AddrPort
+}
+
+// ParsePex decodes a ut_pex message payload, including the leading extended
+// message id. A compact peer list with a trailing partial entry keeps the
+// entries before it.
+func ParsePex(payload []byte) (*PexMessage, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("pex message too short")
+	}
+	decoded, err := bencode.Decode(payload[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pex message: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pex message not a dictionary")
+	}
+
+	pex := &PexMessage{}
+	pex.Added = append(parseCompact(dict, "added", net.IPv4len), parseCompact(dict, "added6", net.IPv6len)...)
+	pex.Dropped = append(parseCompact(dict, "dropped", net.IPv4len), parseCompact(dict, "dropped6", net.IPv6len)...)
+	return pex, nil
+}
+
+// SupportsPex reports whether the peer has advertised ut_pex
+func (p *Peer) SupportsPex() bool {
+	return p.PexID != 0
+}
+
+// SendPex sends the peer a ut_pex update. The peer must have advertised ut_pex
+// in its extension handshake.
+func (p *Peer) SendPex(added, dropped []netip.AddrPort) error {
+	if p.PexID == 0 {
+		return fmt.Errorf("peer does not support ut_pex")
+	}
+	added4, added6 := encodeCompact(added)
+	dropped4, dropped6 := encodeCompact(dropped)
+	dict, err := bencode.Encode(map[string]interface{}{
+		"added":    added4,
+		"added.f":  make([]byte, len(added4)/6),
+		"added6":   added6,
+		"added6.f": make([]byte, len(added6)/18),
+		"dropped":  dropped4,
+		"dropped6": dropped6,
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding pex message: %w", err)
+	}
+	return p.WriteMessage(internal.MessageExtension, append([]byte{byte(p.PexID)}, dict...))
+}
+
+// handleExtension processes the extension messages a peer may send while we
+// download from it: its extension handshake, kept in Extensions, and its PEX
+// updates. Malformed messages are ignored rather than dropping the connection.
+func (p *Peer) handleExtension(msg *PeerMessage) {
+	if len(msg.Payload) == 0 {
+		return
+	}
+	switch msg.Payload[0] {
+	case 0:
+		if ext, err := decodeExtensionHandshake(msg.Payload); err == nil {
+			p.Extensions = ext
+			p.PexID = ext.ExtensionMapping["ut_pex"]
+		}
+	case UtPexID:
+		if p.OnPex == nil {
+			return
+		}
+		if pex, err := ParsePex(msg.Payload); err == nil && len(pex.Added) > 0 {
+			p.OnPex(pex.Added)
+		}
+	}
+}
+
+// parseCompact decodes the compact peer list under key, if there is one,
+// dropping a trailing partial entry
+func parseCompact(dict map[string]interface{}, key string, ipLen int) []netip.AddrPort {
+	b, err := bencode.GetBytes(dict, key)
+	if err != nil {
+		return nil
+	}
+	stride := ipLen + 2
+	peers, _ := tracker.ParseCompactPeers(b[:len(b)-len(b)%stride], ipLen)
+	return peers
+}
+
+// encodeCompact splits peers into compact IPv4 and IPv6 lists
+func encodeCompact(peers []netip.AddrPort) (v4, v6 []byte) {
+	v4, v6 = []byte{}, []byte{}
+	for _, p := range peers {
+		addr := p.Addr().Unmap()
+		if addr.Is4() {
+			v4 = append(v4, addr.AsSlice()...)
+			v4 = binary.BigEndian.AppendUint16(v4, p.Port())
+		} else {
+			v6 = append(v6, addr.AsSlice()...)
+			v6 = binary.BigEndian.AppendUint16(v6, p.Port())
+		}
+	}
+	return v4, v6
+}
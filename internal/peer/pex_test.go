@@ -0,0 +1,33 @@
+package peer
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParsePex(t *testing.T) {
+	v4 := "\xc0\x00\x02\x01\x1a\xe1"                                     // 192.0.2.1:6881
+	v6 := "\x20\x01\x0d\xb8" + string(make([]byte, 11)) + "\x01\x1a\xe1" // [2001:db8::1]:6881
+	payload := "\x01d5:added9:" + v4 + v4[:3] +
+		"6:added621:" + v6 + "\x00\x00\x00" +
+		"7:dropped6:" + v4 + "e"
+
+	pex, err := ParsePex([]byte(payload))
+	if err != nil {
+		t.Fatalf("ParsePex: %v", err)
+	}
+
+	// Each list keeps its whole entries and drops the partial one after them
+	wantAdded := []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:6881"),
+		netip.MustParseAddrPort("[2001:db8::1]:6881"),
+	}
+	wantDropped := []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:6881")}
+	if !reflect.DeepEqual(pex.Added, wantAdded) {
+		t.Errorf("Added = %v, want %v", pex.Added, wantAdded)
+	}
+	if !reflect.DeepEqual(pex.Dropped, wantDropped) {
+		t.Errorf("Dropped = %v, want %v", pex.Dropped, wantDropped)
+	}
+}
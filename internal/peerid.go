@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// PeerIDPrefix identifies this client in Azureus-style peer IDs
+const PeerIDPrefix = "-LR0001-"
+
+// ClientVersion names this client in the "v" key of extension handshakes
+const ClientVersion = "LR 0.0.1"
+
+// PeerID identifies this instance in handshakes and tracker announces. It is
+// generated once at startup so that concurrent instances don't collide.
+var PeerID = mustPeerID(rand.Reader)
+
+// NewPeerID returns a 20-byte Azureus-style peer ID: PeerIDPrefix followed by
+// 12 bytes read from r.
+func NewPeerID(r io.Reader) (string, error) {
+	id := make([]byte, 20)
+	copy(id, PeerIDPrefix)
+	if _, err := io.ReadFull(r, id[len(PeerIDPrefix):]); err != nil {
+		return "", fmt.Errorf("error generating peer id: %w", err)
+	}
+	return string(id), nil
+}
+
+func mustPeerID(r io.Reader) string {
+	id, err := NewPeerID(r)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewPeerID(t *testing.T) {
+	random := []byte("0123456789ab")
+	id, err := NewPeerID(bytes.NewReader(random))
+	if err != nil {
+		t.Fatalf("NewPeerID: %v", err)
+	}
+	if want := PeerIDPrefix + string(random); id != want {
+		t.Errorf("NewPeerID = %q, want %q", id, want)
+	}
+}
+
+func TestNewPeerIDShortRead(t *testing.T) {
+	if _, err := NewPeerID(strings.NewReader("short")); err == nil {
+		t.Error("NewPeerID succeeded with 5 random bytes")
+	}
+}
+
+func TestPeerID(t *testing.T) {
+	if len(PeerID) != 20 || !strings.HasPrefix(PeerID, PeerIDPrefix) {
+		t.Errorf("PeerID %q is not 20 bytes starting with %q", PeerID, PeerIDPrefix)
+	}
+}
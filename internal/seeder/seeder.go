@@ -0,0 +1,278 @@
+package seeder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// PieceSource provides the pieces a Seeder can upload.
+type PieceSource interface {
+	// Bitfield returns a snapshot of the pieces we have
+	Bitfield() peer.BitField
+	// ReadAt reads torrent data at a global byte offset
+	ReadAt(p []byte, off int64) (int, error)
+}
+
+// PieceNotifier is implemented by piece sources that gain pieces while
+// seeding, such as a download in progress. Peers are sent a Have for each
+// piece completed after their bitfield.
+type PieceNotifier interface {
+	// SubscribePieces returns a channel receiving the index of each piece
+	// completed from now on, and a func ending the subscription
+	SubscribePieces() (<-chan int, func())
+}
+
+// Seeder accepts inbound peer connections and uploads pieces to them.
+type Seeder struct {
+	info    *metainfo.Info
+	source  PieceSource
+	Verbose bool
+
+	HandshakeTimeout time.Duration // how long an inbound peer has to handshake
+	ReadTimeout      time.Duration // drop a peer that stays silent this long
+	MaxConns         int           // connections served at once; more are closed
+
+	uploaded atomic.Int64
+}
+
+// New creates a Seeder serving the torrent described by info from source.
+func New(info *metainfo.Info, source PieceSource) *Seeder {
+	return &Seeder{
+		info:             info,
+		source:           source,
+		HandshakeTimeout: internal.InboundHandshakeTimeout * time.Second,
+		ReadTimeout:      internal.InboundReadTimeout * time.Second,
+		MaxConns:         internal.MaxInboundConns,
+	}
+}
+
+// Uploaded returns the number of piece bytes sent to peers so far.
+func (s *Seeder) Uploaded() int64 {
+	return s.uploaded.Load()
+}
+
+// Listen accepts connections on port until ctx is done. It is meant to run in
+// its own goroutine alongside a download.
+func (s *Seeder) Listen(ctx context.Context, port int) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("error listening on port %d: %w", port, err)
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts connections on ln until ctx is done, then closes ln. Beyond
+// MaxConns, new connections are closed straight away. It returns only once
+// every connection has been closed, so the piece source may be closed as soon
+// as it does.
+func (s *Seeder) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	slots := make(chan struct{}, s.MaxConns)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error accepting connection: %w", err)
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			s.logf("Seeder: refused %s: too many connections\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer func() { <-slots }()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+// handleConn serves a single inbound peer until it disconnects or ctx is done
+func (s *Seeder) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// A peer that connects and stays silent mustn't hold its slot
+	conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	p, h, err := peer.Accept(conn, s.info.InfoHash)
+	if err != nil {
+		s.logf("Seeder: rejected %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	p.ReadTimeout = s.ReadTimeout
+
+	// Subscribe before taking the bitfield so no piece completed in between
+	// is missed
+	var completed <-chan int
+	if n, ok := s.source.(PieceNotifier); ok {
+		var unsubscribe func()
+		completed, unsubscribe = n.SubscribePieces()
+		defer unsubscribe()
+	}
+
+	bf := s.source.Bitfield()
+	if err = p.WriteMessage(internal.MessageBitfield, bf); err != nil {
+		return
+	}
+
+	// Offer our info dict over ut_metadata to peers using the extension
+	// protocol. The bitfield has to be the first message, so this follows it.
+	if h.Reserved[internal.ExtensionBitPosition]&internal.ExtensionID != 0 {
+		if err = p.SendExtensionHandshake(len(s.info.Raw), false); err != nil {
+			return
+		}
+	}
+
+	if completed != nil {
+		stopHaves := make(chan struct{})
+		haves := make(chan struct{})
+		go func() {
+			defer close(haves)
+			s.sendHaves(p, bf, completed, stopHaves)
+		}()
+		// Closing the connection unblocks a Have being written
+		defer func() {
+			close(stopHaves)
+			conn.Close()
+			<-haves
+		}()
+	}
+
+	if err = s.serve(p); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logf("Seeder: peer %s: %v\n", p.AddrPort, err)
+	}
+}
+
+// sendHaves announces each piece received on completed that isn't already in
+// the peer's view of our pieces, bf, until stop is closed
+func (s *Seeder) sendHaves(p *peer.Peer, bf peer.BitField, completed <-chan int, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case index := <-completed:
+			if bf.HasPiece(index) {
+				continue
+			}
+			bf.SetPiece(index)
+			if err := p.WriteMessage(internal.MessageHave, binary.BigEndian.AppendUint32(nil, uint32(index))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serve answers the peer's messages: interest is met with an unchoke,
+// requests with the block read from the piece source and ut_metadata requests
+// with a piece of the raw info dict
+func (s *Seeder) serve(p *peer.Peer) error {
+	// The id the peer wants its ut_metadata messages sent with, once known
+	var utMetadataID int
+	for {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msg.ID {
+		case internal.MessageInterested:
+			if err = p.WriteMessage(internal.MessageUnchoke, nil); err != nil {
+				return err
+			}
+		case internal.MessageRequest:
+			if err = s.sendBlock(p, msg.Payload); err != nil {
+				return err
+			}
+		case internal.MessageExtension:
+			if len(msg.Payload) == 0 {
+				continue
+			}
+			switch msg.Payload[0] {
+			case 0:
+				if ext, err := peer.ParseExtensionHandshake(msg.Payload); err == nil {
+					utMetadataID = ext.UtMetadataID
+				}
+			case peer.UtMetadataID:
+				if utMetadataID == 0 {
+					continue
+				}
+				if err = p.ServeMetadataRequest(utMetadataID, msg.Payload, s.info.Raw); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// sendBlock validates a request payload and replies with the requested block.
+// A request we can't serve is rejected if the peer speaks the Fast Extension,
+// and drops the connection otherwise.
+func (s *Seeder) sendBlock(p *peer.Peer, request []byte) error {
+	if len(request) != 12 {
+		return fmt.Errorf("invalid request payload length: %d", len(request))
+	}
+	index := binary.BigEndian.Uint32(request[0:4])
+	begin := binary.BigEndian.Uint32(request[4:8])
+	length := binary.BigEndian.Uint32(request[8:12])
+
+	pieceLength, err := s.info.PieceLengthAt(int(index))
+	if err != nil || !s.source.Bitfield().HasPiece(int(index)) {
+		return s.reject(p, request, fmt.Errorf("request for piece %d we don't have", index))
+	}
+	if length == 0 || length > internal.MaxBlockSize || uint64(begin)+uint64(length) > uint64(pieceLength) {
+		return s.reject(p, request, fmt.Errorf("invalid request for piece %d: begin %d length %d", index, begin, length))
+	}
+
+	payload := make([]byte, 8+length)
+	copy(payload[0:8], request[0:8])
+	offset := int64(index)*int64(s.info.PieceLength) + int64(begin)
+	if _, err := s.source.ReadAt(payload[8:], offset); err != nil {
+		return fmt.Errorf("error reading piece %d: %w", index, err)
+	}
+
+	if err := p.WriteMessage(internal.MessagePiece, payload); err != nil {
+		return err
+	}
+	s.uploaded.Add(int64(length))
+	return nil
+}
+
+// reject answers a request we won't serve with a Reject Request carrying the
+// request's payload back, or returns reason for peers without the Fast
+// Extension, which have no way to be told
+func (s *Seeder) reject(p *peer.Peer, request []byte, reason error) error {
+	if !p.Fast {
+		return reason
+	}
+	s.logf("Seeder: peer %s: %v\n", p.AddrPort, reason)
+	return p.WriteMessage(internal.MessageRejectRequest, request)
+}
+
+func (s *Seeder) logf(format string, args ...interface{}) {
+	if s.Verbose {
+		fmt.Printf(format, args...)
+	}
+}
@@ -0,0 +1,428 @@
+package seeder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+)
+
+// testData is the torrent served in these tests: pieces of 32, 32 and 16 bytes
+var testData = bytes.Repeat([]byte("0123456789abcdef"), 5)
+
+// testInfo describes testData
+func testInfo() *metainfo.Info {
+	info := &metainfo.Info{Name: "file", Length: len(testData), PieceLength: 32}
+	for begin := 0; begin < len(testData); begin += info.PieceLength {
+		info.Pieces = append(info.Pieces, metainfo.HashPiece(testData[begin:min(begin+info.PieceLength, len(testData))])...)
+	}
+	info.Raw = bytes.Repeat([]byte("i"), 100)
+	info.InfoHash = [20]byte{1, 2, 3}
+	return info
+}
+
+// memSource serves testData, claiming only the pieces in have
+type memSource struct {
+	have peer.BitField
+}
+
+func (m *memSource) Bitfield() peer.BitField { return append(peer.BitField(nil), m.have...) }
+
+func (m *memSource) ReadAt(p []byte, off int64) (int, error) {
+	return copy(p, testData[off:]), nil
+}
+
+// pipeConn is one end of a net.Pipe with a TCP remote address, as
+// peer.Accept expects
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}
+}
+
+// pipeListener hands out the server ends of pipes made with dial
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   atomic.Bool
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	if l.once.CompareAndSwap(false, true) {
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeConn{}.RemoteAddr() }
+
+// dial connects to the seeder accepting on l and returns the client's end
+func (l *pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- pipeConn{server}
+	return client
+}
+
+// handshake sends our handshake over conn, advertising the Fast and
+// extension protocols as asked, and reads the seeder's reply and bitfield
+func handshake(t *testing.T, conn net.Conn, info *metainfo.Info, fast, ext bool) *peer.Peer {
+	t.Helper()
+	msg := append([]byte{internal.ProtocolStringLength}, internal.ProtocolString...)
+	reserved := make([]byte, 8)
+	if fast {
+		reserved[internal.FastBitPosition] |= internal.FastID
+	}
+	if ext {
+		reserved[internal.ExtensionBitPosition] |= internal.ExtensionID
+	}
+	msg = append(msg, reserved...)
+	msg = append(msg, info.InfoHash[:]...)
+	msg = append(msg, "-TS0001-testclient00"...)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("writing handshake: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, internal.HandshakeLength)); err != nil {
+		t.Fatalf("reading handshake: %v", err)
+	}
+
+	p := &peer.Peer{Conn: conn, Fast: fast, NumPieces: info.NumPieces()}
+	if _, err := p.ReadBitfield(); err != nil {
+		t.Fatalf("reading bitfield: %v", err)
+	}
+	return p
+}
+
+// blockingSource is a memSource whose reads wait for release
+type blockingSource struct {
+	memSource
+	reading  chan struct{} // closed when a read starts
+	release  chan struct{}
+	finished atomic.Bool // set when a read returns
+}
+
+func (b *blockingSource) ReadAt(p []byte, off int64) (int, error) {
+	close(b.reading)
+	<-b.release
+	defer b.finished.Store(true)
+	return b.memSource.ReadAt(p, off)
+}
+
+func TestServeWaitsForRequestInFlight(t *testing.T) {
+	info := testInfo()
+	src := &blockingSource{
+		memSource: memSource{have: peer.BitField{0xE0}},
+		reading:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	s := New(info, src)
+	ln := newPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, ln) }()
+
+	conn := ln.dial()
+	defer conn.Close()
+	p := handshake(t, conn, info, false, false)
+	if err := p.WriteMessage(internal.MessageRequest, requestPayload(0, 0, 16)); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	<-src.reading
+
+	// Stopping mid-read must not let Serve return, as the caller would then
+	// close the storage being read
+	cancel()
+	select {
+	case <-served:
+		t.Fatal("Serve returned while a block was being read")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(src.release)
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+	if !src.finished.Load() {
+		t.Error("Serve returned before the read finished")
+	}
+}
+
+// requestPayload encodes a block request
+func requestPayload(index, begin, length uint32) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, index)
+	payload = binary.BigEndian.AppendUint32(payload, begin)
+	return binary.BigEndian.AppendUint32(payload, length)
+}
+
+// notifySource is a memSource whose completed pieces are announced on pieces
+type notifySource struct {
+	memSource
+	pieces       chan int
+	unsubscribed chan struct{}
+}
+
+func (n *notifySource) SubscribePieces() (<-chan int, func()) {
+	return n.pieces, func() { close(n.unsubscribed) }
+}
+
+func TestHandleConnSendsHave(t *testing.T) {
+	info := testInfo()
+	src := &notifySource{
+		memSource:    memSource{have: peer.BitField{0x80}},
+		pieces:       make(chan int, 2),
+		unsubscribed: make(chan struct{}),
+	}
+	s := New(info, src)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConn(context.Background(), pipeConn{server})
+	}()
+
+	p := handshake(t, client, info, false, false)
+	// Piece 0 was in the bitfield, so only piece 2 is announced
+	src.pieces <- 0
+	src.pieces <- 2
+	msg, err := p.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading have: %v", err)
+	}
+	if msg.ID != internal.MessageHave || binary.BigEndian.Uint32(msg.Payload) != 2 {
+		t.Errorf("got message %d %v, want have for piece 2", msg.ID, msg.Payload)
+	}
+
+	client.Close()
+	<-done
+	select {
+	case <-src.unsubscribed:
+	default:
+		t.Error("handleConn returned without unsubscribing")
+	}
+}
+
+// closedByPeer reports whether conn is closed by the other end within a second
+func closedByPeer(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+func TestHandleConnHandshakeTimeout(t *testing.T) {
+	s := New(testInfo(), &memSource{})
+	s.HandshakeTimeout = 10 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConn(context.Background(), pipeConn{server})
+
+	if !closedByPeer(t, client) {
+		t.Error("connection without a handshake was kept open")
+	}
+}
+
+func TestHandleConnReadTimeout(t *testing.T) {
+	info := testInfo()
+	s := New(info, &memSource{have: peer.BitField{0x80}})
+	s.ReadTimeout = 10 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConn(context.Background(), pipeConn{server})
+
+	handshake(t, client, info, false, false)
+	if !closedByPeer(t, client) {
+		t.Error("silent peer was kept connected")
+	}
+}
+
+func TestServeMaxConns(t *testing.T) {
+	info := testInfo()
+	s := New(info, &memSource{have: peer.BitField{0x80}})
+	s.MaxConns = 1
+	ln := newPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	first := ln.dial()
+	defer first.Close()
+	handshake(t, first, info, false, false)
+
+	second := ln.dial()
+	defer second.Close()
+	if !closedByPeer(t, second) {
+		t.Error("connection beyond MaxConns was accepted")
+	}
+
+	// Once the first peer leaves its slot is free again. A refused connection
+	// is closed unread, so writing a handshake to it fails.
+	first.Close()
+	for range 100 {
+		third := ln.dial()
+		if _, err := third.Write(make([]byte, internal.HandshakeLength)); err == nil {
+			third.Close()
+			return
+		}
+		third.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("slot wasn't freed when the first peer left")
+}
+
+// serveConn runs handleConn for a peer advertising the Fast and extension
+// protocols as asked. It returns the client after the seeder's bitfield, and
+// a channel closed when handleConn returns.
+func serveConn(t *testing.T, s *Seeder, fast, ext bool) (*peer.Peer, <-chan struct{}) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConn(context.Background(), pipeConn{server})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return handshake(t, client, s.info, fast, ext), done
+}
+
+// badRequests are requests for pieces 0 and 2 of 0, 1 and 2 that the seeder
+// can't serve
+var badRequests = []struct {
+	name                 string
+	index, begin, length uint32
+}{
+	{"piece we don't have", 1, 0, 16},
+	{"piece out of range", 3, 0, 16},
+	{"block past the piece", 2, 8, 16},
+	{"empty block", 0, 0, 0},
+	{"oversized block", 0, 0, internal.MaxBlockSize + 1},
+}
+
+func TestHandleConnBitfield(t *testing.T) {
+	s := New(testInfo(), &memSource{have: peer.BitField{0xA0}})
+	p, _ := serveConn(t, s, false, false)
+	if !bytes.Equal(p.Bitfield, peer.BitField{0xA0}) {
+		t.Errorf("got bitfield %08b, want %08b", p.Bitfield, peer.BitField{0xA0})
+	}
+}
+
+func TestHandleConnServesBlocks(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		s := New(testInfo(), &memSource{have: peer.BitField{0xA0}})
+		p, done := serveConn(t, s, fast, false)
+
+		for _, r := range []struct{ index, begin, length uint32 }{{0, 0, 32}, {2, 4, 12}} {
+			request := requestPayload(r.index, r.begin, r.length)
+			msg, err := p.SendMessage(internal.MessageRequest, request)
+			if err != nil {
+				t.Fatalf("fast %v: request %v: %v", fast, r, err)
+			}
+			offset := int(r.index)*32 + int(r.begin)
+			want := append(request[:8:8], testData[offset:offset+int(r.length)]...)
+			if msg.ID != internal.MessagePiece || !bytes.Equal(msg.Payload, want) {
+				t.Errorf("fast %v: request %v: got message %d %q, want piece %q", fast, r, msg.ID, msg.Payload, want)
+			}
+		}
+		p.Conn.Close()
+		<-done
+		if got := s.Uploaded(); got != 44 {
+			t.Errorf("fast %v: Uploaded = %d, want 44", fast, got)
+		}
+	}
+}
+
+func TestHandleConnRejectsFastPeer(t *testing.T) {
+	s := New(testInfo(), &memSource{have: peer.BitField{0xA0}})
+	p, _ := serveConn(t, s, true, false)
+
+	// Each bad request is rejected and the connection kept open
+	for _, r := range badRequests {
+		request := requestPayload(r.index, r.begin, r.length)
+		msg, err := p.SendMessage(internal.MessageRequest, request)
+		if err != nil {
+			t.Fatalf("%s: %v", r.name, err)
+		}
+		if msg.ID != internal.MessageRejectRequest || !bytes.Equal(msg.Payload, request) {
+			t.Errorf("%s: got message %d %v, want reject of %v", r.name, msg.ID, msg.Payload, request)
+		}
+	}
+	if got := s.Uploaded(); got != 0 {
+		t.Errorf("Uploaded = %d after rejecting every request", got)
+	}
+}
+
+func TestHandleConnDropsNonFastPeer(t *testing.T) {
+	for _, r := range badRequests {
+		s := New(testInfo(), &memSource{have: peer.BitField{0xA0}})
+		p, _ := serveConn(t, s, false, false)
+
+		// Without the Fast Extension there is no reject, so the peer is dropped
+		if _, err := p.SendMessage(internal.MessageRequest, requestPayload(r.index, r.begin, r.length)); err == nil {
+			t.Errorf("%s: connection still open", r.name)
+		}
+	}
+}
+
+func TestHandleConnServesMetadata(t *testing.T) {
+	s := New(testInfo(), &memSource{have: peer.BitField{0xA0}})
+	p, _ := serveConn(t, s, false, true)
+
+	// The seeder's extension handshake follows the bitfield
+	msg, err := p.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading extension handshake: %v", err)
+	}
+	if msg.ID != internal.MessageExtension {
+		t.Fatalf("got message %d, want an extension handshake", msg.ID)
+	}
+	ext, err := peer.ParseExtensionHandshake(msg.Payload)
+	if err != nil {
+		t.Fatalf("ParseExtensionHandshake: %v", err)
+	}
+	if ext.MetadataSize != len(s.info.Raw) {
+		t.Errorf("metadata_size = %d, want %d", ext.MetadataSize, len(s.info.Raw))
+	}
+
+	// Ours asks for ut_metadata messages with id 1
+	if err := p.WriteMessage(internal.MessageExtension, []byte("\x00d1:md11:ut_metadatai1eee")); err != nil {
+		t.Fatalf("writing extension handshake: %v", err)
+	}
+	piece, err := p.RequestMetadataPiece(byte(ext.UtMetadataID), 0)
+	if err != nil {
+		t.Fatalf("RequestMetadataPiece: %v", err)
+	}
+	if piece.Piece != 0 || piece.TotalSize != len(s.info.Raw) || !bytes.Equal(piece.Data, s.info.Raw) {
+		t.Errorf("got piece %d of %d bytes %q, want the info dict", piece.Piece, piece.TotalSize, piece.Data)
+	}
+}
@@ -0,0 +1,76 @@
+package seeder
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// FileSource serves a torrent's data from files already on disk, such as a
+// finished download.
+type FileSource struct {
+	bitfield peer.BitField
+	left     int64
+	store    storage.Storage
+}
+
+// OpenFileSource verifies the data at path, laid out as for
+// Info.VerifyFile, and serves the pieces whose hashes check out. The files are
+// only read, never modified.
+func OpenFileSource(info *metainfo.Info, path string) (*FileSource, error) {
+	valid, err := info.VerifyFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying %s: %w", path, err)
+	}
+
+	src := &FileSource{bitfield: peer.NewBitField(len(valid))}
+	for index, ok := range valid {
+		if ok {
+			src.bitfield.SetPiece(index)
+			continue
+		}
+		length, err := info.PieceLengthAt(index)
+		if err != nil {
+			return nil, err
+		}
+		src.left += int64(length)
+	}
+
+	var files []storage.File
+	for _, f := range info.GetFiles() {
+		filePath := path
+		if !info.IsSingleFile() {
+			if filePath, err = metainfo.SafeJoin(path, f.Path...); err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, storage.File{Path: filePath, Length: int64(f.Length)})
+	}
+	if src.store, err = storage.OpenReadOnly(files); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// Bitfield returns the pieces that verified
+func (s *FileSource) Bitfield() peer.BitField {
+	return append(peer.BitField(nil), s.bitfield...)
+}
+
+// ReadAt reads torrent data at a global byte offset
+func (s *FileSource) ReadAt(p []byte, off int64) (int, error) {
+	return s.store.ReadAt(p, off)
+}
+
+// Left returns the number of bytes in pieces that failed to verify, as
+// reported to the tracker
+func (s *FileSource) Left() int64 {
+	return s.left
+}
+
+// Close closes the underlying files
+func (s *FileSource) Close() error {
+	return s.store.Close()
+}
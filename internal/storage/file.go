@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// FileStorage writes torrent data to disk with os.File.WriteAt.
+type FileStorage struct {
+	layout
+	handles []*os.File
+}
+
+// OpenFile returns a FileStorage over the given files.
+func OpenFile(files []File) (*FileStorage, error) {
+	handles, err := createFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{
+		layout:  newLayout(files),
+		handles: handles,
+	}, nil
+}
+
+// OpenReadOnly returns a FileStorage over existing files without creating,
+// resizing or writing to them, e.g. to seed a finished download. Missing
+// files are treated as skipped: reads from them return io.EOF.
+func OpenReadOnly(files []File) (*FileStorage, error) {
+	handles := make([]*os.File, len(files))
+	for i, f := range files {
+		if f.Skip {
+			continue
+		}
+		h, err := os.Open(f.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			for _, h := range handles {
+				if h != nil {
+					h.Close()
+				}
+			}
+			return nil, fmt.Errorf("error opening %s: %w", f.Path, err)
+		}
+		handles[i] = h
+	}
+	return &FileStorage{
+		layout:  newLayout(files),
+		handles: handles,
+	}, nil
+}
+
+// WriteAt writes p at the global offset off, splitting it across files as needed
+func (s *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	spans, err := s.spans(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, sp := range spans {
+		if s.handles[sp.file] == nil {
+			n += sp.end - sp.start
+			continue
+		}
+		written, err := s.handles[sp.file].WriteAt(p[sp.start:sp.end], sp.fileOffset)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes starting at the global offset off
+func (s *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	spans, err := s.spans(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, sp := range spans {
+		if s.handles[sp.file] == nil {
+			return n, io.EOF
+		}
+		read, err := s.handles[sp.file].ReadAt(p[sp.start:sp.end], sp.fileOffset)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Sync commits the contents of every file to disk
+func (s *FileStorage) Sync() error {
+	var errs []error
+	for _, h := range s.handles {
+		if h != nil {
+			errs = append(errs, h.Sync())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every file
+func (s *FileStorage) Close() error {
+	var errs []error
+	for _, h := range s.handles {
+		if h != nil {
+			errs = append(errs, h.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MemoryStorage keeps torrent data in a byte slice, for tests and callers
+// that want the data without touching disk. It is safe for concurrent use.
+type MemoryStorage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewMemory returns a zero-filled MemoryStorage of size bytes
+func NewMemory(size int64) *MemoryStorage {
+	return &MemoryStorage{data: make([]byte, size)}
+}
+
+// WriteAt writes p at the global offset off. Writes past the end fail.
+func (s *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+		return 0, fmt.Errorf("range [%d, %d) out of bounds (size %d)", off, off+int64(len(p)), len(s.data))
+	}
+	return copy(s.data[off:], p), nil
+}
+
+// ReadAt reads len(p) bytes starting at the global offset off
+func (s *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the stored data
+func (s *MemoryStorage) Bytes() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]byte(nil), s.data...)
+}
+
+// Sync does nothing; the data is already where it will stay
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Close does nothing; the data stays readable
+func (s *MemoryStorage) Close() error {
+	return nil
+}
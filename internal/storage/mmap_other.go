@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+const mmapSupported = false
+
+// OpenMmap falls back to WriteAt-based storage on platforms without mmap support.
+func OpenMmap(files []File) (*FileStorage, error) {
+	return OpenFile(files)
+}
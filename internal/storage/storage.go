@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Storage is a random-access store for torrent data.
+// Offsets are global: offset 0 is the first byte of the first file, and
+// reads or writes may span several files. Besides the file-backed stores
+// here, any implementation can be handed to the downloader, e.g. one writing
+// to a remote object store.
+type Storage interface {
+	io.WriterAt
+	io.ReaderAt
+	// Sync flushes written data to stable storage
+	Sync() error
+	Close() error
+}
+
+// File describes one file on disk backing a contiguous range of torrent data.
+// A skipped file is never created: writes to its range are discarded and
+// reads from it return io.EOF.
+type File struct {
+	Path   string
+	Length int64
+	Skip   bool
+
+	// Perm and DirPerm are the permissions the file and any missing parent
+	// directories are created with; zero uses 0644 and 0755
+	Perm    fs.FileMode
+	DirPerm fs.FileMode
+
+	// Exclusive refuses to open a file that already exists, failing with an
+	// error wrapping fs.ErrExist, rather than reusing it
+	Exclusive bool
+}
+
+// Open creates (or reuses) the given files, sized to their expected lengths, and
+// returns a Storage over them. If useMmap is set and memory mapping is available
+// on this platform, the files are mapped into memory; otherwise WriteAt is used.
+func Open(files []File, useMmap bool) (Storage, error) {
+	if useMmap && mmapSupported {
+		s, err := OpenMmap(files)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s, err := OpenFile(files)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// span is the part of a buffer that falls into a single file
+type span struct {
+	file       int
+	fileOffset int64
+	start, end int // range within the caller's buffer
+}
+
+// layout maps global offsets onto the backing files
+type layout struct {
+	files   []File
+	offsets []int64 // global offset at which each file starts
+	total   int64
+}
+
+func newLayout(files []File) layout {
+	l := layout{files: files, offsets: make([]int64, len(files))}
+	for i, f := range files {
+		l.offsets[i] = l.total
+		l.total += f.Length
+	}
+	return l
+}
+
+// spans splits the range [off, off+n) into per-file pieces
+func (l layout) spans(off int64, n int) ([]span, error) {
+	if off < 0 || off+int64(n) > l.total {
+		return nil, fmt.Errorf("range [%d, %d) out of bounds (size %d)", off, off+int64(n), l.total)
+	}
+
+	var spans []span
+	pos := 0
+	for i, f := range l.files {
+		if pos == n {
+			break
+		}
+		fileEnd := l.offsets[i] + f.Length
+		cur := off + int64(pos)
+		if f.Length == 0 || cur >= fileEnd {
+			continue
+		}
+		chunk := int(min(int64(n-pos), fileEnd-cur))
+		spans = append(spans, span{
+			file:       i,
+			fileOffset: cur - l.offsets[i],
+			start:      pos,
+			end:        pos + chunk,
+		})
+		pos += chunk
+	}
+	return spans, nil
+}
+
+// createFiles opens every file for reading and writing, creating parent
+// directories as needed and sizing each file to its expected length. Skipped
+// files get a nil handle. Exclusive files are all checked before anything is
+// created, so a clash leaves the disk untouched.
+func createFiles(files []File) ([]*os.File, error) {
+	for _, f := range files {
+		if f.Exclusive && !f.Skip {
+			if _, err := os.Lstat(f.Path); err == nil {
+				return nil, fmt.Errorf("error creating %s: %w", f.Path, fs.ErrExist)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("error checking %s: %w", f.Path, err)
+			}
+		}
+	}
+
+	handles := make([]*os.File, 0, len(files))
+	closeAll := func() {
+		for _, h := range handles {
+			if h != nil {
+				h.Close()
+			}
+		}
+	}
+
+	for _, f := range files {
+		if f.Skip {
+			handles = append(handles, nil)
+			continue
+		}
+		perm, dirPerm := f.Perm, f.DirPerm
+		if perm == 0 {
+			perm = 0644
+		}
+		if dirPerm == 0 {
+			dirPerm = 0755
+		}
+		flags := os.O_RDWR | os.O_CREATE
+		if f.Exclusive {
+			flags |= os.O_EXCL
+		}
+
+		if err := os.MkdirAll(filepath.Dir(f.Path), dirPerm); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error creating directory for %s: %w", f.Path, err)
+		}
+		h, err := os.OpenFile(f.Path, flags, perm)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error opening %s: %w", f.Path, err)
+		}
+		handles = append(handles, h)
+		if err = h.Truncate(f.Length); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error sizing %s: %w", f.Path, err)
+		}
+	}
+	return handles, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeScattered writes data to s in blocks of blockSize, in a shuffled order
+// so the writes land all over the files as they do during a download
+func writeScattered(t *testing.T, s Storage, data []byte, blockSize int) {
+	t.Helper()
+	var offsets []int
+	for off := 0; off < len(data); off += blockSize {
+		offsets = append(offsets, off)
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(offsets), func(i, j int) {
+		offsets[i], offsets[j] = offsets[j], offsets[i]
+	})
+	for _, off := range offsets {
+		end := min(off+blockSize, len(data))
+		if _, err := s.WriteAt(data[off:end], int64(off)); err != nil {
+			t.Fatalf("WriteAt(%d): %v", off, err)
+		}
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// layoutIn returns files of the given lengths inside dir
+func layoutIn(dir string, lengths ...int64) []File {
+	files := make([]File, len(lengths))
+	for i, length := range lengths {
+		files[i] = File{Path: filepath.Join(dir, "sub", string(rune('a'+i))), Length: length}
+	}
+	return files
+}
+
+func TestMmapMatchesWriteAt(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("memory mapping is not supported on this platform")
+	}
+
+	// Blocks straddle file boundaries, and one file is empty
+	lengths := []int64{10000, 0, 33333, 1, 20000}
+	var total int64
+	for _, l := range lengths {
+		total += l
+	}
+	data := make([]byte, total)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	mmapDir, fileDir := t.TempDir(), t.TempDir()
+	mmapFiles, plainFiles := layoutIn(mmapDir, lengths...), layoutIn(fileDir, lengths...)
+
+	ms, err := OpenMmap(mmapFiles)
+	if err != nil {
+		t.Fatalf("OpenMmap: %v", err)
+	}
+	writeScattered(t, ms, data, 4096)
+
+	ws, err := OpenFile(plainFiles)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	writeScattered(t, ws, data, 4096)
+
+	var off int64
+	for i := range lengths {
+		got, err := os.ReadFile(mmapFiles[i].Path)
+		if err != nil {
+			t.Fatalf("reading mmap output: %v", err)
+		}
+		want, err := os.ReadFile(plainFiles[i].Path)
+		if err != nil {
+			t.Fatalf("reading WriteAt output: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("file %d: mmap output differs from WriteAt output", i)
+		}
+		if !bytes.Equal(got, data[off:off+lengths[i]]) {
+			t.Errorf("file %d: output differs from the data written", i)
+		}
+		off += lengths[i]
+	}
+}
@@ -0,0 +1,33 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoPeers is returned along with the response when an announce succeeds but
+// the tracker knows of no peers, as is common for fresh or dead torrents.
+var ErrNoPeers = errors.New("no peers available")
+
+// HTTPStatusError is returned when the tracker answers with an error status
+// and no bencoded body explaining it. 5xx statuses are worth retrying.
+type HTTPStatusError struct {
+	StatusCode  int
+	Status      string
+	ContentType string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("tracker returned HTTP %s (content type %q)", e.Status, e.ContentType)
+}
+
+// TrackerError is returned when the tracker rejects an announce with a
+// "failure reason", e.g. an unregistered torrent or an invalid passkey.
+type TrackerError struct {
+	URL    string
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s rejected announce: %s", e.URL, e.Reason)
+}
@@ -0,0 +1,108 @@
+package tracker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// PeerSource says where a peer's address was learned
+type PeerSource int
+
+const (
+	SourceTracker PeerSource = iota
+	SourceDHT
+	SourcePEX
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceDHT:
+		return "DHT"
+	case SourcePEX:
+		return "PEX"
+	}
+	return fmt.Sprintf("PeerSource(%d)", int(s))
+}
+
+// PeerInfo describes a peer handed out by a tracker, the DHT or PEX. ID is
+// only known when a tracker sends the dictionary form of the peer list, and
+// is zero otherwise.
+type PeerInfo struct {
+	AddrPort netip.AddrPort
+	ID       [20]byte
+	Source   PeerSource
+}
+
+// MarshalJSON encodes the peer as its address, port and source, plus its ID
+// in hex when known
+func (p PeerInfo) MarshalJSON() ([]byte, error) {
+	var id string
+	if p.ID != [20]byte{} {
+		id = hex.EncodeToString(p.ID[:])
+	}
+	return json.Marshal(struct {
+		Address string `json:"address"`
+		Port    uint16 `json:"port"`
+		Source  string `json:"source"`
+		ID      string `json:"id,omitempty"`
+	}{p.AddrPort.Addr().String(), p.AddrPort.Port(), p.Source.String(), id})
+}
+
+// Peers is a list of peer descriptors
+type Peers []PeerInfo
+
+// NewPeers describes addresses learned from source, which carry no peer IDs
+func NewPeers(addrs []netip.AddrPort, source PeerSource) Peers {
+	peers := make(Peers, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = PeerInfo{AddrPort: addr, Source: source}
+	}
+	return peers
+}
+
+// Addrs returns just the peers' addresses, in order
+func (ps Peers) Addrs() []netip.AddrPort {
+	addrs := make([]netip.AddrPort, len(ps))
+	for i, p := range ps {
+		addrs[i] = p.AddrPort
+	}
+	return addrs
+}
+
+// parseDictPeers decodes the original, non-compact peer list: one dictionary
+// per peer with "peer id", "ip" and "port". Entries whose ip is a hostname
+// rather than an address are skipped.
+func parseDictPeers(list []interface{}) (Peers, error) {
+	var peers Peers
+	for i, entry := range list {
+		ip, err := bencode.GetString(entry, "ip")
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: %w", i, err)
+		}
+		port, err := bencode.GetInt(entry, "port")
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: %w", i, err)
+		}
+		if port < 0 || port > 65535 {
+			return nil, fmt.Errorf("peer %d: port %d out of range", i, port)
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+
+		p := PeerInfo{AddrPort: netip.AddrPortFrom(addr.Unmap(), uint16(port))}
+		// The peer id is optional; trackers honouring no_peer_id leave it out
+		if id, err := bencode.GetBytes(entry, "peer id"); err == nil && len(id) == len(p.ID) {
+			copy(p.ID[:], id)
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
@@ -0,0 +1,78 @@
+package tracker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// ScrapeResponse holds a tracker's swarm statistics for one torrent
+type ScrapeResponse struct {
+	Complete   int // peers with the whole torrent (seeders)
+	Incomplete int // peers still downloading (leechers)
+	Downloaded int // times the tracker has seen the download complete
+}
+
+// ScrapeURL derives a tracker's scrape URL from its announce URL. By
+// convention the last path segment must start with "announce", which is
+// replaced by "scrape"; trackers whose URLs don't follow it can't be scraped.
+func ScrapeURL(announceURL string) (string, error) {
+	slash := strings.LastIndex(announceURL, "/")
+	if slash < 0 || !strings.HasPrefix(announceURL[slash+1:], "announce") {
+		return "", fmt.Errorf("tracker %s does not support scrape", announceURL)
+	}
+	return announceURL[:slash+1] + "scrape" + announceURL[slash+1+len("announce"):], nil
+}
+
+// Scrape asks the tracker behind announceURL for the swarm statistics of the
+// torrent with the given info hash, without announcing ourselves.
+func Scrape(announceURL string, infoHash [20]byte) (*ScrapeResponse, error) {
+	scrapeURL, err := ScrapeURL(announceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sep := "?"
+	if strings.Contains(scrapeURL, "?") {
+		sep = "&"
+	}
+	body, err := get(httpClient, scrapeURL+sep+"info_hash="+url.QueryEscape(string(infoHash[:])))
+	if err != nil {
+		return nil, err
+	}
+	return newScrapeResponseFromBytes(body, infoHash)
+}
+
+func newScrapeResponseFromBytes(response []byte, infoHash [20]byte) (*ScrapeResponse, error) {
+	decoded, err := bencode.Decode(response)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding scrape response: %w", err)
+	}
+	d, err := bencode.GetDict(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scrape response: %w", err)
+	}
+	if reason, err := bencode.GetString(d, "failure reason"); err == nil {
+		return nil, &TrackerError{Reason: reason}
+	}
+
+	files, err := bencode.GetDict(d, "files")
+	if err != nil {
+		return nil, fmt.Errorf("error reading files from scrape response: %w", err)
+	}
+	stats, err := bencode.GetDict(files, string(infoHash[:]))
+	if err != nil {
+		return nil, fmt.Errorf("scrape response has no entry for info hash %x", infoHash)
+	}
+
+	complete, _ := bencode.GetInt(stats, "complete")
+	incomplete, _ := bencode.GetInt(stats, "incomplete")
+	downloaded, _ := bencode.GetInt(stats, "downloaded")
+	return &ScrapeResponse{
+		Complete:   complete,
+		Incomplete: incomplete,
+		Downloaded: downloaded,
+	}, nil
+}
@@ -2,13 +2,28 @@ package tracker
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"github.com/codecrafters-io/bittorrent-starter-go/internal"
-	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
 	"io"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// Announce events tell the tracker where we are in a download's lifecycle.
+// Periodic re-announces send EventNone, which omits the parameter.
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
 )
 
 // TrackerRequest represents a request made to a tracker server
@@ -21,6 +36,62 @@ type TrackerRequest struct {
 	Downloaded int
 	Left       int
 	Compact    int
+	Event      string
+
+	MaxRetries int           // retries on transient failures
+	RetryDelay time.Duration // backoff before the first retry, growing linearly
+
+	// Client sends the announce; nil uses a client with TrackerTimeout and
+	// our redirect policy
+	Client *http.Client
+}
+
+// RequestOption customizes a TrackerRequest
+type RequestOption func(*TrackerRequest)
+
+// WithPort sets the port the tracker hands out to peers for reaching us.
+// Ports outside 1..65535 are ignored.
+func WithPort(port int) RequestOption {
+	return func(treq *TrackerRequest) {
+		if port > 0 && port <= 65535 {
+			treq.Port = port
+		}
+	}
+}
+
+// WithRetries sets how many times a transient failure is retried and the
+// backoff before the first retry
+func WithRetries(n int, delay time.Duration) RequestOption {
+	return func(treq *TrackerRequest) {
+		if n >= 0 {
+			treq.MaxRetries = n
+		}
+		if delay > 0 {
+			treq.RetryDelay = delay
+		}
+	}
+}
+
+// WithCompact asks for the compact peer list when set, or the original list
+// of dictionaries, which carries peer IDs, when not. Some trackers only serve
+// the dictionary form properly.
+func WithCompact(compact bool) RequestOption {
+	return func(treq *TrackerRequest) {
+		treq.Compact = 0
+		if compact {
+			treq.Compact = 1
+		}
+	}
+}
+
+// WithHTTPClient sends the announce through client, e.g. one built with
+// NewHTTPClient around a proxying transport
+func WithHTTPClient(client *http.Client) RequestOption {
+	return func(treq *TrackerRequest) {
+		if client != nil {
+			treq.Client = client
+		}
+	}
 }
 
 // NewTrackerRequest serves as a constructor for the TrackerRequest struct.
@@ -36,80 +107,258 @@ func NewTrackerRequest(
 		Downloaded: internal.DefaultDownloaded,
 		Left:       left,
 		Compact:    internal.DefaultCompact,
+		Event:      EventStarted,
+		MaxRetries: internal.DefaultTrackerRetries,
+		RetryDelay: internal.TrackerRetryDelay * time.Millisecond,
 	}
 }
 
 // getFullUrl returns the full url sent to a peer for a handshake
 func (treq TrackerRequest) getFullUrl() string {
-	return fmt.Sprintf(
+	fullUrl := fmt.Sprintf(
 		"%s?info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&compact=%d",
-		treq.TrackerURL, treq.InfoHash, treq.PeerID, treq.Port, treq.Uploaded, treq.Downloaded,
+		treq.TrackerURL, treq.InfoHash, url.QueryEscape(treq.PeerID), treq.Port, treq.Uploaded, treq.Downloaded,
 		treq.Left, treq.Compact)
+	if treq.Event != EventNone {
+		fullUrl += "&event=" + treq.Event
+	}
+	return fullUrl
 }
 
+// SendRequest announces to the tracker and parses its response.
+// Transient failures (DNS, refused or reset connections, timeouts and 5xx
+// statuses) are retried up to MaxRetries times, waiting RetryDelay times the
+// attempt number in between; anything else, including a failure reason from
+// the tracker, is returned immediately. A response without peers comes back
+// together with ErrNoPeers.
 func (treq TrackerRequest) SendRequest() (*TrackerResponse, error) {
-	resp, err := http.Get(treq.getFullUrl())
+	var lastErr error
+
+	for attempt := 0; attempt <= treq.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * treq.RetryDelay)
+		}
+
+		body, err := treq.fetch()
+		if err == nil {
+			tres, err := newTrackerResponseFromBytes(body)
+			var trackerErr *TrackerError
+			if errors.As(err, &trackerErr) {
+				trackerErr.URL = treq.TrackerURL
+			}
+			if err == nil && len(tres.Peers) == 0 {
+				err = ErrNoPeers
+			}
+			return tres, err
+		}
+
+		lastErr = err
+		if !isTransient(err) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// fetch performs a single announce and returns the raw response body
+func (treq TrackerRequest) fetch() ([]byte, error) {
+	client := treq.Client
+	if client == nil {
+		client = httpClient
+	}
+	return get(client, treq.getFullUrl())
+}
+
+// httpClient bounds every tracker request so a hung tracker can't block us
+var httpClient = NewHTTPClient(nil)
+
+// NewHTTPClient returns a client suited to tracker requests, with
+// TrackerTimeout and a redirect policy that keeps the announce parameters,
+// sending requests through transport, or http.DefaultTransport if nil. Use it
+// to route announces through a proxy or trust a custom CA.
+func NewHTTPClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       internal.TrackerTimeout * time.Second,
+		CheckRedirect: keepQueryOnRedirect,
+	}
+}
+
+// keepQueryOnRedirect follows a limited number of redirects, carrying the
+// announce parameters over when the new location drops them
+func keepQueryOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= internal.MaxTrackerRedirects {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	if req.URL.RawQuery == "" {
+		req.URL.RawQuery = via[0].URL.RawQuery
+	}
+	req.Header.Set("User-Agent", internal.UserAgent)
+	return nil
+}
+
+// get sends a GET request to the tracker and returns the raw response body.
+// Bodies over MaxTrackerResponse are refused, as are error statuses unless
+// the body is a bencoded dictionary that may explain the failure.
+func get(client *http.Client, rawURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracker request: %w", err)
+	}
+	req.Header.Set("User-Agent", internal.UserAgent)
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error sending request to tracker server: %w", err)
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+
+	if resp.ContentLength > internal.MaxTrackerResponse {
+		return nil, fmt.Errorf("tracker response too large: %d bytes", resp.ContentLength)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, internal.MaxTrackerResponse+1))
 	if err != nil {
 		return nil, fmt.Errorf("error reading tracker response body: %w", err)
 	}
-	trackerResponse, err := newTrackerResponseFromBytes(body)
-	if err != nil {
-		return nil, err
+	if len(body) > internal.MaxTrackerResponse {
+		return nil, fmt.Errorf("tracker response larger than %d bytes", internal.MaxTrackerResponse)
+	}
+
+	isBencoded := len(body) > 0 && body[0] == 'd'
+	if resp.StatusCode != http.StatusOK && !isBencoded {
+		return nil, &HTTPStatusError{
+			StatusCode:  resp.StatusCode,
+			Status:      resp.Status,
+			ContentType: resp.Header.Get("Content-Type"),
+		}
+	}
+	return body, nil
+}
+
+// isTransient reports whether err is a network failure or server error that
+// may succeed on retry
+func isTransient(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
 	}
-	return trackerResponse, nil
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
 type TrackerResponse struct {
-	Interval int
-	Peers    []netip.AddrPort
+	Interval    int // seconds to wait before the next announce
+	MinInterval int // seconds the tracker requires between announces; 0 if unset
+	Peers       Peers
+	Warning     string // non-fatal "warning message" from the tracker, if any
+	Seeders     int    // peers with the whole torrent ("complete"); 0 if unset
+	Leechers    int    // peers still downloading ("incomplete"); 0 if unset
+}
+
+// NextAnnounce returns how many seconds to wait before announcing again,
+// honouring the tracker's minimum interval.
+func (tres TrackerResponse) NextAnnounce() int {
+	return max(tres.Interval, tres.MinInterval)
 }
 
 func newTrackerResponseFromBytes(response []byte) (*TrackerResponse, error) {
 	decoded, err := bencode.Decode(response)
 	if err != nil {
-		fmt.Println("error decoding tracker response body: ", err)
-		return nil, err
+		return nil, fmt.Errorf("error decoding tracker response: %w", err)
 	}
-	d, ok := decoded.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("decoded did not return map[string]interface{}")
+	d, err := bencode.GetDict(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tracker response: %w", err)
 	}
-	interval, ok := d["interval"].(int)
-	if !ok {
-		return nil, fmt.Errorf("error reading interval from tracker response")
+
+	// A rejected announce carries only the reason, none of the other keys
+	if reason, err := bencode.GetString(d, "failure reason"); err == nil {
+		return nil, &TrackerError{Reason: reason}
 	}
+	warning, _ := bencode.GetString(d, "warning message")
 
-	peerBytes, ok := d["peers"].([]byte)
-	if !ok {
-		return nil, fmt.Errorf("error reading peers from tracker response")
+	interval, err := bencode.GetInt(d, "interval")
+	if err != nil {
+		return nil, fmt.Errorf("error reading interval from tracker response: %w", err)
 	}
 
-	var peers []netip.AddrPort
+	minInterval, _ := bencode.GetInt(d, "min interval")
+	// The swarm's size is optional, but most trackers send it
+	seeders, _ := bencode.GetInt(d, "complete")
+	leechers, _ := bencode.GetInt(d, "incomplete")
 
-	for i := 0; i < len(peerBytes); i += 6 {
-		peerAddr, ok := netip.AddrFromSlice(peerBytes[i : i+4])
-		if !ok {
-			return nil, err
-		}
-		port := binary.BigEndian.Uint16(peerBytes[i+4 : i+6])
+	// "peers" is either a compact string of IPv4 entries or, from trackers
+	// ignoring compact=1, a list of dictionaries; per BEP 7, "peers6" holds
+	// compact IPv6 entries. Either may be missing, but not both.
+	peersValue, err := bencode.Lookup(d, "peers")
+	peer6Bytes, err6 := bencode.GetBytes(d, "peers6")
+	if err != nil && err6 != nil {
+		return nil, fmt.Errorf("error reading peers from tracker response: %w", err)
+	}
 
-		peerAddrPort := netip.AddrPortFrom(peerAddr, port)
-		peers = append(peers, peerAddrPort)
+	var peers Peers
+	if list, ok := peersValue.([]interface{}); ok {
+		peers, err = parseDictPeers(list)
+		if err != nil {
+			return nil, fmt.Errorf("error reading peers from tracker response: %w", err)
+		}
+	} else if peersValue != nil {
+		peerBytes, err := bencode.GetBytes(peersValue)
+		if err != nil {
+			return nil, fmt.Errorf("error reading peers from tracker response: %w", err)
+		}
+		addrs, err := ParseCompactPeers(peerBytes, net.IPv4len)
+		if err != nil {
+			return nil, fmt.Errorf("error reading peers from tracker response: %w", err)
+		}
+		peers = NewPeers(addrs, SourceTracker)
+	}
+	addrs6, err := ParseCompactPeers(peer6Bytes, net.IPv6len)
+	if err != nil {
+		return nil, fmt.Errorf("error reading peers6 from tracker response: %w", err)
 	}
+	peers = append(peers, NewPeers(addrs6, SourceTracker)...)
 
 	return &TrackerResponse{
-		Interval: interval,
-		Peers:    peers,
-	}, err
+		Interval:    interval,
+		MinInterval: minInterval,
+		Peers:       peers,
+		Warning:     warning,
+		Seeders:     max(seeders, 0),
+		Leechers:    max(leechers, 0),
+	}, nil
+}
+
+// ParseCompactPeers decodes a compact peer list made of ipLen-byte addresses,
+// each followed by a 2-byte big-endian port, as sent by trackers, PEX and the
+// DHT. A list that isn't a whole number of entries is refused.
+func ParseCompactPeers(peerBytes []byte, ipLen int) ([]netip.AddrPort, error) {
+	stride := ipLen + 2
+	if len(peerBytes)%stride != 0 {
+		return nil, fmt.Errorf("compact peer list of %d bytes is not a multiple of %d", len(peerBytes), stride)
+	}
+
+	var peers []netip.AddrPort
+	for i := 0; i < len(peerBytes); i += stride {
+		peerAddr, _ := netip.AddrFromSlice(peerBytes[i : i+ipLen])
+		port := binary.BigEndian.Uint16(peerBytes[i+ipLen : i+stride])
+
+		// IPv4-mapped entries in peers6 are the same peers as in peers
+		peers = append(peers, netip.AddrPortFrom(peerAddr.Unmap(), port))
+	}
+	return peers, nil
 }
 
 func (tres TrackerResponse) PeersString() string {
-	peers := tres.Peers
+	peers := tres.Peers.Addrs()
 	peersString := ""
 	for _, peer := range peers {
 		peersString += fmt.Sprintf("%s\n", peer.String())
@@ -0,0 +1,74 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// announceResponse is a tracker response with one compact peer, 1.2.3.4:6881
+const announceResponse = "d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe1e"
+
+func TestSendRequestRetriesTransientFailure(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(announceResponse))
+	}))
+	defer srv.Close()
+
+	treq := NewTrackerRequest(srv.URL, "%00", 100)
+	WithRetries(2, time.Millisecond)(treq)
+
+	tres, err := treq.SendRequest()
+	if err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("tracker got %d requests, want 2", n)
+	}
+	want := netip.MustParseAddrPort("1.2.3.4:6881")
+	if addrs := tres.Peers.Addrs(); len(addrs) != 1 || addrs[0] != want {
+		t.Errorf("got peers %v, want [%v]", addrs, want)
+	}
+}
+
+func TestSendRequestDoesNotRetryFailureReason(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("d14:failure reason7:go awaye"))
+	}))
+	defer srv.Close()
+
+	treq := NewTrackerRequest(srv.URL, "%00", 100)
+	WithRetries(2, time.Millisecond)(treq)
+
+	if _, err := treq.SendRequest(); err == nil {
+		t.Fatal("SendRequest succeeded despite a failure reason")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("tracker got %d requests, want 1", n)
+	}
+}
+
+func TestMalformedCompactPeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"7-byte peers", "d8:intervali900e5:peers7:\x01\x02\x03\x04\x1a\xe1\x01e"},
+		{"19-byte peers6", "d8:intervali900e6:peers619:" + string(make([]byte, 19)) + "e"},
+	}
+	for _, tt := range tests {
+		if _, err := newTrackerResponseFromBytes([]byte(tt.response)); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}